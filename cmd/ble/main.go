@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"os"
 
 	proto "github.com/golang/protobuf/proto"
 	"github.com/paypal/gatt"
@@ -62,10 +62,16 @@ func (r r) Notify() <-chan []byte {
 	return c
 }
 
+var (
+	inf   = flag.String("inf", "wlan0", "network interface where the nodes live")
+	laddr = flag.String("laddr", "10.0.0.1", "local address of the network interface")
+)
+
 func main() {
+	flag.Parse()
 	var err error
 	client := r{}
-	srv, err = qsy.NewServer(ctx, os.Stdout, "wlan0", "10.0.0.1", client)
+	srv, err = qsy.NewServer(ctx, *inf, *laddr, client)
 	if err != nil {
 		log.Fatalf("failed to create server: %s", err)
 	}
@@ -0,0 +1,128 @@
+// Command qsycap records the traffic of QSY nodes to a capture
+// and replays captures.
+//
+//	qsycap record [-o capture.jsonl] [-inf wlan0] [-laddr 10.0.0.1]
+//	qsycap replay [-speed 1] capture.jsonl
+//
+// Captures are JSON lines, see qsy.Record. Recording runs a QSY
+// server until interrupted, replaying prints every event.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"qsydev.com/term/pkg/qsy"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	var err error
+	switch os.Args[1] {
+	case "record":
+		err = record(ctx, os.Args[2:])
+	case "replay":
+		err = replay(ctx, os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil && err != context.Canceled {
+		log.Fatalf("qsycap: %s", err)
+	}
+}
+
+func usage() {
+	log.Fatalf("usage: qsycap record|replay [flags]")
+}
+
+// record captures the traffic of the nodes until ctx is done.
+func record(ctx context.Context, args []string) error {
+	var (
+		fs        = flag.NewFlagSet("record", flag.ExitOnError)
+		out       = fs.String("o", "", "file the capture is written to, empty writes to stdout")
+		inf       = fs.String("inf", "wlan0", "network interface where the nodes live")
+		laddr     = fs.String("laddr", "10.0.0.1", "local address of the network interface")
+		port      = fs.Int("port", qsy.QSYPort, "port used for reaching the nodes")
+		keepAlive = fs.Duration("keepalive", qsy.DefaultDelay*time.Second, "time a node can go without sending keep alives")
+	)
+	fs.Parse(args)
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	rec := qsy.NewRecorder(w, nil)
+	srv, err := qsy.NewServer(ctx, *inf, *laddr, rec, qsy.WithPort(*port), qsy.WithKeepAlive(*keepAlive))
+	if err != nil {
+		return err
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	srv.Wait()
+	return rec.Err()
+}
+
+// replay prints the events of the capture.
+func replay(ctx context.Context, args []string) error {
+	var (
+		fs    = flag.NewFlagSet("replay", flag.ExitOnError)
+		speed = fs.Float64("speed", 1, "speed of the replay, zero replays without waiting")
+	)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected a capture file")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return qsy.Replay(ctx, f, printer{}, *speed)
+}
+
+// printer prints the events it listens to.
+type printer struct{}
+
+func (printer) Receive(p qsy.Packet) {
+	fmt.Printf("in   node %v: %s, delay %v, step %v\n", p.ID, p, p.Delay, p.Step)
+}
+
+func (printer) PacketSent(p qsy.Packet) {
+	fmt.Printf("out  node %v: %s, delay %v, step %v\n", p.ID, p, p.Delay, p.Step)
+}
+
+func (printer) NewNode(id uint16) {
+	fmt.Printf("new  node %v\n", id)
+}
+
+func (printer) LostNode(id uint16) {
+	fmt.Printf("lost node %v\n", id)
+}
+
+func (printer) NodeReconnected(id uint16) {
+	fmt.Printf("back node %v\n", id)
+}
@@ -0,0 +1,458 @@
+// Command qsydump decodes and prints QSY packets read from a
+// pcap capture or a live socket.
+//
+//	qsydump [flags] capture.pcap
+//	qsydump [flags] -live udp:224.0.0.12:3000 [-inf wlan0]
+//	qsydump [flags] -live tcp:10.0.0.5:3000
+//
+// Live UDP addresses in a multicast group join the group, live
+// TCP addresses are dialed. Frames that can't be decoded, and
+// the bytes between frames, are printed as MALFORMED along with
+// their bytes in hex regardless of the filters.
+//
+// UDP datagrams are hellos and are decoded as v1. The frames of
+// a TCP connection are decoded with the protocol version of the
+// handshake hello the server starts it with, or as v1 without
+// one. -proto forces the version of every TCP connection, e.g.
+// for captures that start after the handshake.
+//
+// The TCP payloads of a capture are joined in the order they
+// were captured, without looking at their sequence numbers, so
+// retransmitted frames are printed twice.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+
+	"qsydev.com/term/internal/pcap"
+	"qsydev.com/term/pkg/qsy"
+)
+
+var (
+	live    = flag.String("live", "", "udp:host:port or tcp:host:port to read from instead of a capture")
+	inf     = flag.String("inf", "", "network interface used for joining live multicast groups")
+	version = flag.Uint("proto", 0, "protocol version of the TCP frames, 0 takes it from the handshake")
+	id      = flag.Int("id", -1, "only print packets of the node id")
+	typ     = flag.String("type", "", "only print packets of the type: hello, command, touche, keepalive or a number")
+	step    = flag.Int("step", -1, "only print packets of the step")
+
+	// signature is the start of every frame.
+	signature = []byte("QSY")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	f, err := newFilter(*id, *typ, *step)
+	if err != nil {
+		log.Fatalf("qsydump: %s", err)
+	}
+	d := newDumper(os.Stdout, f)
+	if *version != 0 {
+		if d.codec, err = qsy.LookupCodec(uint16(*version)); err != nil {
+			log.Fatalf("qsydump: %s", err)
+		}
+	}
+	switch {
+	case *live != "":
+		err = d.live(ctx, *live)
+	case flag.NArg() == 1:
+		err = d.capture(flag.Arg(0))
+	default:
+		log.Fatalf("usage: qsydump [flags] capture.pcap | -live udp:host:port | -live tcp:host:port")
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Fatalf("qsydump: %s", err)
+	}
+}
+
+// filter decides which packets are printed, negative fields
+// match any packet.
+type filter struct {
+	id, typ, step int
+}
+
+// newFilter returns the filter of the flags.
+func newFilter(id int, typ string, step int) (filter, error) {
+	f := filter{id: id, typ: -1, step: step}
+	switch strings.ToLower(typ) {
+	case "":
+	case "hello":
+		f.typ = qsy.HelloT
+	case "command":
+		f.typ = qsy.CommandT
+	case "touche":
+		f.typ = qsy.ToucheT
+	case "keepalive":
+		f.typ = qsy.KeepAliveT
+	default:
+		t, err := strconv.ParseUint(typ, 0, 8)
+		if err != nil {
+			return f, errors.Errorf("unknown packet type %q", typ)
+		}
+		f.typ = int(t)
+	}
+	return f, nil
+}
+
+func (f filter) match(pkt qsy.Packet) bool {
+	return (f.id < 0 || int(pkt.ID) == f.id) &&
+		(f.typ < 0 || int(pkt.T) == f.typ) &&
+		(f.step < 0 || int(pkt.Step) == f.step)
+}
+
+// dumper splits the streams in frames and prints them.
+type dumper struct {
+	w      io.Writer
+	filter filter
+	// codec is the codec of every TCP connection if not nil.
+	codec qsy.Codec
+	// streams holds the bytes of each stream that are not a
+	// whole frame yet.
+	streams map[string][]byte
+	// conns holds the codec of each TCP connection after its
+	// first frame.
+	conns map[string]qsy.Codec
+}
+
+func newDumper(w io.Writer, f filter) *dumper {
+	return &dumper{w: w, filter: f, streams: map[string][]byte{}, conns: map[string]qsy.Codec{}}
+}
+
+// capture dumps the packets of the pcap capture.
+func (d *dumper) capture(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		d.payload(p)
+	}
+	// streams that end in the middle of a frame
+	for flow, b := range d.streams {
+		if len(b) > 0 {
+			d.malformed(time.Time{}, flow, b, errors.Wrap(qsy.ErrShortPacket, "end of capture"))
+		}
+	}
+	return nil
+}
+
+// live dumps the packets read from the address until ctx is
+// done.
+func (d *dumper) live(ctx context.Context, addr string) error {
+	i := strings.Index(addr, ":")
+	if i < 0 {
+		return errors.Errorf("invalid live address %q", addr)
+	}
+	network, addr := addr[:i], addr[i+1:]
+	switch network {
+	case "udp":
+		return d.liveUDP(ctx, addr)
+	case "tcp":
+		return d.liveTCP(ctx, addr)
+	default:
+		return errors.Errorf("invalid live network %q", network)
+	}
+}
+
+func (d *dumper) liveUDP(ctx context.Context, addr string) error {
+	udp, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	c, err := net.ListenPacket("udp4", net.JoinHostPort("0.0.0.0", strconv.Itoa(udp.Port)))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	p := ipv4.NewPacketConn(c)
+	if udp.IP.IsMulticast() {
+		var i *net.Interface
+		if *inf != "" {
+			if i, err = net.InterfaceByName(*inf); err != nil {
+				return errors.Wrap(err, "invalid network interface")
+			}
+		}
+		if err := p.JoinGroup(i, &net.UDPAddr{IP: udp.IP}); err != nil {
+			return errors.Wrap(err, "failed to join group")
+		}
+	}
+	b := make([]byte, 1<<16)
+	for {
+		n, _, src, err := p.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		d.payload(pcap.Packet{Time: time.Now(), Proto: "udp", Src: src.String(), Dst: addr, Payload: b[:n]})
+	}
+}
+
+func (d *dumper) liveTCP(ctx context.Context, addr string) error {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "tcp4", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Read(b)
+		if n > 0 {
+			d.payload(pcap.Packet{Time: time.Now(), Proto: "tcp", Src: c.RemoteAddr().String(), Dst: c.LocalAddr().String(), Payload: b[:n]})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// payload prints the frames of the payload of the packet. The
+// bytes of a TCP flow are kept until they make a whole frame,
+// UDP datagrams hold whole frames.
+func (d *dumper) payload(p pcap.Packet) {
+	var (
+		at       = p.Time
+		flow     = p.Flow()
+		datagram = p.Proto == "udp"
+		buf      = append(d.streams[flow], p.Payload...)
+	)
+	for len(buf) > 0 {
+		i := bytes.Index(buf, signature)
+		if i != 0 {
+			skip := i
+			if i < 0 {
+				skip = resync(buf, 0, datagram)
+			}
+			if skip > 0 {
+				d.malformed(at, flow, buf[:skip], qsy.ErrBadSignature)
+				buf = buf[skip:]
+				continue
+			}
+			if i < 0 {
+				break
+			}
+		}
+		codec, first := d.codecOf(p)
+		size, err := frameSize(codec, buf)
+		if err != nil {
+			// the header is not a frame, skip to the next
+			// signature
+			skip := resync(buf, 1, datagram)
+			d.malformed(at, flow, buf[:skip], err)
+			buf = buf[skip:]
+			continue
+		}
+		if size < 0 || len(buf) < size {
+			if datagram {
+				d.malformed(at, flow, buf, qsy.ErrShortPacket)
+				buf = nil
+			}
+			break
+		}
+		pkt, ok := d.frame(at, flow, codec, buf[:size])
+		if first {
+			d.conns[conn(p)] = negotiated(pkt, ok)
+		}
+		buf = buf[size:]
+	}
+	d.streams[flow] = append([]byte(nil), buf...)
+}
+
+// codecOf returns the codec of the next frame of the packet,
+// first is true if it is the first frame of a TCP connection.
+// UDP datagrams and first frames are v1.
+func (d *dumper) codecOf(p pcap.Packet) (codec qsy.Codec, first bool) {
+	if p.Proto == "udp" {
+		return qsy.V1Codec{}, false
+	}
+	if d.codec != nil {
+		return d.codec, false
+	}
+	if c, ok := d.conns[conn(p)]; ok {
+		return c, false
+	}
+	return qsy.V1Codec{}, true
+}
+
+// conn returns the TCP connection of the packet, it is the
+// same for both directions.
+func conn(p pcap.Packet) string {
+	if p.Src < p.Dst {
+		return p.Src + " " + p.Dst
+	}
+	return p.Dst + " " + p.Src
+}
+
+// negotiated returns the codec of a connection whose first
+// frame is pkt. A hello with qsy.VersionConfig is the handshake
+// of the server, connections without one speak v1.
+func negotiated(pkt qsy.Packet, ok bool) qsy.Codec {
+	if !ok || pkt.T != qsy.HelloT || pkt.Config&qsy.VersionConfig == 0 {
+		return qsy.V1Codec{}
+	}
+	c, err := qsy.LookupCodec(pkt.Step)
+	if err != nil {
+		return qsy.V1Codec{}
+	}
+	return c
+}
+
+// resync returns the amount of bytes of b before the next
+// signature found after from. Without one every byte is skipped
+// but, in a stream, the last two as they might be the start of
+// a signature.
+func resync(b []byte, from int, datagram bool) int {
+	if i := bytes.Index(b[from:], signature); i >= 0 {
+		return from + i
+	}
+	if datagram {
+		return len(b)
+	}
+	if len(b) < 2 {
+		return 0
+	}
+	return len(b) - 2
+}
+
+// frameSize returns the size of the frame of the codec at the
+// start of b or -1 if b is too short to tell. Like the codec, it
+// returns an error if the fields are longer than
+// qsy.MaxExtensionSize.
+func frameSize(codec qsy.Codec, b []byte) (int, error) {
+	if codec.Version() < qsy.ProtocolV2 {
+		return qsy.PacketSize, nil
+	}
+	if len(b) < qsy.PacketSize+2 {
+		return -1, nil
+	}
+	size := int(binary.BigEndian.Uint16(b[qsy.PacketSize:]))
+	if size > qsy.MaxExtensionSize {
+		return -1, errors.Errorf("fields are too long: %v bytes", size)
+	}
+	return qsy.PacketSize + 2 + size, nil
+}
+
+// frame decodes and prints the frame. It returns the packet
+// and false if it was malformed.
+func (d *dumper) frame(at time.Time, flow string, codec qsy.Codec, b []byte) (qsy.Packet, bool) {
+	pkt := qsy.Packet{}
+	if err := codec.Decode(b, &pkt); err != nil {
+		d.malformed(at, flow, b, err)
+		return pkt, false
+	}
+	if !d.filter.match(pkt) {
+		return pkt, true
+	}
+	fmt.Fprintf(d.w, "%s %s %-9s id=%v color=%s delay=%v step=%v config=%s",
+		timestamp(at), flow, typeName(pkt.T), pkt.ID, pkt.Color, pkt.Delay, pkt.Step, configFlags(pkt))
+	if pkt.Animation.Kind != qsy.Steady {
+		a := pkt.Animation
+		fmt.Fprintf(d.w, " animation=%s period=%s fade=%s/%s", a.Kind, a.Period, a.FadeIn, a.FadeOut)
+	}
+	fmt.Fprintln(d.w)
+	return pkt, true
+}
+
+// malformed prints the bytes that could not be decoded.
+func (d *dumper) malformed(at time.Time, flow string, b []byte, err error) {
+	fmt.Fprintf(d.w, "%s %s MALFORMED %s: % x\n", timestamp(at), flow, err, b)
+}
+
+func timestamp(at time.Time) string {
+	if at.IsZero() {
+		return "--:--:--.------"
+	}
+	return at.Format("15:04:05.000000")
+}
+
+func typeName(t uint8) string {
+	switch t {
+	case qsy.HelloT:
+		return "Hello"
+	case qsy.CommandT:
+		return "Command"
+	case qsy.ToucheT:
+		return "Touche"
+	case qsy.KeepAliveT:
+		return "KeepAlive"
+	default:
+		return fmt.Sprintf("Type(%v)", t)
+	}
+}
+
+// configFlags returns the names of the config bits set in the
+// packet.
+func configFlags(pkt qsy.Packet) string {
+	s := pkt.Settings()
+	flags := []string{}
+	if s.Distance {
+		flags = append(flags, "Distance")
+	}
+	if s.Sound {
+		flags = append(flags, "Sound")
+	}
+	if s.Sensitivity > 0 {
+		flags = append(flags, fmt.Sprintf("Sensitivity(%v)", s.Sensitivity))
+	}
+	if s.Brightness > 0 {
+		flags = append(flags, fmt.Sprintf("Brightness(%v)", s.Brightness))
+	}
+	if pkt.Config&qsy.VersionConfig != 0 {
+		flags = append(flags, "Version")
+	}
+	if pkt.Config&qsy.FrameConfig != 0 {
+		flags = append(flags, "Frame")
+	}
+	if pkt.Config&qsy.AssignIDConfig != 0 {
+		flags = append(flags, "AssignID")
+	}
+	if pkt.Config&qsy.ProbeConfig != 0 {
+		flags = append(flags, "Probe")
+	}
+	if len(flags) == 0 {
+		return "-"
+	}
+	return strings.Join(flags, "|")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"qsydev.com/term/internal/pcap"
+	"qsydev.com/term/pkg/qsy"
+)
+
+func encode(t *testing.T, c qsy.Codec, pkt qsy.Packet) []byte {
+	b, err := c.Encode(pkt)
+	if err != nil {
+		t.Fatalf("failed to encode %s: %s", pkt, err)
+	}
+	return b
+}
+
+func TestMixedVersions(t *testing.T) {
+	var (
+		v1, v2  = qsy.V1Codec{}, qsy.V2Codec{}
+		server  = "10.0.0.1:40000"
+		v1Node  = "10.0.0.11:3000"
+		v2Node  = "10.0.0.12:3000"
+		blink   = qsy.NewPacket(qsy.CommandT, 12, qsy.Red, 0, 1, false, false)
+		tooLong = encode(t, v2, qsy.NewPacket(qsy.ToucheT, 12, qsy.Red, 0, 1, false, false))
+		out     = &bytes.Buffer{}
+		d       = newDumper(out, filter{id: -1, typ: -1, step: -1})
+	)
+	blink.Animation = qsy.Animation{Kind: qsy.Blink, Period: qsy.MinAnimationPeriod}
+	command := encode(t, v2, blink)
+	binary.BigEndian.PutUint16(tooLong[qsy.PacketSize:], qsy.MaxExtensionSize+1)
+	packets := []pcap.Packet{
+		// a v1 node with junk where the version would be
+		{Proto: "udp", Src: "10.0.0.11:5000", Dst: "224.0.0.12:3000", Payload: encode(t, v1, qsy.NewPacket(qsy.HelloT, 11, qsy.NoColor, 7, 9, false, false))},
+		{Proto: "udp", Src: "10.0.0.12:5000", Dst: "224.0.0.12:3000", Payload: encode(t, v1, qsy.NewHelloPacket(12, qsy.ProtocolV2, qsy.CapProbe))},
+		{Proto: "tcp", Src: server, Dst: v1Node, Payload: encode(t, v1, qsy.NewPacket(qsy.CommandT, 11, qsy.Green, 0, 1, false, false))},
+		{Proto: "tcp", Src: v1Node, Dst: server, Payload: encode(t, v1, qsy.NewPacket(qsy.ToucheT, 11, qsy.Green, 100, 1, false, false))},
+		// the handshake is a v1 hello
+		{Proto: "tcp", Src: server, Dst: v2Node, Payload: encode(t, v1, qsy.NewHelloPacket(12, qsy.ProtocolV2, 0))},
+		{Proto: "tcp", Src: server, Dst: v2Node, Payload: command[:20]},
+		{Proto: "tcp", Src: server, Dst: v2Node, Payload: command[20:]},
+		{Proto: "tcp", Src: v2Node, Dst: server, Payload: append(tooLong, encode(t, v2, qsy.NewPacket(qsy.ToucheT, 12, qsy.Red, 200, 1, false, false))...)},
+	}
+	for _, p := range packets {
+		p.Time = time.Now()
+		d.payload(p)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		"Hello     id=11 color=NoColor delay=7 step=9 config=-",
+		"Hello     id=12 color=NoColor delay=1 step=2 config=Version",
+		"Command   id=11",
+		"Touche    id=11",
+		"Hello     id=12 color=NoColor delay=0 step=2 config=Version",
+		"Command   id=12 color=Red delay=0 step=1 config=- animation=Blink",
+		"MALFORMED fields are too long",
+		"Touche    id=12 color=Red delay=200",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v lines but got:\n%s", len(expected), out)
+	}
+	for i, e := range expected {
+		if !strings.Contains(lines[i], e) {
+			t.Fatalf("expected line %v to contain %q but got %q", i, e, lines[i])
+		}
+	}
+}
@@ -2,17 +2,54 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
+	"os"
+	"time"
 
 	"qsydev.com/term/internal/terminal"
+	"qsydev.com/term/pkg/qsy"
+)
+
+var (
+	inf       = flag.String("inf", "wlan0", "network interface where the nodes live")
+	laddr     = flag.String("laddr", "10.0.0.1", "local address of the network interface")
+	port      = flag.Int("port", qsy.QSYPort, "port used for reaching the nodes")
+	keepAlive = flag.Duration("keepalive", qsy.DefaultDelay*time.Second, "time a node can go without sending keep alives")
+	grace     = flag.Duration("grace", 0, "time a lost node has to come back before being reported lost")
+	pairings  = flag.String("pairings", "", "file where paired nodes are kept, empty accepts any node")
+	pair      = flag.Duration("pair", 0, "time to pair new nodes for after starting")
+	capture   = flag.String("capture", "", "file where the traffic of the nodes is recorded, see qsycap")
 )
 
 func main() {
+	flag.Parse()
 	// TODO: check for setup stuff
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	t := &terminal.T{}
+	opts := []qsy.Option{
+		qsy.WithInterface(*inf),
+		qsy.WithLocalAddress(*laddr),
+		qsy.WithPort(*port),
+		qsy.WithKeepAlive(*keepAlive),
+		qsy.WithReconnectGrace(*grace),
+	}
+	if *pairings != "" {
+		opts = append(opts, qsy.WithPairings(qsy.NewFileStore(*pairings)))
+	}
+	t := &terminal.T{
+		Options: opts,
+		Pair:    *pair,
+	}
+	if *capture != "" {
+		f, err := os.Create(*capture)
+		if err != nil {
+			log.Fatalf("failed to create capture: %s", err)
+		}
+		defer f.Close()
+		t.Capture = f
+	}
 	if err := t.Run(ctx); err != nil {
 		log.Printf("terminal interrupted: %s", err)
 	}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
+	"time"
 
 	"qsydev.com/term/pkg/qsy"
 )
@@ -24,9 +26,17 @@ func (r r) NewNode(id uint16) {
 	log.Printf("new node: %v", id)
 }
 
+var (
+	inf       = flag.String("inf", "wlan0", "network interface where the nodes live")
+	laddr     = flag.String("laddr", "10.0.0.1", "local address of the network interface")
+	port      = flag.Int("port", qsy.QSYPort, "port used for reaching the nodes")
+	keepAlive = flag.Duration("keepalive", qsy.DefaultDelay*time.Second, "time a node can go without sending keep alives")
+)
+
 func main() {
+	flag.Parse()
 	ctx := context.Background()
-	s, err := qsy.NewServer(ctx, os.Stdout, "wlan0", "10.0.0.1", r{})
+	s, err := qsy.NewServer(ctx, *inf, *laddr, r{}, qsy.WithPort(*port), qsy.WithKeepAlive(*keepAlive))
 	if err != nil {
 		log.Printf("failed to create server: %s", err)
 		os.Exit(1)
@@ -1,5 +1,7 @@
 module qsydev.com/term
 
+go 1.21
+
 require (
 	github.com/golang/protobuf v1.2.0
 	github.com/paypal/gatt v0.0.0-20151011220935-4ae819d591cf
@@ -1,19 +1,35 @@
 package executor
 
-import "time"
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"qsydev.com/term/internal/tree"
+)
 
 // Custom wraps a CustomExecutor with the functionality
 // necessary to be executed.
 type Custom struct {
 	*executor
 	*CustomExecutor
+
+	compiled []*step
 }
 
-// Start starts the executor using sender to send commands.
+// Start starts the executor using sender to send commands. It
+// returns an error if the expression of any step is not valid,
+// see tree.Check.
 func (c *Custom) Start(sender Sender) error {
 	if c.CustomExecutor == nil {
 		return ErrInvalidExecutor
 	}
+	compiled, err := c.compile()
+	if err != nil {
+		return err
+	}
+	c.compiled = compiled
 	c.executor = &executor{
 		events:      make(chan Event, eventChannelSize),
 		sender:      sender,
@@ -25,9 +41,33 @@ func (c *Custom) Start(sender Sender) error {
 	return nil
 }
 
+// compile returns the steps with the checked tree of their
+// expression.
+func (c *Custom) compile() ([]*step, error) {
+	compiled := make([]*step, len(c.GetSteps()))
+	for i, s := range c.GetSteps() {
+		ids := make([]int, len(s.GetNodeConfigs()))
+		for j, nc := range s.GetNodeConfigs() {
+			ids[j] = int(nc.GetId())
+		}
+		st, err := newStep(s)
+		if err == nil {
+			err = tree.Check(st.tree, ids)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid step %v", i+1)
+		}
+		if irrelevant := tree.Irrelevant(st.tree, ids); len(irrelevant) > 0 {
+			log.Printf("nodes %v of step %v never change the outcome of its expression", irrelevant, i+1)
+		}
+		compiled[i] = st
+	}
+	return compiled, nil
+}
+
 // generateNextSteps returns the next step to be executed.
 func (c *Custom) generateNextStep() *step {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return newStep(c.GetSteps()[c.stepID-1])
+	return c.compiled[c.stepID-1]
 }
@@ -1,6 +1,12 @@
 package executor
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"qsydev.com/term/internal/tree"
+)
 
 func TestCustomGenerateNextStep(t *testing.T) {
 	t.Parallel()
@@ -11,6 +17,11 @@ func TestCustomGenerateNextStep(t *testing.T) {
 		},
 		executor: &executor{stepID: 1},
 	}
+	compiled, err := c.compile()
+	if err != nil {
+		t.Fatalf("failed to compile steps: %s", err)
+	}
+	c.compiled = compiled
 	s := c.generateNextStep()
 	if s.GetExpression() != "1" {
 		t.Fatalf("expected expression to be 1 but got %s", s.GetExpression())
@@ -33,3 +44,60 @@ func TestCustomGenerateNextStep(t *testing.T) {
 		t.Fatalf("expected id and color to be 2 and Blue, got %d and %s", nc.Id, nc.Color)
 	}
 }
+
+func TestCustomStartInvalid(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		expression string
+		err        error
+	}{
+		{name: "unknown node", expression: "1 & 3", err: tree.ErrUnknownNode},
+		{name: "tautology", expression: "1 | !1", err: tree.ErrTautology},
+		{name: "unsatisfiable", expression: "1 & !1", err: tree.ErrUnsatisfiable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(tt *testing.T) {
+			c := &Custom{
+				CustomExecutor: &CustomExecutor{
+					Steps: []*Step{
+						&Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}}, Expression: "1"},
+						&Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}, &NodeConfig{Id: 2}}, Expression: tc.expression},
+					},
+				},
+			}
+			if err := c.Start(&s{r: make(chan uint32, 2)}); errors.Cause(err) != tc.err {
+				tt.Fatalf("expected %v but got %v", tc.err, err)
+			}
+		})
+	}
+	c := &Custom{CustomExecutor: &CustomExecutor{Steps: []*Step{&Step{Expression: "1 &"}}}}
+	if err := c.Start(&s{}); err == nil {
+		t.Fatalf("expected a syntax error")
+	}
+}
+
+func TestCustomStartTree(t *testing.T) {
+	t.Parallel()
+
+	leaf := func(id uint32) *Expr { return &Expr{Op: Expr_NODE, Id: id} }
+	step := &Step{
+		NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}, &NodeConfig{Id: 18}},
+		Expression:  "not used",
+		Tree:        &Expr{Op: Expr_THEN, Args: []*Expr{leaf(18), leaf(1)}},
+	}
+	c := &Custom{CustomExecutor: &CustomExecutor{Steps: []*Step{step}}}
+	if err := c.Start(&s{r: make(chan uint32, 2)}); err != nil {
+		t.Fatalf("failed to start: %s", err)
+	}
+	if st := c.compiled[0]; st.done(18) || !st.done(1) {
+		t.Fatalf("expected step to be done after touching 18 then 1")
+	}
+
+	step.Tree = &Expr{Op: Expr_AND, Args: []*Expr{leaf(18)}}
+	c = &Custom{CustomExecutor: &CustomExecutor{Steps: []*Step{step}}}
+	if err := c.Start(&s{r: make(chan uint32, 2)}); errors.Cause(err) != tree.ErrInvalidExpr {
+		t.Fatalf("expected invalid expression tree but got %v", err)
+	}
+}
@@ -36,6 +36,22 @@ type Sender interface {
 	Send(stepID uint32, node NodeConfig)
 }
 
+// BatchSender is a Sender that can send the node configs
+// of a step at once. Executors use SendAll when the sender
+// implements it so that every node turns on at the same time.
+type BatchSender interface {
+	Sender
+	SendAll(stepID uint32, nodes []NodeConfig)
+}
+
+// NodeLister is a Sender that knows the IDs of the connected
+// nodes. Random executors make their steps of those nodes when
+// the sender implements it.
+type NodeLister interface {
+	Sender
+	Nodes() []uint32
+}
+
 // E knows how to advance after each touche
 // and exposes the events that happen durinig the
 // execution.
@@ -88,7 +104,10 @@ func (e *executor) Events() <-chan Event {
 }
 
 // Touche adds the nodeID as touched. If stepID is not the
-// same one than the current step then this does nothing.
+// same one than the current step then this does nothing. A
+// touche of a node that is not in the step sends a WrongNode
+// event whatever its stepID, the node was not turned on with
+// the current step so it has no way of knowing it.
 func (e *executor) Touche(stepID, nodeID, delay uint32) {
 	e.touche(stepID, nodeID, delay)
 }
@@ -103,11 +122,19 @@ func (e *executor) start() {
 
 func (e *executor) touche(stepID, nodeID, delay uint32) {
 	e.mu.RLock()
-	if e.done || stepID != e.stepID {
+	current := e.stepID
+	if e.done {
 		e.mu.RUnlock()
 		return
 	}
 	e.mu.RUnlock()
+	if !e.step.has(nodeID) {
+		e.wrongNodeEvent(nodeID)
+		return
+	}
+	if stepID != current {
+		return
+	}
 	if done := e.step.done(nodeID); !done {
 		return
 	}
@@ -139,9 +166,7 @@ func (e *executor) nextStep() {
 func (e *executor) sendStep() {
 	e.step = e.getNextStep()
 	e.mu.RLock()
-	for _, nc := range e.step.NodeConfigs {
-		e.sender.Send(e.stepID, *nc)
-	}
+	e.send(e.stepID, e.step.NodeConfigs)
 	e.mu.RUnlock()
 	if e.step.GetTimeout() != 0 {
 		e.stepTimer = time.AfterFunc(time.Duration(e.step.GetTimeout())*time.Millisecond, e.stepTimeout)
@@ -168,9 +193,24 @@ func (e *executor) stepTimeout() {
 }
 
 func (e *executor) cancelStep() {
-	for _, nc := range e.step.NodeConfigs {
-		e.sender.Send(0, *nc)
+	e.send(0, e.step.NodeConfigs)
+}
+
+// send sends the node configs using the sender, all at once
+// if it is a BatchSender.
+func (e *executor) send(stepID uint32, ncs []*NodeConfig) {
+	bs, ok := e.sender.(BatchSender)
+	if !ok {
+		for _, nc := range ncs {
+			e.sender.Send(stepID, *nc)
+		}
+		return
 	}
+	nodes := make([]NodeConfig, 0, len(ncs))
+	for _, nc := range ncs {
+		nodes = append(nodes, *nc)
+	}
+	bs.SendAll(stepID, nodes)
 }
 
 func (e *executor) routineTimeout() {
@@ -203,9 +243,11 @@ func (e *executor) stepTimeoutEvent() {
 
 func (e *executor) toucheEvent(nodeID, delay uint32) {
 	e.mu.RLock()
+	color, rgb := e.step.nodeColor(nodeID)
 	e.events <- Event{
 		Type:  Event_Touche,
-		Color: e.step.nodeColor(nodeID),
+		Color: color,
+		Rgb:   rgb,
 		Delay: delay,
 		Step:  e.stepID,
 		Node:  nodeID,
@@ -213,6 +255,16 @@ func (e *executor) toucheEvent(nodeID, delay uint32) {
 	e.mu.RUnlock()
 }
 
+func (e *executor) wrongNodeEvent(nodeID uint32) {
+	e.mu.RLock()
+	e.events <- Event{
+		Type: Event_WrongNode,
+		Step: e.stepID,
+		Node: nodeID,
+	}
+	e.mu.RUnlock()
+}
+
 func (e *executor) routineEndEvent() {
 	e.events <- Event{
 		Type: Event_End,
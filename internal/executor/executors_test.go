@@ -13,6 +13,17 @@ func (s *s) Send(stepID uint32, config NodeConfig) {
 	s.r <- config.GetId()
 }
 
+// validStep returns the step of s, its expression must be
+// valid.
+func validStep(t *testing.T, s *Step) *step {
+	t.Helper()
+	st, err := newStep(s)
+	if err != nil {
+		t.Fatalf("invalid step %q: %s", s.GetExpression(), err)
+	}
+	return st
+}
+
 func TestStepTimeout(t *testing.T) {
 	t.Parallel()
 
@@ -21,7 +32,7 @@ func TestStepTimeout(t *testing.T) {
 		sender:        &s{r: schan},
 		events:        make(chan Event, 2),
 		stopOnTimeout: true,
-		step:          newStep(&Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}}}),
+		step:          validStep(t, &Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}}, Expression: "1"}),
 	}
 	e.stepTimer = time.AfterFunc(10*time.Millisecond, e.stepTimeout)
 	if event := <-e.events; event.GetType() != Event_StepTimeout {
@@ -34,12 +45,13 @@ func TestStepTimeout(t *testing.T) {
 		t.Fatalf("expected node id 1 to be sent but go %d", nid)
 	}
 
+	next := validStep(t, &Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 2}}, Expression: "2"})
 	e = &executor{
 		sender:        &s{r: schan},
 		events:        make(chan Event, 1),
 		stopOnTimeout: false,
-		step:          newStep(&Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}}}),
-		getNextStep:   func() *step { return newStep(&Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 2}}}) },
+		step:          validStep(t, &Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}}, Expression: "1"}),
+		getNextStep:   func() *step { return next },
 		steps:         3,
 	}
 	e.stepTimer = time.AfterFunc(10*time.Millisecond, e.stepTimeout)
@@ -58,11 +70,12 @@ func TestSendStep(t *testing.T) {
 	t.Parallel()
 
 	schan := make(chan uint32, 2)
+	next := validStep(t, &Step{Timeout: 1, NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}, &NodeConfig{Id: 2}}, Expression: "1 & 2"})
 	e := &executor{
 		stepID: 1,
 		sender: &s{r: schan},
 		getNextStep: func() *step {
-			return newStep(&Step{Timeout: 1, NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}, &NodeConfig{Id: 2}}})
+			return next
 		},
 	}
 	e.sendStep()
@@ -77,6 +90,34 @@ func TestSendStep(t *testing.T) {
 	}
 }
 
+type bs struct {
+	s
+	batches chan []NodeConfig
+}
+
+func (b *bs) SendAll(stepID uint32, nodes []NodeConfig) {
+	b.batches <- nodes
+}
+
+func TestSendStepBatch(t *testing.T) {
+	t.Parallel()
+
+	sender := &bs{batches: make(chan []NodeConfig, 1)}
+	next := validStep(t, &Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}, &NodeConfig{Id: 2}}, Expression: "1 & 2"})
+	e := &executor{
+		stepID: 1,
+		sender: sender,
+		getNextStep: func() *step {
+			return next
+		},
+	}
+	e.sendStep()
+	batch := <-sender.batches
+	if len(batch) != 2 || batch[0].GetId() != 1 || batch[1].GetId() != 2 {
+		t.Fatalf("expected nodes 1 and 2 to be sent at once but got %v", batch)
+	}
+}
+
 func TestNextStep(t *testing.T) {
 	t.Parallel()
 
@@ -99,7 +140,8 @@ func TestRoutineTimeout(t *testing.T) {
 	t.Parallel()
 
 	e := &executor{
-		step:   newStep(&Step{}),
+		sender: &s{r: make(chan uint32, 1)},
+		step:   validStep(t, &Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 1}}, Expression: "1"}),
 		events: make(chan Event, 1),
 	}
 	e.routineTimer = time.AfterFunc(10*time.Millisecond, e.routineTimeout)
@@ -110,3 +152,34 @@ func TestRoutineTimeout(t *testing.T) {
 		t.Fatalf("expected routine to be done")
 	}
 }
+
+func TestToucheNodeID(t *testing.T) {
+	t.Parallel()
+
+	schan := make(chan uint32, 4)
+	e := &executor{
+		stepID: 1,
+		steps:  2,
+		sender: &s{r: schan},
+		events: make(chan Event, 2),
+		step:   validStep(t, &Step{NodeConfigs: []*NodeConfig{&NodeConfig{Id: 18}, &NodeConfig{Id: 3}}, Expression: "18 then 3"}),
+	}
+	// node 7 was never turned on with the step
+	for _, stepID := range []uint32{1, 0} {
+		e.touche(stepID, 7, 100)
+		if event := <-e.events; event.GetType() != Event_WrongNode || event.GetNode() != 7 || event.GetStep() != 1 {
+			t.Fatalf("expected wrong node event of node 7 but got %+v", event)
+		}
+	}
+	// stale touches of the nodes of the step are ignored
+	e.touche(0, 18, 100)
+	e.touche(0, 3, 100)
+	if len(e.events) != 0 {
+		t.Fatalf("expected the stale touche to be ignored but got %+v", <-e.events)
+	}
+	e.touche(1, 18, 100)
+	e.touche(1, 3, 100)
+	if event := <-e.events; event.GetType() != Event_End {
+		t.Fatalf("expected routine end event but got %s", event.GetType())
+	}
+}
@@ -1,9 +1,13 @@
 package executor
 
 import (
+	"log"
 	"math/rand"
 	"strconv"
+	"strings"
 	"time"
+
+	"qsydev.com/term/internal/tree"
 )
 
 // Random wraps a RandomExecutor with the functionality
@@ -13,7 +17,9 @@ type Random struct {
 	*RandomExecutor
 }
 
-// Start starts the executor using sender to send actions.
+// Start starts the executor using sender to send actions. If
+// sender is a NodeLister the steps are made of the connected
+// nodes.
 func (r *Random) Start(sender Sender) error {
 	if r.RandomExecutor == nil {
 		return ErrInvalidExecutor
@@ -30,23 +36,48 @@ func (r *Random) Start(sender Sender) error {
 	return nil
 }
 
-// generateNextStep generates a new random step.
+// generateNextStep generates a new random step with a node
+// for each color.
 func (r *Random) generateNextStep() *step {
+	ids := r.nodeIDs()
 	nodeConfigs := []*NodeConfig{}
-	exp := ""
-	nodes := rand.Perm(int(r.RandomExecutor.Nodes))
-	for i, c := range r.RandomExecutor.Colors {
+	exp := []string{}
+	for i, n := range rand.Perm(len(ids)) {
+		if i == len(r.RandomExecutor.Colors) {
+			break
+		}
 		nodeConfigs = append(nodeConfigs, &NodeConfig{
-			Id:    uint32(nodes[i]),
+			Id:    ids[n],
 			Delay: r.RandomExecutor.Delay,
-			Color: c,
+			Color: r.RandomExecutor.Colors[i],
 		})
-		exp += strconv.Itoa(nodes[i]) + "&"
+		exp = append(exp, strconv.Itoa(int(ids[n])))
 	}
-	return newStep(&Step{
+	s := &Step{
 		NodeConfigs:   nodeConfigs,
-		Expression:    exp[:len(exp)-1],
+		Expression:    strings.Join(exp, "&"),
 		Timeout:       r.RandomExecutor.Timeout,
 		StopOnTimeout: r.RandomExecutor.StopOnTimeout,
-	})
+	}
+	st, err := newStep(s)
+	if err != nil {
+		// there are no nodes to touch, the step can only time out
+		log.Printf("failed to generate random step: %s", err)
+		return &step{Step: s, touched: tree.NewVisits()}
+	}
+	return st
+}
+
+// nodeIDs returns the IDs of the nodes steps are made of, the
+// connected nodes if the sender is a NodeLister or nodes 0 to
+// Nodes-1 otherwise.
+func (r *Random) nodeIDs() []uint32 {
+	if l, ok := r.sender.(NodeLister); ok {
+		return l.Nodes()
+	}
+	ids := make([]uint32, r.RandomExecutor.Nodes)
+	for i := range ids {
+		ids[i] = uint32(i)
+	}
+	return ids
 }
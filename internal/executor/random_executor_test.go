@@ -13,8 +13,8 @@ func TestGenerateNextStep(t *testing.T) {
 		nNodeConfigs   int
 		expectedColors []Color
 	}{
-		{name: "repeated colors", re: &Random{RandomExecutor: &RandomExecutor{Colors: []Color{Color_BLUE, Color_BLUE}, Nodes: 4}}, expectedColors: []Color{Color_BLUE, Color_BLUE}},
-		{name: "different colors", re: &Random{RandomExecutor: &RandomExecutor{Colors: []Color{Color_BLUE, Color_RED}, Nodes: 5}}, expectedColors: []Color{Color_BLUE, Color_RED}},
+		{name: "repeated colors", re: &Random{executor: &executor{}, RandomExecutor: &RandomExecutor{Colors: []Color{Color_BLUE, Color_BLUE}, Nodes: 4}}, expectedColors: []Color{Color_BLUE, Color_BLUE}},
+		{name: "different colors", re: &Random{executor: &executor{}, RandomExecutor: &RandomExecutor{Colors: []Color{Color_BLUE, Color_RED}, Nodes: 5}}, expectedColors: []Color{Color_BLUE, Color_RED}},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(tt *testing.T) {
@@ -32,6 +32,38 @@ func TestGenerateNextStep(t *testing.T) {
 	}
 }
 
+type ls struct {
+	s
+	ids []uint32
+}
+
+func (l *ls) Nodes() []uint32 {
+	return l.ids
+}
+
+func TestGenerateNextStepConnectedNodes(t *testing.T) {
+	t.Parallel()
+
+	connected := map[uint32]bool{18: true, 40: true, 1000: true}
+	r := &Random{
+		executor:       &executor{sender: &ls{ids: []uint32{18, 40, 1000}}},
+		RandomExecutor: &RandomExecutor{Colors: []Color{Color_BLUE, Color_RED}, Nodes: 3},
+	}
+	for i := 0; i < 20; i++ {
+		s := r.generateNextStep()
+		if len(s.NodeConfigs) != 2 {
+			t.Fatalf("expected 2 node configs but got %d", len(s.NodeConfigs))
+		}
+		a, b := s.NodeConfigs[0].Id, s.NodeConfigs[1].Id
+		if !connected[a] || !connected[b] || a == b {
+			t.Fatalf("expected two of the connected nodes but got %v and %v", a, b)
+		}
+		if s.done(a) || !s.done(b) {
+			t.Fatalf("expected step %q to be done once both nodes are touched", s.GetExpression())
+		}
+	}
+}
+
 func hasColors(nc NodeConfig, colors []Color) bool {
 	for _, c := range colors {
 		if nc.Color == c {
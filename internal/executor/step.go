@@ -1,34 +1,83 @@
 package executor
 
-import "qsydev.com/term/internal/tree"
+import (
+	"qsydev.com/term/internal/tree"
+)
 
 type step struct {
 	*Step
 	tree    tree.Node
-	touched []bool
+	touched *tree.Visits
 }
 
-func newStep(s *Step) *step {
+// newStep returns the step. It returns an error if the
+// expression of the step can't be parsed.
+func newStep(s *Step) (*step, error) {
+	t, err := stepTree(s)
+	if err != nil {
+		return nil, err
+	}
 	return &step{
 		Step:    s,
-		tree:    tree.Parse(s.GetExpression()),
-		touched: make([]bool, len(s.NodeConfigs)),
+		tree:    t,
+		touched: tree.NewVisits(),
+	}, nil
+}
+
+// stepTree returns the tree of the expression of the step,
+// either from its tree or parsing its expression.
+func stepTree(s *Step) (tree.Node, error) {
+	if s.GetTree() != nil {
+		return tree.Decode(s.GetTree().expr())
+	}
+	return tree.Parse(s.GetExpression())
+}
+
+// exprOps are the tree ops of the Expr ops.
+var exprOps = map[Expr_Op]string{
+	Expr_NODE: tree.OpNode,
+	Expr_AND:  tree.OpAnd,
+	Expr_OR:   tree.OpOr,
+	Expr_XOR:  tree.OpXor,
+	Expr_NOT:  tree.OpNot,
+	Expr_THEN: tree.OpThen,
+	Expr_OF:   tree.OpOf,
+}
+
+// expr returns the tree.Expr of the message, unknown ops are
+// left empty so that tree.Decode rejects them.
+func (e *Expr) expr() tree.Expr {
+	te := tree.Expr{Op: exprOps[e.GetOp()], ID: int(e.GetId()), K: int(e.GetK())}
+	for _, a := range e.GetArgs() {
+		te.Args = append(te.Args, a.expr())
+	}
+	return te
+}
+
+// has returns true if nodeID is in the node configs of the
+// step.
+func (s *step) has(nodeID uint32) bool {
+	for _, nc := range s.NodeConfigs {
+		if nc.GetId() == nodeID {
+			return true
+		}
 	}
+	return false
 }
 
 // Done checks with the step expression if this step is done.
 func (s *step) done(nodeID uint32) bool {
-	s.touched[nodeID] = true
-	return s.tree.Eval(s.touched)
+	s.touched.Visit(int(nodeID))
+	return s.tree != nil && s.tree.Eval(s.touched)
 }
 
-// nodeColor returns the color of nodeID. If nodeID is not in
-// nodeConfigs then it Color_NO_COLOR.
-func (s *step) nodeColor(nodeID uint32) Color {
+// nodeColor returns the color of nodeID and its rgb value. If
+// nodeID is not in nodeConfigs then it Color_NO_COLOR.
+func (s *step) nodeColor(nodeID uint32) (Color, uint32) {
 	for _, nc := range s.NodeConfigs {
 		if nc.GetId() == nodeID {
-			return nc.GetColor()
+			return nc.GetColor(), nc.GetRgb()
 		}
 	}
-	return Color_NO_COLOR
+	return Color_NO_COLOR, 0
 }
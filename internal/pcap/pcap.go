@@ -0,0 +1,208 @@
+// Package pcap reads the TCP and UDP payloads of IPv4 packets
+// from libpcap capture files, such as the ones written by
+// tcpdump or Wireshark.
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// magic numbers of captures with microsecond and
+	// nanosecond timestamps.
+	magicMicros = 0xa1b2c3d4
+	magicNanos  = 0xa1b23c4d
+
+	// link types of the supported captures.
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+
+	headerSize = 24
+	recordSize = 16
+	// maxSnapLen bounds the size of a single record.
+	maxSnapLen = 1 << 18
+
+	protoTCP = 6
+	protoUDP = 17
+)
+
+var (
+	// ErrNotPcap is the error returned when the file is not a
+	// pcap capture.
+	ErrNotPcap = errors.New("not a pcap capture")
+	// ErrLinkType is the error returned when the link type of
+	// the capture is not supported.
+	ErrLinkType = errors.New("unsupported link type")
+)
+
+// Packet is the payload of a TCP or UDP segment.
+type Packet struct {
+	Time time.Time
+	// Proto is either "tcp" or "udp".
+	Proto    string
+	Src, Dst string
+	Payload  []byte
+}
+
+// Flow returns the source and destination of the packet, it
+// identifies the stream the payload belongs to.
+func (p Packet) Flow() string {
+	return p.Proto + " " + p.Src + " > " + p.Dst
+}
+
+// Reader reads the packets of a capture.
+type Reader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	nanos bool
+	link  uint32
+	hdr   [recordSize]byte
+}
+
+// NewReader returns a Reader that reads the capture from r. It
+// returns ErrNotPcap or ErrLinkType if the capture can't be
+// read.
+func NewReader(r io.Reader) (*Reader, error) {
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errors.Wrap(ErrNotPcap, err.Error())
+	}
+	rd := &Reader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(hdr) == magicMicros:
+		rd.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr) == magicMicros:
+		rd.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr) == magicNanos:
+		rd.order, rd.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr) == magicNanos:
+		rd.order, rd.nanos = binary.BigEndian, true
+	default:
+		return nil, errors.Wrapf(ErrNotPcap, "magic %#x", hdr[:4])
+	}
+	rd.link = rd.order.Uint32(hdr[20:])
+	switch rd.link {
+	case linkNull, linkEthernet, linkRaw, linkLinuxSLL:
+	default:
+		return nil, errors.Wrapf(ErrLinkType, "%v", rd.link)
+	}
+	return rd, nil
+}
+
+// Next returns the next TCP or UDP packet with a payload, every
+// other packet is skipped. It returns io.EOF at the end of the
+// capture.
+func (r *Reader) Next() (Packet, error) {
+	for {
+		if _, err := io.ReadFull(r.r, r.hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return Packet{}, errors.Wrap(err, "truncated record header")
+			}
+			return Packet{}, err
+		}
+		size := r.order.Uint32(r.hdr[8:])
+		if size > maxSnapLen {
+			return Packet{}, errors.Errorf("record of %v bytes is too long", size)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r.r, data); err != nil {
+			return Packet{}, errors.Wrap(err, "truncated record")
+		}
+		sec, frac := int64(r.order.Uint32(r.hdr[0:])), int64(r.order.Uint32(r.hdr[4:]))
+		if !r.nanos {
+			frac *= int64(time.Microsecond)
+		}
+		ip, ok := r.network(data)
+		if !ok {
+			continue
+		}
+		p, ok := transport(ip)
+		if !ok || len(p.Payload) == 0 {
+			continue
+		}
+		p.Time = time.Unix(sec, frac)
+		return p, nil
+	}
+}
+
+// network returns the IPv4 packet in the link layer frame.
+func (r *Reader) network(b []byte) ([]byte, bool) {
+	switch r.link {
+	case linkNull:
+		// the address family is in host order, AF_INET is 2
+		// everywhere
+		if len(b) < 4 || (b[0] != 2 && b[3] != 2) {
+			return nil, false
+		}
+		return b[4:], true
+	case linkEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		ethertype, b := binary.BigEndian.Uint16(b[12:]), b[14:]
+		if ethertype == 0x8100 && len(b) >= 4 {
+			// 802.1Q tag
+			ethertype, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+		return b, ethertype == 0x0800
+	case linkLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		return b[16:], binary.BigEndian.Uint16(b[14:]) == 0x0800
+	default:
+		return b, true
+	}
+}
+
+// transport returns the TCP or UDP payload of the IPv4 packet.
+func transport(b []byte) (Packet, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return Packet{}, false
+	}
+	ihl := int(b[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if ihl < 20 || total < ihl || len(b) < ihl {
+		return Packet{}, false
+	}
+	if total < len(b) {
+		// drop the link layer padding
+		b = b[:total]
+	}
+	if binary.BigEndian.Uint16(b[6:])&0x1fff != 0 {
+		// only the first fragment has the transport header
+		return Packet{}, false
+	}
+	src, dst := net.IP(b[12:16]), net.IP(b[16:20])
+	proto, seg := b[9], b[ihl:]
+	p := Packet{}
+	switch proto {
+	case protoTCP:
+		if len(seg) < 20 {
+			return Packet{}, false
+		}
+		off := int(seg[12]>>4) * 4
+		if off < 20 || len(seg) < off {
+			return Packet{}, false
+		}
+		p.Proto, p.Payload = "tcp", seg[off:]
+	case protoUDP:
+		if len(seg) < 8 {
+			return Packet{}, false
+		}
+		p.Proto, p.Payload = "udp", seg[8:]
+	default:
+		return Packet{}, false
+	}
+	p.Src = net.JoinHostPort(src.String(), strconv.Itoa(int(binary.BigEndian.Uint16(seg[0:]))))
+	p.Dst = net.JoinHostPort(dst.String(), strconv.Itoa(int(binary.BigEndian.Uint16(seg[2:]))))
+	return p, true
+}
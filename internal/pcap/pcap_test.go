@@ -0,0 +1,135 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// capture returns a little endian capture with the frames.
+func capture(link uint32, frames ...[]byte) []byte {
+	b := &bytes.Buffer{}
+	hdr := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(hdr, magicMicros)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], link)
+	b.Write(hdr)
+	for i, f := range frames {
+		rec := make([]byte, recordSize)
+		binary.LittleEndian.PutUint32(rec, 1551549845)
+		binary.LittleEndian.PutUint32(rec[4:], uint32(i*1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(f)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(f)))
+		b.Write(rec)
+		b.Write(f)
+	}
+	return b.Bytes()
+}
+
+// ipv4 returns an IPv4 packet from 10.0.0.5:3000 to
+// 10.0.0.1:4000 carrying the payload.
+func ipv4(proto byte, payload []byte) []byte {
+	var seg []byte
+	switch proto {
+	case protoTCP:
+		seg = make([]byte, 20)
+		seg[12] = 5 << 4
+	case protoUDP:
+		seg = make([]byte, 8)
+	}
+	binary.BigEndian.PutUint16(seg, 3000)
+	binary.BigEndian.PutUint16(seg[2:], 4000)
+	seg = append(seg, payload...)
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(seg)))
+	ip[9] = proto
+	copy(ip[12:], []byte{10, 0, 0, 5})
+	copy(ip[16:], []byte{10, 0, 0, 1})
+	return append(ip, seg...)
+}
+
+func ethernet(ethertype uint16, payload []byte) []byte {
+	f := make([]byte, 14)
+	binary.BigEndian.PutUint16(f[12:], ethertype)
+	return append(f, payload...)
+}
+
+func TestReader(t *testing.T) {
+	tcp := ipv4(protoTCP, []byte("QSY tcp"))
+	udp := ipv4(protoUDP, []byte("QSY udp"))
+	// padded to the minimum ethernet frame size
+	padded := append(ethernet(0x0800, udp), 0, 0, 0, 0)
+	b := capture(linkEthernet,
+		ethernet(0x0800, tcp),
+		ethernet(0x86dd, tcp),
+		ethernet(0x0800, ipv4(protoTCP, nil)),
+		padded,
+	)
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to create reader: %s", err)
+	}
+	want := []Packet{
+		{Proto: "tcp", Src: "10.0.0.5:3000", Dst: "10.0.0.1:4000", Payload: []byte("QSY tcp")},
+		{Proto: "udp", Src: "10.0.0.5:3000", Dst: "10.0.0.1:4000", Payload: []byte("QSY udp")},
+	}
+	for i, w := range want {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read packet %v: %s", i, err)
+		}
+		if p.Flow() != w.Flow() || !bytes.Equal(p.Payload, w.Payload) {
+			t.Fatalf("expected %s %q but got %s %q", w.Flow(), w.Payload, p.Flow(), p.Payload)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF but got %v", err)
+	}
+}
+
+func TestReaderLinkTypes(t *testing.T) {
+	udp := ipv4(protoUDP, []byte("QSY"))
+	sll := append(make([]byte, 14), 0x08, 0x00)
+	frames := map[uint32][]byte{
+		linkNull:     append([]byte{2, 0, 0, 0}, udp...),
+		linkRaw:      udp,
+		linkLinuxSLL: append(sll, udp...),
+	}
+	for link, f := range frames {
+		r, err := NewReader(bytes.NewReader(capture(link, f)))
+		if err != nil {
+			t.Fatalf("link %v: failed to create reader: %s", link, err)
+		}
+		p, err := r.Next()
+		if err != nil {
+			t.Fatalf("link %v: failed to read packet: %s", link, err)
+		}
+		if string(p.Payload) != "QSY" || p.Time != time.Unix(1551549845, 0) {
+			t.Fatalf("link %v: unexpected packet %+v", link, p)
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("link %v: expected io.EOF but got %v", link, err)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("QSY not a capture at all!"))); errors.Cause(err) != ErrNotPcap {
+		t.Fatalf("expected ErrNotPcap but got %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader(capture(105))); errors.Cause(err) != ErrLinkType {
+		t.Fatalf("expected ErrLinkType but got %v", err)
+	}
+	b := capture(linkRaw, ipv4(protoUDP, []byte("QSY")))
+	r, _ := NewReader(bytes.NewReader(b[:len(b)-1]))
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Fatalf("expected error reading a truncated record but got %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package terminal
 
 import (
 	"context"
+	"io"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
@@ -17,6 +19,9 @@ import (
 const (
 	inf   = "wlan0"
 	laddr = "10.0.0.1"
+	// sendTimeout is the maximum amount of time sending
+	// a node config can take.
+	sendTimeout = 500 * time.Millisecond
 )
 
 var (
@@ -37,6 +42,16 @@ type nodeEvent struct {
 // T is the terminal that puts together all the
 // modules of this app.
 type T struct {
+	// Options configure the QSY server. They are applied on
+	// top of the terminal defaults.
+	Options []qsy.Option
+	// Pair is the time new nodes are paired for after starting.
+	// It requires a pairing store in Options.
+	Pair time.Duration
+	// Capture is where the traffic of the nodes is recorded,
+	// nothing is recorded if it is nil. See qsy.Recorder.
+	Capture io.Writer
+
 	ctx context.Context
 
 	device *ble.Device
@@ -59,20 +74,53 @@ func (t *T) Run(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to initialize BLE device")
 	}
-	t.server, err = qsy.NewServer(ctx, inf, laddr, t)
+	if err := t.Start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	if err := t.device.Close(); err != nil {
+		log.Printf("failed to close BLE device: %s", err)
+	}
+	return nil
+}
+
+// Start starts the QSY server and handles the events of the
+// nodes until ctx is done. It does not initialize BLE, without
+// Run executors are started with Write and their events are
+// read from Notify.
+func (t *T) Start(ctx context.Context) error {
+	t.ctx = ctx
+	t.events = make(chan []byte)
+	t.nodesChan = make(chan nodeEvent)
+	t.packetsChan = make(chan qsy.Packet)
+	var listener qsy.Listener = t
+	if t.Capture != nil {
+		listener = qsy.NewRecorder(t.Capture, t)
+	}
+	var err error
+	t.server, err = qsy.NewServer(ctx, inf, laddr, listener, t.Options...)
 	if err != nil {
 		return errors.Wrap(err, "failed to create QSY server")
 	}
 	if err = t.server.ListenAndAccept(); err != nil {
 		return errors.Wrap(err, "failed to start QSY server")
 	}
-	t.events = make(chan []byte)
-	t.nodesChan = make(chan nodeEvent)
-	t.ctx = ctx
-	return t.run()
+	if t.Pair > 0 {
+		if err = t.server.Pair(t.Pair); err != nil {
+			return errors.Wrap(err, "failed to pair QSY nodes")
+		}
+	}
+	go t.run()
+	return nil
+}
+
+// Server returns the QSY server, it is nil until the terminal
+// is started.
+func (t *T) Server() *qsy.Server {
+	return t.server
 }
 
-func (t *T) run() error {
+func (t *T) run() {
 	for {
 		select {
 		case ne := <-t.nodesChan:
@@ -80,21 +128,23 @@ func (t *T) run() error {
 		case pkt := <-t.packetsChan:
 			t.handlePacket(pkt)
 		case <-t.ctx.Done():
-			t.mu.Lock()
-			if t.executing {
-				t.executing = false
-				t.mu.Unlock()
-				t.executor.Stop()
-			}
-			t.mu.Unlock()
-			if err := t.device.Close(); err != nil {
-				log.Printf("failed to close BLE device: %s", err)
-			}
-			return nil
+			t.stop()
+			return
 		}
 	}
 }
 
+// stop stops the executor if it is running.
+func (t *T) stop() {
+	t.mu.Lock()
+	executing := t.executing
+	t.executing = false
+	t.mu.Unlock()
+	if executing {
+		t.executor.Stop()
+	}
+}
+
 func (t *T) processEvents() {
 	for event := range t.executor.Events() {
 		b, err := proto.Marshal(&event)
@@ -127,13 +177,7 @@ func (t *T) ConnState(state ble.State) {
 // Write implements the fragmenter.Client interface.
 func (t *T) Write(data []byte) error {
 	if data[0] == executor.StopExecID {
-		t.mu.Lock()
-		if t.executing {
-			t.executing = false
-			t.mu.Unlock()
-			t.executor.Stop()
-		}
-		t.mu.Unlock()
+		t.stop()
 		return nil
 	}
 	if data[0] != executor.CustomExecID && data[0] != executor.RandomExecID {
@@ -146,22 +190,27 @@ func (t *T) Write(data []byte) error {
 	}
 	t.mu.Unlock()
 	if data[0] == executor.CustomExecID {
-		c := &executor.Custom{}
+		c := &executor.CustomExecutor{}
 		if err := proto.Unmarshal(data[1:], c); err != nil {
 			return errors.Wrap(err, "failed to unmarshal bytes")
 		}
-		t.executor = c
+		t.executor = &executor.Custom{CustomExecutor: c}
 	} else {
-		r := &executor.Random{}
+		r := &executor.RandomExecutor{}
 		if err := proto.Unmarshal(data[1:], r); err != nil {
 			return errors.Wrap(err, "failed to unmarshal bytes")
 		}
-		t.executor = r
+		t.executor = &executor.Random{RandomExecutor: r}
 	}
 	t.mu.Lock()
 	t.executing = true
 	t.mu.Unlock()
-	t.executor.Start(t)
+	if err := t.executor.Start(t); err != nil {
+		t.mu.Lock()
+		t.executing = false
+		t.mu.Unlock()
+		return errors.Wrap(err, "failed to start executor")
+	}
 	go t.processEvents()
 	return nil
 }
@@ -173,29 +222,124 @@ func (t *T) Notify() <-chan []byte {
 
 // Receive implements the receive method of qsy.Listener.
 func (t *T) Receive(pkt qsy.Packet) {
-	t.packetsChan <- pkt
+	select {
+	case t.packetsChan <- pkt:
+	case <-t.ctx.Done():
+	}
 }
 
 // LostNode implements the LostNode method of qsy.Listener.
 func (t *T) LostNode(id uint16) {
-	t.nodesChan <- nodeEvent{id: uint32(id), lost: true}
+	t.nodeEvent(nodeEvent{id: uint32(id), lost: true})
 }
 
 // NewNode implements the receive NewNode of qsy.Listener.
 func (t *T) NewNode(id uint16) {
-	t.nodesChan <- nodeEvent{id: uint32(id)}
+	t.nodeEvent(nodeEvent{id: uint32(id)})
+}
+
+// nodeEvent hands the event to the terminal, it is dropped
+// once the terminal is done.
+func (t *T) nodeEvent(ne nodeEvent) {
+	select {
+	case t.nodesChan <- ne:
+	case <-t.ctx.Done():
+	}
+}
+
+// Nodes implements the Nodes method of executor.NodeLister.
+func (t *T) Nodes() []uint32 {
+	ids := []uint32{}
+	for _, info := range t.server.Snapshot() {
+		ids = append(ids, uint32(info.ID))
+	}
+	return ids
 }
 
 // Send implements the send method of executor.Sender.
+// Failed sends are logged, the node will show up as lost
+// if the connection is broken.
 func (t *T) Send(stepID uint32, nc executor.NodeConfig) {
-	// TODO: what happens on error
-	t.server.Send(qsy.NewPacket(qsy.ToucheT, uint16(nc.GetId()),
-		parseColor(nc.GetColor()), nc.GetDelay(), uint16(stepID), false, false))
+	ctx, cancel := context.WithTimeout(t.ctx, sendTimeout)
+	defer cancel()
+	err := t.server.SendContext(ctx, nodePacket(stepID, nc))
+	if err != nil {
+		log.Printf("failed to send step %v to node %v: %s", stepID, nc.GetId(), err)
+	}
+}
+
+// SendAll implements the SendAll method of executor.BatchSender.
+// The node configs are written concurrently so that every node
+// turns on at the same time.
+func (t *T) SendAll(stepID uint32, ncs []executor.NodeConfig) {
+	packets := make([]qsy.Packet, 0, len(ncs))
+	for _, nc := range ncs {
+		packets = append(packets, nodePacket(stepID, nc))
+	}
+	if err := t.server.SendMany(packets); err != nil {
+		log.Printf("failed to send step %v: %s", stepID, err)
+	}
 }
 
-// parseColor parses the executor.Color to a qsy.Color.
-func parseColor(color executor.Color) qsy.Color {
-	switch color {
+// nodePacket returns the packet that turns on the node of the
+// node config in the step.
+func nodePacket(stepID uint32, nc executor.NodeConfig) qsy.Packet {
+	pkt := qsy.NewPacket(qsy.ToucheT, uint16(nc.GetId()), parseColor(nc),
+		nc.GetDelay(), uint16(stepID), false, false)
+	pkt.Configure(parseSettings(nc))
+	pkt.Animation = parseAnimation(nc)
+	return pkt
+}
+
+// parseSettings parses the settings of the node config to
+// qsy.Settings.
+func parseSettings(nc executor.NodeConfig) qsy.Settings {
+	return qsy.Settings{
+		Sound:       nc.GetSound(),
+		Distance:    nc.GetDistance(),
+		Sensitivity: parseLevel(nc.GetSensitivity()),
+		Brightness:  parseLevel(nc.GetBrightness()),
+	}
+}
+
+// parseAnimation parses the animation of the node config to a
+// qsy.Animation.
+func parseAnimation(nc executor.NodeConfig) qsy.Animation {
+	a := qsy.Animation{
+		Period:  time.Duration(nc.GetPeriod()) * time.Millisecond,
+		FadeIn:  time.Duration(nc.GetFadeIn()) * time.Millisecond,
+		FadeOut: time.Duration(nc.GetFadeOut()) * time.Millisecond,
+	}
+	switch nc.GetAnimation() {
+	case executor.Animation_BLINK:
+		a.Kind = qsy.Blink
+	case executor.Animation_FADE:
+		a.Kind = qsy.Fade
+	case executor.Animation_PULSE:
+		a.Kind = qsy.Pulse
+	default:
+		a.Kind = qsy.Steady
+	}
+	return a
+}
+
+// parseLevel parses a node config level, levels above
+// qsy.MaxLevel are taken as qsy.MaxLevel.
+func parseLevel(l uint32) uint8 {
+	if l > qsy.MaxLevel {
+		return qsy.MaxLevel
+	}
+	return uint8(l)
+}
+
+// parseColor parses the color of the node config to a
+// qsy.Color. The rgb value is used if it is set, otherwise the
+// executor.Color.
+func parseColor(nc executor.NodeConfig) qsy.Color {
+	if rgb := nc.GetRgb(); rgb != 0 {
+		return qsy.RGB(uint8(rgb>>16), uint8(rgb>>8), uint8(rgb))
+	}
+	switch nc.GetColor() {
 	case executor.Color_RED:
 		return qsy.Red
 	case executor.Color_GREEN:
@@ -0,0 +1,242 @@
+package tree
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// maxSearch bounds the amount of visits Satisfiable and
+// Irrelevant try.
+const maxSearch = 1 << 16
+
+var (
+	// ErrUnknownNode is the error returned when the expression
+	// references a node that is not in the step.
+	ErrUnknownNode = errors.New("unknown node")
+	// ErrUnsatisfiable is the error returned when no visits
+	// satisfy the expression.
+	ErrUnsatisfiable = errors.New("expression can't be satisfied")
+	// ErrTautology is the error returned when the expression is
+	// satisfied without visiting any node.
+	ErrTautology = errors.New("expression is satisfied without visiting any node")
+	// ErrUndecided is the error returned when there are too
+	// many visits to try to tell if the expression can be
+	// satisfied.
+	ErrUndecided = errors.New("expression is too large to be checked")
+)
+
+// Compile parses the expression of a step with the nodes and
+// checks it, see Check. It returns a *SyntaxError if the
+// expression can't be parsed.
+func Compile(expression string, nodeIDs []int) (Node, error) {
+	t, err := Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	if err := Check(t, nodeIDs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Check checks that n can be used for a step with the nodes.
+// Every node referenced by n must be one of nodeIDs and n must
+// be satisfied by visiting some, but not none, of them. It
+// returns ErrUnknownNode, ErrTautology or ErrUnsatisfiable
+// otherwise. Expressions that are too large for Satisfiable to
+// decide are assumed to be satisfiable.
+func Check(n Node, nodeIDs []int) error {
+	ids := map[int]bool{}
+	for _, id := range nodeIDs {
+		ids[id] = true
+	}
+	for _, id := range Leaves(n) {
+		if !ids[id] {
+			return errors.Wrapf(ErrUnknownNode, "node %v", id)
+		}
+	}
+	if Tautology(n) {
+		return ErrTautology
+	}
+	if ok, err := Satisfiable(n); !ok && err != ErrUndecided {
+		return ErrUnsatisfiable
+	}
+	return nil
+}
+
+// walk calls f for n and every node below it.
+func walk(n Node, f func(Node)) {
+	f(n)
+	switch n := n.(type) {
+	case And:
+		walk(n.Left, f)
+		walk(n.Right, f)
+	case Or:
+		walk(n.Left, f)
+		walk(n.Right, f)
+	case Xor:
+		walk(n.Left, f)
+		walk(n.Right, f)
+	case Then:
+		walk(n.Left, f)
+		walk(n.Right, f)
+	case Not:
+		walk(n.Node, f)
+	case Of:
+		for _, c := range n.Nodes {
+			walk(c, f)
+		}
+	}
+}
+
+// Leaves returns the sorted IDs of the nodes referenced by n.
+func Leaves(n Node) []int {
+	seen := map[int]bool{}
+	walk(n, func(n Node) {
+		if l, ok := n.(Leaf); ok {
+			seen[l.Value] = true
+		}
+	})
+	ids := make([]int, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Irrelevant returns the nodes of nodeIDs whose visit never
+// changes the outcome of n, either because n does not reference
+// them or because n evaluates the same with and without their
+// visit, e.g. 2 in 1 | (1 & 2). Only the visits that can happen
+// before n is satisfied are considered. If the search takes
+// more than maxSearch visits the nodes referenced by n are
+// assumed to be relevant.
+func Irrelevant(n Node, nodeIDs []int) []int {
+	leaves := Leaves(n)
+	relevant := map[int]bool{}
+	err := explore(n, leaves, func(v *Visits) bool {
+		satisfied := n.Eval(v)
+		for _, id := range leaves {
+			if !relevant[id] && v.Visited(id) && n.Eval(v.without(id)) != satisfied {
+				relevant[id] = true
+			}
+		}
+		return len(relevant) == len(leaves)
+	})
+	if err != nil {
+		for _, id := range leaves {
+			relevant[id] = true
+		}
+	}
+	ids := []int{}
+	for _, id := range nodeIDs {
+		if !relevant[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Tautology returns true if n is satisfied without visiting any
+// node.
+func Tautology(n Node) bool {
+	return n.Eval(NewVisits())
+}
+
+// Satisfiable returns true if visiting its nodes in some order
+// satisfies n. Without then the order doesn't matter and only
+// the sets of visited nodes are tried. If the search takes more
+// than maxSearch visits it returns ErrUndecided.
+func Satisfiable(n Node) (bool, error) {
+	satisfied := false
+	err := explore(n, Leaves(n), func(v *Visits) bool {
+		satisfied = n.Eval(v)
+		return satisfied
+	})
+	if satisfied {
+		return true, nil
+	}
+	return false, err
+}
+
+// explore calls f with every visits of the leaves of n that can
+// happen before n is satisfied, and with the ones that satisfy
+// it, until f returns true. Without then the order doesn't
+// matter and only the sets of visited nodes are tried. It
+// returns ErrUndecided if there are more than maxSearch visits
+// to try.
+func explore(n Node, leaves []int, f func(v *Visits) bool) error {
+	ordered := false
+	walk(n, func(n Node) {
+		if _, ok := n.(Then); ok {
+			ordered = true
+		}
+	})
+	var (
+		budget = maxSearch
+		tried  = map[string]bool{}
+		search func(v *Visits) (bool, error)
+	)
+	search = func(v *Visits) (bool, error) {
+		if f(v) {
+			return true, nil
+		}
+		// the step is over once n is satisfied
+		if n.Eval(v) {
+			return false, nil
+		}
+		if budget--; budget <= 0 {
+			return false, ErrUndecided
+		}
+		for _, id := range leaves {
+			if v.Visited(id) {
+				continue
+			}
+			w := v.clone()
+			w.Visit(id)
+			if !ordered {
+				key := w.set(leaves)
+				if tried[key] {
+					continue
+				}
+				tried[key] = true
+			}
+			if done, err := search(w); done || err != nil {
+				return done, err
+			}
+		}
+		return false, nil
+	}
+	_, err := search(NewVisits())
+	return err
+}
+
+// clone returns a copy of the visits.
+func (v *Visits) clone() *Visits {
+	w := &Visits{order: make(map[int]int, len(v.order)), n: v.n}
+	for id, at := range v.order {
+		w.order[id] = at
+	}
+	return w
+}
+
+// without returns a copy of the visits without the visit of
+// the node, the other visits keep their order.
+func (v *Visits) without(id int) *Visits {
+	w := v.clone()
+	delete(w.order, id)
+	return w
+}
+
+// set returns the visited nodes of ids, ignoring the order.
+func (v *Visits) set(ids []int) string {
+	b := make([]byte, len(ids))
+	for i, id := range ids {
+		if v.Visited(id) {
+			b[i] = 1
+		}
+	}
+	return string(b)
+}
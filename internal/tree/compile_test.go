@@ -0,0 +1,89 @@
+package tree
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCompile(t *testing.T) {
+	t.Parallel()
+
+	nodes := []int{1, 2, 3, 18}
+	cases := []struct {
+		expression string
+		err        error
+	}{
+		{expression: "1 & 18"},
+		{expression: "1 then 2 then 3"},
+		{expression: "2 of (1, 2, 3) & !18"},
+		{expression: "1 ^ 2"},
+		{expression: "1 & 4", err: ErrUnknownNode},
+		{expression: "!1", err: ErrTautology},
+		{expression: "1 | !1", err: ErrTautology},
+		{expression: "1 & !1", err: ErrUnsatisfiable},
+		{expression: "(1 & 2) & !(1 | 2)", err: ErrUnsatisfiable},
+		{expression: "1 then 1", err: ErrUnsatisfiable},
+		{expression: "(1 then 2) & (2 then 1)", err: ErrUnsatisfiable},
+		{expression: "!2 then 2", err: ErrUnsatisfiable},
+	}
+	for _, c := range cases {
+		_, err := Compile(c.expression, nodes)
+		if errors.Cause(err) != c.err {
+			t.Fatalf("expected %q to fail with %v but got %v", c.expression, c.err, err)
+		}
+	}
+	if _, err := Compile("1 &", nodes); err == nil {
+		t.Fatalf("expected syntax error")
+	} else if _, ok := err.(*SyntaxError); !ok {
+		t.Fatalf("expected syntax error but got %v", err)
+	}
+}
+
+func TestIrrelevant(t *testing.T) {
+	t.Parallel()
+
+	nodes := []int{1, 2, 3, 18}
+	cases := []struct {
+		expression string
+		irrelevant []int
+	}{
+		{expression: "1 & 2", irrelevant: []int{3, 18}},
+		{expression: "1 & (3 | 1)", irrelevant: []int{2, 3, 18}},
+		{expression: "1 | (1 & 2)", irrelevant: []int{2, 3, 18}},
+		{expression: "1 then 2", irrelevant: []int{3, 18}},
+		{expression: "1 & !2", irrelevant: []int{3, 18}},
+		{expression: "(1 & 2) | (1 & !2)", irrelevant: []int{2, 3, 18}},
+		{expression: "2 of (1, 2, 3) & !18", irrelevant: []int{}},
+	}
+	for _, c := range cases {
+		n, err := Parse(c.expression)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", c.expression, err)
+		}
+		if ids := Irrelevant(n, nodes); !reflect.DeepEqual(ids, c.irrelevant) {
+			t.Fatalf("expected nodes %v of %q to be irrelevant but got %v", c.irrelevant, c.expression, ids)
+		}
+	}
+}
+
+func TestUndecided(t *testing.T) {
+	t.Parallel()
+
+	// 9 can't be visited but proving it takes every order
+	n, err := Parse("(1 then 2 then 3 then 4 then 5 then 6 then 7 then 8 then 9) & !9")
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	if ok, err := Satisfiable(n); ok || err != ErrUndecided {
+		t.Fatalf("expected the search to be undecided but got %v, %v", ok, err)
+	}
+	nodes := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 18}
+	if err := Check(n, nodes); err != nil {
+		t.Fatalf("expected undecided expression to be accepted but got %v", err)
+	}
+	if ids := Irrelevant(n, nodes); !reflect.DeepEqual(ids, []int{18}) {
+		t.Fatalf("expected only node 18 to be irrelevant but got %v", ids)
+	}
+}
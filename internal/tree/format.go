@@ -0,0 +1,323 @@
+package tree
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidExpr is the error returned when an Expr is not a
+// valid tree.
+var ErrInvalidExpr = errors.New("invalid expression tree")
+
+// Ops of the Expr nodes.
+const (
+	OpNode = "node"
+	OpAnd  = "and"
+	OpOr   = "or"
+	OpXor  = "xor"
+	OpNot  = "not"
+	OpThen = "then"
+	OpOf   = "of"
+)
+
+// atom is the precedence of leaves and k of n, they never need
+// parentheses.
+const atom = 6
+
+// format writes n in infix notation with the parentheses needed
+// for it to parse back to n.
+func format(b *strings.Builder, n Node) {
+	switch n := n.(type) {
+	case Leaf:
+		b.WriteString(strconv.Itoa(n.Value))
+	case Not:
+		b.WriteByte(notOp)
+		group(b, n.Node, nodePrecedence(n.Node) < precedence(notTok))
+	case Of:
+		b.WriteString(strconv.Itoa(n.K) + " of (")
+		for i, c := range n.Nodes {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, c)
+		}
+		b.WriteByte(closeParen)
+	default:
+		op, l, r := binary(n)
+		p := nodePrecedence(n)
+		// operators are left associative, a right operand of
+		// the same precedence needs parentheses
+		group(b, l, nodePrecedence(l) < p)
+		b.WriteString(op)
+		group(b, r, nodePrecedence(r) <= p)
+	}
+}
+
+// group formats n, within parentheses if paren is true.
+func group(b *strings.Builder, n Node, paren bool) {
+	if paren {
+		b.WriteByte(openParen)
+	}
+	format(b, n)
+	if paren {
+		b.WriteByte(closeParen)
+	}
+}
+
+// binary returns the operator and the operands of a binary
+// node.
+func binary(n Node) (string, Node, Node) {
+	switch n := n.(type) {
+	case And:
+		return " & ", n.Left, n.Right
+	case Or:
+		return " | ", n.Left, n.Right
+	case Xor:
+		return " ^ ", n.Left, n.Right
+	case Then:
+		return " then ", n.Left, n.Right
+	default:
+		return "", nil, nil
+	}
+}
+
+// nodePrecedence returns the precedence of the operator of n.
+func nodePrecedence(n Node) int {
+	switch n.(type) {
+	case And:
+		return precedence(andTok)
+	case Or:
+		return precedence(orTok)
+	case Xor:
+		return precedence(xorTok)
+	case Then:
+		return precedence(thenTok)
+	case Not:
+		return precedence(notTok)
+	default:
+		return atom
+	}
+}
+
+func toString(n Node) string {
+	b := &strings.Builder{}
+	format(b, n)
+	return b.String()
+}
+
+// String returns the expression with the fewest parentheses.
+func (and And) String() string { return toString(and) }
+
+// String returns the expression with the fewest parentheses.
+func (or Or) String() string { return toString(or) }
+
+// String returns the expression with the fewest parentheses.
+func (xor Xor) String() string { return toString(xor) }
+
+// String returns the expression with the fewest parentheses.
+func (not Not) String() string { return toString(not) }
+
+// String returns the expression with the fewest parentheses.
+func (then Then) String() string { return toString(then) }
+
+// String returns the expression with the fewest parentheses.
+func (of Of) String() string { return toString(of) }
+
+// String returns the node ID.
+func (l Leaf) String() string { return strconv.Itoa(l.Value) }
+
+// Canonical returns the normalized form of n: the operands of
+// chained and and or operators are flattened and sorted, as
+// well as the two operands of xor and the operands of k of n,
+// nodes before expressions and nodes by ID. Chained xor
+// operators are not flattened, regrouping them changes when
+// they are satisfied and so the outcome of then. Expressions
+// that only differ in the order of those operands have the
+// same canonical form, its String can be used for comparing
+// them.
+func Canonical(n Node) Node {
+	switch n := n.(type) {
+	case And:
+		return chain(n, func(l, r Node) Node { return And{Left: l, Right: r} })
+	case Or:
+		return chain(n, func(l, r Node) Node { return Or{Left: l, Right: r} })
+	case Xor:
+		operands := []Node{Canonical(n.Left), Canonical(n.Right)}
+		sortNodes(operands)
+		return Xor{Left: operands[0], Right: operands[1]}
+	case Then:
+		return Then{Left: Canonical(n.Left), Right: Canonical(n.Right)}
+	case Not:
+		return Not{Node: Canonical(n.Node)}
+	case Of:
+		nodes := make([]Node, len(n.Nodes))
+		for i, c := range n.Nodes {
+			nodes[i] = Canonical(c)
+		}
+		sortNodes(nodes)
+		return Of{K: n.K, Nodes: nodes}
+	default:
+		return n
+	}
+}
+
+// chain flattens the operands of the chain of operators of the
+// same type as n, sorts them and joins them with join.
+func chain(n Node, join func(l, r Node) Node) Node {
+	operands := flatten(n, nil)
+	for i, o := range operands {
+		operands[i] = Canonical(o)
+	}
+	sortNodes(operands)
+	c := operands[0]
+	for _, o := range operands[1:] {
+		c = join(c, o)
+	}
+	return c
+}
+
+// flatten appends the operands of the chain of operators of the
+// same type as n.
+func flatten(n Node, operands []Node) []Node {
+	op, l, r := binary(n)
+	for _, c := range []Node{l, r} {
+		if cop, _, _ := binary(c); cop == op {
+			operands = flatten(c, operands)
+			continue
+		}
+		operands = append(operands, c)
+	}
+	return operands
+}
+
+func sortNodes(nodes []Node) {
+	keys := make([]string, len(nodes))
+	for i, n := range nodes {
+		keys[i] = toString(n)
+	}
+	sort.Sort(byKey{nodes, keys})
+}
+
+// byKey sorts nodes before expressions, nodes by ID and
+// expressions by their string.
+type byKey struct {
+	nodes []Node
+	keys  []string
+}
+
+func (s byKey) Len() int { return len(s.nodes) }
+
+func (s byKey) Swap(i, j int) {
+	s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+func (s byKey) Less(i, j int) bool {
+	li, iok := s.nodes[i].(Leaf)
+	lj, jok := s.nodes[j].(Leaf)
+	switch {
+	case iok && jok:
+		return li.Value < lj.Value
+	case iok != jok:
+		return iok
+	default:
+		return s.keys[i] < s.keys[j]
+	}
+}
+
+// Expr is the encoding of a tree, such as the ones built by
+// apps. Leaves have the OpNode op and the ID of the node, k of
+// n have the OpOf op and K.
+type Expr struct {
+	Op   string `json:"op"`
+	ID   int    `json:"id,omitempty"`
+	K    int    `json:"k,omitempty"`
+	Args []Expr `json:"args,omitempty"`
+}
+
+// Encode returns the Expr of n.
+func Encode(n Node) Expr {
+	switch n := n.(type) {
+	case Leaf:
+		return Expr{Op: OpNode, ID: n.Value}
+	case Not:
+		return Expr{Op: OpNot, Args: []Expr{Encode(n.Node)}}
+	case Of:
+		e := Expr{Op: OpOf, K: n.K, Args: make([]Expr, len(n.Nodes))}
+		for i, c := range n.Nodes {
+			e.Args[i] = Encode(c)
+		}
+		return e
+	}
+	e := Expr{Args: make([]Expr, 2)}
+	switch n := n.(type) {
+	case And:
+		e.Op, e.Args[0], e.Args[1] = OpAnd, Encode(n.Left), Encode(n.Right)
+	case Or:
+		e.Op, e.Args[0], e.Args[1] = OpOr, Encode(n.Left), Encode(n.Right)
+	case Xor:
+		e.Op, e.Args[0], e.Args[1] = OpXor, Encode(n.Left), Encode(n.Right)
+	case Then:
+		e.Op, e.Args[0], e.Args[1] = OpThen, Encode(n.Left), Encode(n.Right)
+	}
+	return e
+}
+
+// Decode returns the tree of the Expr. It returns ErrInvalidExpr
+// if an op is unknown or has the wrong amount of operands.
+func Decode(e Expr) (Node, error) {
+	args := make([]Node, len(e.Args))
+	for i, a := range e.Args {
+		n, err := Decode(a)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = n
+	}
+	arity := map[string]int{OpNode: 0, OpNot: 1, OpAnd: 2, OpOr: 2, OpXor: 2, OpThen: 2}
+	if n, ok := arity[e.Op]; ok && n != len(args) {
+		return nil, errors.Wrapf(ErrInvalidExpr, "%s with %v operands", e.Op, len(args))
+	}
+	switch e.Op {
+	case OpNode:
+		if e.ID < 0 || e.ID > maxID {
+			return nil, errors.Wrapf(ErrInvalidExpr, "node id %v", e.ID)
+		}
+		return Leaf{Value: e.ID}, nil
+	case OpNot:
+		return Not{Node: args[0]}, nil
+	case OpAnd:
+		return And{Left: args[0], Right: args[1]}, nil
+	case OpOr:
+		return Or{Left: args[0], Right: args[1]}, nil
+	case OpXor:
+		return Xor{Left: args[0], Right: args[1]}, nil
+	case OpThen:
+		return Then{Left: args[0], Right: args[1]}, nil
+	case OpOf:
+		if e.K < 1 || e.K > len(args) {
+			return nil, errors.Wrapf(ErrInvalidExpr, "%v of %v", e.K, len(args))
+		}
+		return Of{K: e.K, Nodes: args}, nil
+	default:
+		return nil, errors.Wrapf(ErrInvalidExpr, "unknown op %q", e.Op)
+	}
+}
+
+// EncodeJSON returns the JSON encoding of the Expr of n.
+func EncodeJSON(n Node) ([]byte, error) {
+	return json.Marshal(Encode(n))
+}
+
+// DecodeJSON returns the tree of the JSON encoded Expr.
+func DecodeJSON(b []byte) (Node, error) {
+	e := Expr{}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, errors.Wrap(ErrInvalidExpr, err.Error())
+	}
+	return Decode(e)
+}
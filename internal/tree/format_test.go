@@ -0,0 +1,146 @@
+package tree
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+var stringCases = []struct {
+	expression string
+	result     string
+}{
+	{expression: "((1&2))", result: "1 & 2"},
+	{expression: "(1&2)&3", result: "1 & 2 & 3"},
+	{expression: "1&(2&3)", result: "1 & (2 & 3)"},
+	{expression: "(1|2)&3", result: "(1 | 2) & 3"},
+	{expression: "1|(2&3)", result: "1 | 2 & 3"},
+	{expression: "not (1 xor 2) and !3", result: "!(1 ^ 2) & !3"},
+	{expression: "1 then (2 then 3)", result: "1 then (2 then 3)"},
+	{expression: "(1 then 2) | 3", result: "(1 then 2) | 3"},
+	{expression: "2 OF (1,(3|4),5) & !!6", result: "2 of (1, 3 | 4, 5) & !!6"},
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range stringCases {
+		n, err := Parse(c.expression)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", c.expression, err)
+		}
+		s := n.String()
+		if s != c.result {
+			t.Fatalf("expected %s to be printed as %s but got %s", c.expression, c.result, s)
+		}
+		back, err := Parse(s)
+		if err != nil {
+			t.Fatalf("failed to parse back %s: %s", s, err)
+		}
+		if !reflect.DeepEqual(back, n) {
+			t.Fatalf("expected %s to parse back to %#v but got %#v", s, n, back)
+		}
+	}
+}
+
+var canonicalCases = []struct {
+	expressions []string
+	canonical   string
+}{
+	{expressions: []string{"3 & 1 & 2", "1 & (2 & 3)", "(2 & 3) & 1"}, canonical: "1 & 2 & 3"},
+	{expressions: []string{"(4 | 3) & 10 & 2", "2 & (3 | 4) & 10"}, canonical: "2 & 10 & (3 | 4)"},
+	{expressions: []string{"2 then 1 & 3", "2 then 3 & 1"}, canonical: "2 then 1 & 3"},
+	{expressions: []string{"2 of (5, 1, 3 ^ 2)", "2 of (1, 2 ^ 3, 5)"}, canonical: "2 of (1, 5, 2 ^ 3)"},
+	{expressions: []string{"!(2 | 1) ^ 3"}, canonical: "3 ^ !(1 | 2)"},
+	{expressions: []string{"4 then 1 ^ (2 ^ 3)", "4 then (3 ^ 2) ^ 1"}, canonical: "4 then 1 ^ (2 ^ 3)"},
+	{expressions: []string{"4 then 1 ^ 2 ^ 3", "4 then 3 ^ (1 ^ 2)"}, canonical: "4 then 3 ^ (1 ^ 2)"},
+}
+
+func TestCanonical(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range canonicalCases {
+		for _, e := range c.expressions {
+			n, err := Parse(e)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %s", e, err)
+			}
+			s := Canonical(n).String()
+			if s != c.canonical {
+				t.Fatalf("expected canonical form of %s to be %s but got %s", e, c.canonical, s)
+			}
+		}
+	}
+}
+
+// orders returns every order of visiting any of the nodes.
+func orders(ids []int) [][]int {
+	all := [][]int{{}}
+	for i, id := range ids {
+		rest := append(append([]int{}, ids[:i]...), ids[i+1:]...)
+		for _, o := range orders(rest) {
+			all = append(all, append([]int{id}, o...))
+		}
+	}
+	return all
+}
+
+func TestCanonicalEval(t *testing.T) {
+	t.Parallel()
+
+	expressions := []string{}
+	for _, c := range stringCases {
+		expressions = append(expressions, c.expression)
+	}
+	for _, c := range canonicalCases {
+		expressions = append(expressions, c.expressions...)
+	}
+	for _, e := range expressions {
+		n, err := Parse(e)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", e, err)
+		}
+		c := Canonical(n)
+		for _, o := range orders(Leaves(n)) {
+			v := visits(o...)
+			if n.Eval(v) != c.Eval(v) {
+				t.Fatalf("expected %s and its canonical form %s to eval the same visiting %v", e, c, o)
+			}
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	t.Parallel()
+
+	n, err := Parse("0 then 2 of (1, 18 & !3)")
+	if err != nil {
+		t.Fatalf("failed to parse: %s", err)
+	}
+	b, err := EncodeJSON(n)
+	if err != nil {
+		t.Fatalf("failed to encode: %s", err)
+	}
+	back, err := DecodeJSON(b)
+	if err != nil {
+		t.Fatalf("failed to decode %s: %s", b, err)
+	}
+	if !reflect.DeepEqual(back, n) {
+		t.Fatalf("expected %s to decode to %#v but got %#v", b, n, back)
+	}
+
+	invalid := []string{
+		`{"op":"nand","args":[{"op":"node","id":1},{"op":"node","id":2}]}`,
+		`{"op":"and","args":[{"op":"node","id":1}]}`,
+		`{"op":"not"}`,
+		`{"op":"of","k":3,"args":[{"op":"node","id":1},{"op":"node","id":2}]}`,
+		`{"op":"node","id":70000}`,
+		`{"op":`,
+	}
+	for _, s := range invalid {
+		if _, err := DecodeJSON([]byte(s)); errors.Cause(err) != ErrInvalidExpr {
+			t.Fatalf("expected %s to be invalid but got %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package tree
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SyntaxError is the error returned when an expression can't be
+// parsed.
+type SyntaxError struct {
+	// Pos is the column of the error, starting at 1.
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at column %v: %s", e.Pos, e.Msg)
+}
+
+func syntaxError(pos int, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{Pos: pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+type tokenKind int
+
+const (
+	numTok tokenKind = iota
+	andTok
+	orTok
+	xorTok
+	notTok
+	thenTok
+	ofTok
+	openTok
+	closeTok
+	commaTok
+	endTok
+)
+
+// token is a lexeme of an expression, pos is its byte offset.
+type token struct {
+	kind tokenKind
+	text string
+	val  int
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == endTok {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// words are the operators that are spelled out.
+var words = map[string]tokenKind{
+	"and":  andTok,
+	"or":   orTok,
+	"xor":  xorTok,
+	"not":  notTok,
+	"then": thenTok,
+	"of":   ofTok,
+}
+
+// symbols are the single character operators.
+var symbols = map[rune]tokenKind{
+	andOp:      andTok,
+	orOp:       orTok,
+	xorOp:      xorTok,
+	notOp:      notTok,
+	openParen:  openTok,
+	closeParen: closeTok,
+	comma:      commaTok,
+}
+
+// lex splits the expression in tokens, the last one is always
+// endTok.
+func lex(expression string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(expression); {
+		c := rune(expression[i])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(expression) && expression[j] >= '0' && expression[j] <= '9' {
+				j++
+			}
+			v, err := strconv.Atoi(expression[i:j])
+			if err != nil || v > maxID {
+				return nil, syntaxError(i, "node id %s is too large", expression[i:j])
+			}
+			tokens = append(tokens, token{kind: numTok, text: expression[i:j], val: v, pos: i})
+			i = j
+		case c < unicode.MaxASCII && unicode.IsLetter(c):
+			j := i
+			for j < len(expression) && expression[j] < unicode.MaxASCII && unicode.IsLetter(rune(expression[j])) {
+				j++
+			}
+			w := expression[i:j]
+			kind, ok := words[strings.ToLower(w)]
+			if !ok {
+				return nil, syntaxError(i, "unknown word %q", w)
+			}
+			tokens = append(tokens, token{kind: kind, text: w, pos: i})
+			i = j
+		default:
+			kind, ok := symbols[c]
+			if !ok {
+				r := []rune(expression[i:])[0]
+				return nil, syntaxError(i, "unexpected character %q", r)
+			}
+			tokens = append(tokens, token{kind: kind, text: string(c), pos: i})
+			i++
+		}
+	}
+	return append(tokens, token{kind: endTok, pos: len(expression)}), nil
+}
@@ -1,39 +1,46 @@
 package tree
 
-// Stack is a LIFO data structure.
-type Stack struct {
-	top  *Element
-	size int
+// Stack is a LIFO data structure. The zero value is an empty
+// stack ready to use.
+type Stack[T any] struct {
+	values []T
 }
 
-// Element is an element in the stack.
-type Element struct {
-	value interface{}
-	next  *Element
+// Empty returns true if no elements are in the stack.
+func (s *Stack[T]) Empty() bool {
+	return len(s.values) == 0
 }
 
-// Empty returns true if no elements are in the stack.
-func (s *Stack) Empty() bool {
-	return s.size == 0
+// Len returns the amount of elements in the stack.
+func (s *Stack[T]) Len() int {
+	return len(s.values)
 }
 
-// Top returns the top value of the stack without poping.
-func (s *Stack) Top() interface{} {
-	return s.top.value
+// Peek returns the top value of the stack without popping it.
+// It returns false if the stack is empty.
+func (s *Stack[T]) Peek() (T, bool) {
+	if len(s.values) == 0 {
+		var zero T
+		return zero, false
+	}
+	return s.values[len(s.values)-1], true
 }
 
 // Push pushes value into the stack.
-func (s *Stack) Push(value interface{}) {
-	s.size++
-	s.top = &Element{value, s.top}
+func (s *Stack[T]) Push(value T) {
+	s.values = append(s.values, value)
 }
 
-// Pop popes the top value.
-func (s *Stack) Pop() (value interface{}) {
-	if s.size == 0 {
-		return nil
+// Pop pops the top value. It returns false if the stack is
+// empty.
+func (s *Stack[T]) Pop() (T, bool) {
+	v, ok := s.Peek()
+	if !ok {
+		return v, false
 	}
-	s.size--
-	value, s.top = s.top.value, s.top.next
-	return value
+	var zero T
+	// clear the slot so that the stack doesn't hold on to it
+	s.values[len(s.values)-1] = zero
+	s.values = s.values[:len(s.values)-1]
+	return v, true
 }
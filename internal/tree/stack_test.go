@@ -0,0 +1,29 @@
+package tree
+
+import "testing"
+
+func TestStack(t *testing.T) {
+	t.Parallel()
+
+	var s Stack[int]
+	if v, ok := s.Peek(); ok {
+		t.Fatalf("expected empty stack but peeked %v", v)
+	}
+	if v, ok := s.Pop(); ok {
+		t.Fatalf("expected empty stack but popped %v", v)
+	}
+	for i := 1; i <= 3; i++ {
+		s.Push(i)
+	}
+	if v, ok := s.Peek(); !ok || v != 3 || s.Len() != 3 {
+		t.Fatalf("expected to peek 3 of 3 but got %v of %v", v, s.Len())
+	}
+	for i := 3; i >= 1; i-- {
+		if v, ok := s.Pop(); !ok || v != i {
+			t.Fatalf("expected to pop %v but got %v", i, v)
+		}
+	}
+	if !s.Empty() {
+		t.Fatalf("expected empty stack")
+	}
+}
@@ -1,21 +1,72 @@
 package tree
 
 import (
-	"strconv"
-	"strings"
+	"math"
+	"sort"
 )
 
 const (
 	openParen  = '('
 	closeParen = ')'
+	comma      = ','
 	andOp      = '&'
 	orOp       = '|'
+	xorOp      = '^'
+	notOp      = '!'
+
+	// maxID is the largest node ID, QSY node IDs are 16 bits.
+	maxID = math.MaxUint16
+	// never is when an expression that is not satisfied was
+	// satisfied.
+	never = math.MaxInt32
 )
 
+// Visits is the order in which the nodes were visited, by node
+// ID.
+type Visits struct {
+	order map[int]int
+	n     int
+}
+
+// NewVisits returns visits without any node visited.
+func NewVisits() *Visits {
+	return &Visits{order: map[int]int{}}
+}
+
+// Visit visits the node. Visiting a node again keeps its first
+// visit.
+func (v *Visits) Visit(id int) {
+	if _, ok := v.order[id]; ok {
+		return
+	}
+	v.n++
+	v.order[id] = v.n
+}
+
+// Visited returns true if the node was visited.
+func (v *Visits) Visited(id int) bool {
+	_, ok := v.order[id]
+	return ok
+}
+
+// at returns the position of the visit of the node, starting
+// at 1.
+func (v *Visits) at(id int) int {
+	if at, ok := v.order[id]; ok {
+		return at
+	}
+	return never
+}
+
 // Node has an eval method that returns true depending
 // on the visited elements.
 type Node interface {
-	Eval(visited []bool) bool
+	Eval(v *Visits) bool
+	// String returns the expression of the node.
+	String() string
+	// at returns the position of the visit that satisfied the
+	// node or never.
+	at(v *Visits) int
 }
 
 // And is a node that implements the and binary expression.
@@ -24,9 +75,12 @@ type And struct {
 }
 
 // Eval implements the Node interface for and.
-func (and And) Eval(visited []bool) bool {
-	return and.Left.Eval(visited) && and.Right.Eval(visited)
+func (and And) Eval(v *Visits) bool {
+	return and.at(v) != never
+}
 
+func (and And) at(v *Visits) int {
+	return max(and.Left.at(v), and.Right.at(v))
 }
 
 // Or is a node that implements the or binary expression.
@@ -35,95 +89,303 @@ type Or struct {
 }
 
 // Eval implements the Node interface for or.
-func (or Or) Eval(visited []bool) bool {
-	return or.Left.Eval(visited) || or.Right.Eval(visited)
+func (or Or) Eval(v *Visits) bool {
+	return or.at(v) != never
+}
+
+func (or Or) at(v *Visits) int {
+	return min(or.Left.at(v), or.Right.at(v))
+}
+
+// Xor is a node that implements the exclusive or binary
+// expression.
+type Xor struct {
+	Left, Right Node
+}
+
+// Eval implements the Node interface for xor.
+func (xor Xor) Eval(v *Visits) bool {
+	return xor.at(v) != never
+}
+
+func (xor Xor) at(v *Visits) int {
+	l, r := xor.Left.at(v), xor.Right.at(v)
+	if (l == never) == (r == never) {
+		return never
+	}
+	return min(l, r)
+}
+
+// Not is a node that is satisfied as long as its node is not.
+type Not struct {
+	Node Node
+}
+
+// Eval implements the Node interface for not.
+func (not Not) Eval(v *Visits) bool {
+	return not.at(v) != never
+}
+
+func (not Not) at(v *Visits) int {
+	if not.Node.at(v) != never {
+		return never
+	}
+	return 0
+}
+
+// Then is a node that is satisfied when Right is satisfied
+// after Left.
+type Then struct {
+	Left, Right Node
+}
+
+// Eval implements the Node interface for then.
+func (then Then) Eval(v *Visits) bool {
+	return then.at(v) != never
+}
+
+func (then Then) at(v *Visits) int {
+	l, r := then.Left.at(v), then.Right.at(v)
+	if l >= r {
+		return never
+	}
+	return r
+}
+
+// Of is a node that is satisfied when at least K of its nodes
+// are.
+type Of struct {
+	K     int
+	Nodes []Node
 }
 
-// Leaf represents a leaf in the tree.
+// Eval implements the Node interface for k of n.
+func (of Of) Eval(v *Visits) bool {
+	return of.at(v) != never
+}
+
+func (of Of) at(v *Visits) int {
+	if of.K <= 0 {
+		return 0
+	}
+	if of.K > len(of.Nodes) {
+		return never
+	}
+	ats := make([]int, len(of.Nodes))
+	for i, n := range of.Nodes {
+		ats[i] = n.at(v)
+	}
+	sort.Ints(ats)
+	return ats[of.K-1]
+}
+
+// Leaf represents a leaf in the tree, its value is a node ID.
 type Leaf struct {
 	Value int
 }
 
 // Eval implements the Node interface for Leaft.
-func (l Leaf) Eval(visited []bool) bool {
-	return visited[l.Value]
-}
-
-// Parse parses the expression and returns the tree.
-func Parse(expression string) Node {
-	var stack Stack
-	postfix := infixToPostfix(expression)
-	for _, c := range postfix {
-		switch c {
-		case ' ':
-			break
-		case andOp:
-			a := And{}
-			a.Left, _ = stack.Pop().(Node)
-			a.Right, _ = stack.Pop().(Node)
-			stack.Push(a)
-		case orOp:
-			o := Or{}
-			o.Left, _ = stack.Pop().(Node)
-			o.Right, _ = stack.Pop().(Node)
-			stack.Push(o)
-		default:
-			v, err := strconv.Atoi(string(c))
-			if err != nil {
-				return Leaf{}
+func (l Leaf) Eval(v *Visits) bool {
+	return v.Visited(l.Value)
+}
+
+func (l Leaf) at(v *Visits) int {
+	return v.at(l.Value)
+}
+
+// Parse parses the expression and returns the tree. Leaves are
+// node IDs, from lowest to highest precedence the operators are:
+//
+//	a then b     b after a
+//	a | b        a or b, also spelled "or"
+//	a ^ b        either a or b but not both, also spelled "xor"
+//	a & b        a and b, also spelled "and"
+//	!a           not a, also spelled "not"
+//
+// and k of (a, b, ...) is satisfied by any k of its
+// expressions. It returns a *SyntaxError if the expression is
+// not valid.
+func Parse(expression string) (Node, error) {
+	tokens, err := lex(expression)
+	if err != nil {
+		return nil, err
+	}
+	postfix, err := infixToPostfix(tokens)
+	if err != nil {
+		return nil, err
+	}
+	return build(postfix)
+}
+
+// build builds the tree of the postfix expression. It returns a
+// *SyntaxError if an operator is missing operands or there is
+// more than one tree.
+func build(postfix []*operator) (Node, error) {
+	var stack Stack[Node]
+	for _, op := range postfix {
+		arity := 2
+		switch op.kind {
+		case numTok:
+			stack.Push(Leaf{Value: op.val})
+			continue
+		case notTok:
+			arity = 1
+		case ofTok:
+			arity = op.args
+		}
+		n := make([]Node, arity)
+		for i := arity - 1; i >= 0; i-- {
+			var ok bool
+			if n[i], ok = stack.Pop(); !ok {
+				return nil, syntaxError(op.pos, "missing operand of %s", op.token)
 			}
-			stack.Push(Leaf{Value: v})
+		}
+		switch op.kind {
+		case notTok:
+			stack.Push(Not{Node: n[0]})
+		case andTok:
+			stack.Push(And{Left: n[0], Right: n[1]})
+		case orTok:
+			stack.Push(Or{Left: n[0], Right: n[1]})
+		case xorTok:
+			stack.Push(Xor{Left: n[0], Right: n[1]})
+		case thenTok:
+			stack.Push(Then{Left: n[0], Right: n[1]})
+		case ofTok:
+			stack.Push(Of{K: op.val, Nodes: n})
+		default:
+			return nil, syntaxError(op.pos, "unexpected %s", op.token)
 		}
 	}
-	t, _ := stack.Pop().(Node)
-	return t
+	t, ok := stack.Pop()
+	if !ok || !stack.Empty() {
+		return nil, syntaxError(0, "expected a single expression")
+	}
+	return t, nil
+}
+
+// operator is a token in the operator stack or the postfix
+// expression. args counts the expressions of a k of n, both in
+// the operator and in its open paren, it is zero for any other
+// paren.
+type operator struct {
+	token
+	args int
 }
 
-func infixToPostfix(infix string) string {
-	var stack Stack
-	postfix := ""
-	for _, c := range infix {
-		switch c {
-		case ' ':
-		case andOp, orOp:
-			for !stack.Empty() && (precedence(c) <= precedence(stack.Top())) {
-				top, _ := stack.Pop().(rune)
-				postfix += " " + string(top)
+// infixToPostfix reorders the tokens in postfix notation,
+// checking that operators and operands alternate and that
+// parentheses match.
+func infixToPostfix(tokens []token) ([]*operator, error) {
+	var (
+		stack   Stack[*operator]
+		postfix []*operator
+		// operand is true when an operand is expected next.
+		operand = true
+	)
+	top := func() *operator {
+		op, _ := stack.Peek()
+		return op
+	}
+	// unwind moves the operators up to the innermost open
+	// paren to the postfix expression.
+	unwind := func() *operator {
+		for op := top(); op != nil; op = top() {
+			if op.kind == openTok {
+				return op
 			}
-			stack.Push(c)
-		case openParen:
-			stack.Push(c)
-		case closeParen:
-			for !stack.Empty() {
-				str, _ := stack.Top().(rune)
-				if str == openParen {
+			postfix = append(postfix, op)
+			stack.Pop()
+		}
+		return nil
+	}
+	if len(tokens) == 1 {
+		return nil, syntaxError(0, "empty expression")
+	}
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if operand {
+			switch t.kind {
+			case numTok:
+				if tokens[i+1].kind != ofTok {
+					postfix = append(postfix, &operator{token: t})
+					operand = false
 					break
 				}
-				postfix += " " + string(str)
+				if tokens[i+2].kind != openTok {
+					return nil, syntaxError(tokens[i+2].pos, "expected \"(\" after %q but got %s", t.text+" "+tokens[i+1].text, tokens[i+2])
+				}
+				of := &operator{token: tokens[i+1]}
+				of.val = t.val
+				stack.Push(of)
+				stack.Push(&operator{token: tokens[i+2], args: 1})
+				i += 2
+			case notTok, openTok:
+				stack.Push(&operator{token: t})
+			default:
+				return nil, syntaxError(t.pos, "expected a node id but got %s", t)
+			}
+			continue
+		}
+		switch t.kind {
+		case andTok, orTok, xorTok, thenTok:
+			for op := top(); op != nil && precedence(op.kind) >= precedence(t.kind); op = top() {
+				postfix = append(postfix, op)
 				stack.Pop()
 			}
+			stack.Push(&operator{token: t})
+			operand = true
+		case commaTok:
+			paren := unwind()
+			if paren == nil || paren.args == 0 {
+				return nil, syntaxError(t.pos, "unexpected \",\" outside of k of n")
+			}
+			paren.args++
+			operand = true
+		case closeTok:
+			paren := unwind()
+			if paren == nil {
+				return nil, syntaxError(t.pos, "unmatched \")\"")
+			}
 			stack.Pop()
+			if paren.args == 0 {
+				break
+			}
+			of, ok := stack.Pop()
+			if !ok || of.kind != ofTok {
+				return nil, syntaxError(paren.pos, "\"(\" of k of n without k")
+			}
+			of.args = paren.args
+			if of.val < 1 || of.val > of.args {
+				return nil, syntaxError(of.pos, "k of %v must be between 1 and %v but got %v", of.args, of.args, of.val)
+			}
+			postfix = append(postfix, of)
+		case endTok:
+			if paren := unwind(); paren != nil {
+				return nil, syntaxError(paren.pos, "unclosed \"(\"")
+			}
 		default:
-			postfix += " " + string(c)
+			return nil, syntaxError(t.pos, "expected an operator but got %s", t)
 		}
 	}
-	for !stack.Empty() {
-		str, _ := stack.Pop().(rune)
-		postfix += " " + string(str)
-	}
-	return strings.TrimSpace(postfix)
+	return postfix, nil
 }
 
-func precedence(v interface{}) int {
-	r, _ := v.(rune)
-	switch r {
-	case orOp:
+// precedence returns the precedence of the operator, it is zero
+// for parentheses.
+func precedence(kind tokenKind) int {
+	switch kind {
+	case thenTok:
 		return 1
-	case andOp:
+	case orTok:
 		return 2
-	case openParen:
-		return 0
+	case xorTok:
+		return 3
+	case andTok:
+		return 4
+	case notTok:
+		return 5
 	default:
-		return -1
+		return 0
 	}
 }
@@ -1,6 +1,40 @@
 package tree
 
-import "testing"
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// postfix returns the postfix notation of the expression.
+func postfix(infix string) (string, error) {
+	tokens, err := lex(infix)
+	if err != nil {
+		return "", err
+	}
+	ops, err := infixToPostfix(tokens)
+	if err != nil {
+		return "", err
+	}
+	s := []string{}
+	for _, op := range ops {
+		if op.kind == ofTok {
+			s = append(s, strconv.Itoa(op.val)+"of"+strconv.Itoa(op.args))
+			continue
+		}
+		s = append(s, op.text)
+	}
+	return strings.Join(s, " "), nil
+}
+
+// visits returns the visits of the nodes in order.
+func visits(nodes ...int) *Visits {
+	v := NewVisits()
+	for _, n := range nodes {
+		v.Visit(n)
+	}
+	return v
+}
 
 func TestInfixToPostfix(t *testing.T) {
 	t.Parallel()
@@ -15,10 +49,20 @@ func TestInfixToPostfix(t *testing.T) {
 		{name: "and no paren", infix: "1&2", result: "1 2 &"},
 		{name: "no operator", infix: "1", result: "1"},
 		{name: "no paren lot of &", infix: "1&2&3&4", result: "1 2 & 3 & 4 &"},
+		{name: "multi digit ids", infix: "12&345", result: "12 345 &"},
+		{name: "precedence", infix: "1 then 2|3^4&!5", result: "1 2 3 4 5 ! & ^ | then"},
+		{name: "words", infix: "not 1 AND 2 or 3 xor 4", result: "1 not 2 AND 3 4 xor or"},
+		{name: "double not", infix: "!!1", result: "1 ! !"},
+		{name: "k of n", infix: "2 of (1, 3&4, 5)", result: "1 3 4 & 5 2of3"},
+		{name: "nested k of n", infix: "1 of (2 of (1,2), (3))", result: "1 2 2of2 3 1of2"},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(tt *testing.T) {
-			if postfix := infixToPostfix(c.infix); postfix != c.result {
+			postfix, err := postfix(c.infix)
+			if err != nil {
+				tt.Fatalf("failed to parse %s: %s", c.infix, err)
+			}
+			if postfix != c.result {
 				tt.Errorf("expected %s but got %s", c.result, postfix)
 			}
 		})
@@ -30,22 +74,97 @@ func TestParse(t *testing.T) {
 
 	cases := []struct {
 		name       string
-		visited    []bool
+		visits     *Visits
 		expression string
 		eval       bool
 	}{
-		{name: "and with all visited", visited: []bool{true, true, true, true}, expression: "(0|1)&(2|3)", eval: true},
-		{name: "or with enough visited", visited: []bool{true, false}, expression: "0|1", eval: true},
-		{name: "and with not all visited", visited: []bool{true, false}, expression: "0&1", eval: false},
-		{name: "or with none visited", visited: []bool{false, false}, expression: "0|1", eval: false},
-		{name: "and of lot expressions no paren", visited: []bool{true, true, true, true}, expression: "0&1&2&3", eval: true},
+		{name: "and with all visited", visits: visits(0, 1, 2, 3), expression: "(0|1)&(2|3)", eval: true},
+		{name: "or with enough visited", visits: visits(0), expression: "0|1", eval: true},
+		{name: "and with not all visited", visits: visits(0), expression: "0&1", eval: false},
+		{name: "or with none visited", visits: visits(), expression: "0|1", eval: false},
+		{name: "and of lot expressions no paren", visits: visits(0, 1, 2, 3), expression: "0&1&2&3", eval: true},
+		{name: "multi digit id", visits: visits(18), expression: "18", eval: true},
+		{name: "not visited id", visits: visits(0), expression: "0&18", eval: false},
+		{name: "xor with one visited", visits: visits(1), expression: "0^1", eval: true},
+		{name: "xor with both visited", visits: visits(1, 0), expression: "0 xor 1", eval: false},
+		{name: "not visited", visits: visits(0), expression: "0&!1", eval: true},
+		{name: "not with visited", visits: visits(0, 1), expression: "0&!1", eval: false},
+		{name: "then in order", visits: visits(0, 1), expression: "0 then 1", eval: true},
+		{name: "then out of order", visits: visits(1, 0), expression: "0 then 1", eval: false},
+		{name: "then chain", visits: visits(2, 0, 1), expression: "2 then 0 then 1", eval: true},
+		{name: "then of and", visits: visits(1, 0, 2), expression: "(0&1) then 2", eval: true},
+		{name: "then of and out of order", visits: visits(0, 2, 1), expression: "(0&1) then 2", eval: false},
+		{name: "k of n satisfied", visits: visits(1, 4), expression: "2 of (1,3,4)", eval: true},
+		{name: "k of n not satisfied", visits: visits(1, 2), expression: "2 of (1,3,4)", eval: false},
+		{name: "then k of n", visits: visits(0, 3, 4), expression: "0 then 2 of (1,3,4)", eval: true},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(tt *testing.T) {
-			t := Parse(c.expression)
-			if eval := t.Eval(c.visited); eval != c.eval {
+			t, err := Parse(c.expression)
+			if err != nil {
+				tt.Fatalf("failed to parse %s: %s", c.expression, err)
+			}
+			if eval := t.Eval(c.visits); eval != c.eval {
 				tt.Fatalf("expected %s to eval to %v but got %v", c.expression, c.eval, eval)
 			}
 		})
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		expression string
+		pos        int
+	}{
+		{expression: "", pos: 1},
+		{expression: "   ", pos: 1},
+		{expression: "1 &", pos: 4},
+		{expression: "& 1", pos: 1},
+		{expression: "&", pos: 1},
+		{expression: "1 2", pos: 3},
+		{expression: "(1 | 2", pos: 1},
+		{expression: "1 | 2)", pos: 6},
+		{expression: ")(", pos: 1},
+		{expression: "()", pos: 2},
+		{expression: "1 & 2 $ 3", pos: 7},
+		{expression: "1 nand 2", pos: 3},
+		{expression: "1 & 99999999", pos: 5},
+		{expression: "1, 2", pos: 2},
+		{expression: "(1, 2)", pos: 3},
+		{expression: "2 of 1", pos: 6},
+		{expression: "3 of (1, 2)", pos: 3},
+		{expression: "0 of (1)", pos: 3},
+		{expression: "2 of (1,)", pos: 9},
+		{expression: "1 !", pos: 3},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.expression)
+		serr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Fatalf("expected syntax error parsing %q but got %v", c.expression, err)
+		}
+		if serr.Pos != c.pos {
+			t.Fatalf("expected error parsing %q at column %v but got %s", c.expression, c.pos, serr)
+		}
+	}
+}
+
+func TestBuildMalformed(t *testing.T) {
+	t.Parallel()
+
+	leaf := &operator{token: token{kind: numTok, text: "1", val: 1}}
+	cases := [][]*operator{
+		{},
+		{{token: token{kind: andTok, text: "&"}}},
+		{leaf, {token: token{kind: andTok, text: "&"}}},
+		{leaf, {token: token{kind: ofTok, text: "of", val: 1}, args: 2}},
+		{leaf, leaf},
+	}
+	for i, c := range cases {
+		if n, err := build(c); err == nil {
+			t.Fatalf("expected case %v to fail but got %#v", i, n)
+		}
+	}
+}
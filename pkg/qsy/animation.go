@@ -0,0 +1,217 @@
+package qsy
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MinAnimationPeriod is the shortest period of a blink or
+	// a pulse.
+	MinAnimationPeriod = 4 * frameInterval
+	// MaxAnimationDuration is the longest period or fade of an
+	// animation, durations travel as milliseconds in 16 bits.
+	MaxAnimationDuration = 0xffff * time.Millisecond
+
+	// frameInterval is the time between the frames of the
+	// animations emulated by the server.
+	frameInterval = 25 * time.Millisecond
+	// animationField is the ProtocolV2 field of animations.
+	animationField = 1
+
+	// FrameConfig is the config bit of the frames of emulated
+	// animations. A frame is a command that only changes the
+	// light of the node, the step it belongs to keeps running.
+	FrameConfig = 1 << 13
+)
+
+// ErrInvalidAnimation is the error returned when the timings of
+// an animation are out of range.
+var ErrInvalidAnimation = errors.New("invalid animation")
+
+// AnimationKind is the pattern of the light of a node.
+type AnimationKind uint8
+
+const (
+	// Steady keeps the light on.
+	Steady AnimationKind = iota
+	// Blink turns the light on and off, it is on for the
+	// first half of every period.
+	Blink
+	// Fade fades the light in when it turns on and out before
+	// it turns off.
+	Fade
+	// Pulse dims the light and brings it back every period.
+	Pulse
+)
+
+// String implements the Stringer interface.
+func (k AnimationKind) String() string {
+	switch k {
+	case Steady:
+		return "Steady"
+	case Blink:
+		return "Blink"
+	case Fade:
+		return "Fade"
+	case Pulse:
+		return "Pulse"
+	default:
+		return "Unknown"
+	}
+}
+
+// Animation is the light animation played by a node while it is
+// on. Nodes that advertise CapAnimation and speak ProtocolV2
+// play it themselves, the server emulates it for the rest by
+// sending a frame every time the light changes. Frames are
+// commands with FrameConfig set.
+type Animation struct {
+	Kind AnimationKind
+	// Period is the duration of a blink or a pulse.
+	Period time.Duration
+	// FadeIn and FadeOut are the durations of the fades. The
+	// light fades out at the end of the delay of the packet, it
+	// does not fade out if the delay is zero.
+	FadeIn  time.Duration
+	FadeOut time.Duration
+}
+
+// Validate returns ErrInvalidAnimation if the timings of the
+// animation are out of range.
+func (a Animation) Validate() error {
+	switch a.Kind {
+	case Steady, Fade:
+	case Blink, Pulse:
+		if a.Period < MinAnimationPeriod {
+			return errors.Wrapf(ErrInvalidAnimation, "%s period %s is shorter than %s", a.Kind, a.Period, MinAnimationPeriod)
+		}
+	default:
+		return errors.Wrapf(ErrInvalidAnimation, "kind %v", uint8(a.Kind))
+	}
+	for _, d := range []time.Duration{a.Period, a.FadeIn, a.FadeOut} {
+		if d < 0 || d > MaxAnimationDuration {
+			return errors.Wrapf(ErrInvalidAnimation, "duration %s is out of range", d)
+		}
+	}
+	return nil
+}
+
+// level returns the brightness of the light, from 0 to 1, t
+// after the animation started. d is how long the light is on,
+// zero meaning until it is told otherwise. Lights that are on
+// never go below a level of 1/MaxLevel, except while a blink is
+// off.
+func (a Animation) level(t, d time.Duration) float64 {
+	const min = 1.0 / MaxLevel
+	switch a.Kind {
+	case Blink:
+		if t%a.Period < a.Period/2 {
+			return 1
+		}
+		return 0
+	case Fade:
+		l := 1.0
+		if a.FadeIn > 0 && t < a.FadeIn {
+			l = min + (1-min)*float64(t)/float64(a.FadeIn)
+		}
+		if left := d - t; d > 0 && a.FadeOut > 0 && left < a.FadeOut {
+			if out := min + (1-min)*float64(left)/float64(a.FadeOut); out < l {
+				l = out
+			}
+		}
+		return l
+	case Pulse:
+		// a triangle that starts at the top of the period
+		phase := float64(t%a.Period) / float64(a.Period)
+		if phase < 0.5 {
+			return 1 - (1-min)*2*phase
+		}
+		return min + (1-min)*(2*phase-1)
+	default:
+		return 1
+	}
+}
+
+// over returns true if the animation does not change the light
+// anymore t after it started, d is how long the light is on.
+func (a Animation) over(t, d time.Duration) bool {
+	if d > 0 && t >= d {
+		return true
+	}
+	return a.Kind == Steady || a.Kind == Fade && d == 0 && t >= a.FadeIn
+}
+
+// dim returns c with every channel scaled by level. Channels
+// that are on stay on as long as the level is not zero.
+func dim(c Color, level float64) Color {
+	if level >= 1 {
+		return c
+	}
+	scaled := Color(0)
+	for shift := uint(12); shift >= 4; shift -= 4 {
+		ch := float64(c >> shift & 0xf)
+		l := Color(ch*level + 0.5)
+		if l == 0 && ch > 0 && level > 0 {
+			l = 1
+		}
+		scaled |= l << shift
+	}
+	return scaled
+}
+
+// frame returns the packet that shows pkt t after its animation
+// started. Frames carry what is left of the delay.
+func frame(pkt Packet, t time.Duration) Packet {
+	d := time.Duration(pkt.Delay) * time.Millisecond
+	pkt.Color = dim(pkt.Color, pkt.Animation.level(t, d))
+	if d > 0 {
+		pkt.Delay = uint32((d - t) / time.Millisecond)
+	}
+	pkt.Animation = Animation{}
+	return pkt
+}
+
+func init() {
+	extensions[animationField] = extension{
+		encode: encodeAnimation,
+		decode: decodeAnimation,
+	}
+}
+
+// encodeAnimation encodes the animation of the packet as its
+// kind followed by the period, fade in and fade out in
+// milliseconds.
+func encodeAnimation(pkt Packet) ([]byte, bool) {
+	a := pkt.Animation
+	if a.Kind == Steady {
+		return nil, false
+	}
+	b := make([]byte, 7)
+	b[0] = uint8(a.Kind)
+	binary.BigEndian.PutUint16(b[1:], uint16(a.Period/time.Millisecond))
+	binary.BigEndian.PutUint16(b[3:], uint16(a.FadeIn/time.Millisecond))
+	binary.BigEndian.PutUint16(b[5:], uint16(a.FadeOut/time.Millisecond))
+	return b, true
+}
+
+// decodeAnimation decodes the animation encoded by
+// encodeAnimation into the packet.
+func decodeAnimation(pkt *Packet, b []byte) error {
+	if len(b) < 7 {
+		return errors.Wrapf(ErrShortPacket, "animation of %v bytes", len(b))
+	}
+	a := Animation{
+		Kind:    AnimationKind(b[0]),
+		Period:  time.Duration(binary.BigEndian.Uint16(b[1:])) * time.Millisecond,
+		FadeIn:  time.Duration(binary.BigEndian.Uint16(b[3:])) * time.Millisecond,
+		FadeOut: time.Duration(binary.BigEndian.Uint16(b[5:])) * time.Millisecond,
+	}
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	pkt.Animation = a
+	return nil
+}
@@ -0,0 +1,187 @@
+package qsy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestAnimationFrames(t *testing.T) {
+	t.Parallel()
+
+	period := 200 * time.Millisecond
+	tests := []struct {
+		name   string
+		a      Animation
+		delay  uint32
+		t      time.Duration
+		color  Color
+		remain uint32
+	}{
+		{"steady", Animation{}, 500, 300 * time.Millisecond, Red, 200},
+		{"blink on", Animation{Kind: Blink, Period: period}, 0, 250 * time.Millisecond, Red, 0},
+		{"blink off", Animation{Kind: Blink, Period: period}, 0, 350 * time.Millisecond, NoColor, 0},
+		{"fade in", Animation{Kind: Fade, FadeIn: period}, 1000, 0, Color(0x1000), 1000},
+		{"fade half", Animation{Kind: Fade, FadeIn: period}, 1000, 100 * time.Millisecond, Color(0x8000), 900},
+		{"fade on", Animation{Kind: Fade, FadeIn: period, FadeOut: period}, 1000, 500 * time.Millisecond, Red, 500},
+		{"fade out", Animation{Kind: Fade, FadeIn: period, FadeOut: period}, 1000, 1000 * time.Millisecond, Color(0x1000), 0},
+		{"pulse top", Animation{Kind: Pulse, Period: period}, 0, 0, White, 0},
+		{"pulse bottom", Animation{Kind: Pulse, Period: period}, 0, 100 * time.Millisecond, Color(0x1110), 0},
+	}
+	for _, tt := range tests {
+		color := Red
+		if tt.a.Kind == Pulse {
+			color = White
+		}
+		pkt := NewPacket(ToucheT, 1, color, tt.delay, 1, false, false)
+		pkt.Animation = tt.a
+		f := frame(pkt, tt.t)
+		if f.Color != tt.color || f.Delay != tt.remain {
+			t.Errorf("%s: expected %s for %vms but got %s for %vms", tt.name, tt.color, tt.remain, f.Color, f.Delay)
+		}
+		if f.Animation != (Animation{}) {
+			t.Errorf("%s: frames should not have an animation", tt.name)
+		}
+	}
+}
+
+func TestAnimationValidate(t *testing.T) {
+	t.Parallel()
+
+	invalid := []Animation{
+		{Kind: Blink},
+		{Kind: Pulse, Period: MinAnimationPeriod - 1},
+		{Kind: Fade, FadeIn: MaxAnimationDuration + time.Millisecond},
+		{Kind: Pulse + 1},
+	}
+	for _, a := range invalid {
+		if err := a.Validate(); errors.Cause(err) != ErrInvalidAnimation {
+			t.Errorf("expected ErrInvalidAnimation for %+v but got %v", a, err)
+		}
+	}
+	if err := (Animation{Kind: Blink, Period: time.Second}).Validate(); err != nil {
+		t.Errorf("failed to validate blink: %s", err)
+	}
+}
+
+func TestAnimationField(t *testing.T) {
+	t.Parallel()
+
+	pkt := NewPacket(ToucheT, 1, Blue, 1000, 2, false, false)
+	pkt.Animation = Animation{Kind: Fade, FadeIn: 120 * time.Millisecond, FadeOut: time.Second}
+	c := V2Codec{}
+	b, err := c.Encode(pkt)
+	if err != nil {
+		t.Fatalf("failed to encode packet: %s", err)
+	}
+	got := Packet{}
+	if err := c.Decode(b, &got); err != nil {
+		t.Fatalf("failed to decode packet: %s", err)
+	}
+	if got != pkt {
+		t.Fatalf("expected %+v but got %+v", pkt, got)
+	}
+	// v1 has no room for animations
+	b, _ = V1Codec{}.Encode(pkt)
+	if err := (V1Codec{}).Decode(b, &got); err != nil || got.Animation != (Animation{}) {
+		t.Fatalf("expected v1 packet without animation but got %+v, %v", got.Animation, err)
+	}
+}
+
+func TestEmulatedAnimation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		hello  Hello
+		frames []Color
+	}{
+		{"emulated", Hello{ID: 1}, []Color{Red, NoColor, Red, NoColor}},
+		{"native", Hello{ID: 1, Version: ProtocolV2, Caps: CapAnimation}, []Color{Red}},
+		{"no capability", Hello{ID: 1, Version: ProtocolV2}, []Color{Red, NoColor, Red, NoColor}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+				e           = newEvents()
+				conns       = make(chan net.Conn, 1)
+			)
+			defer cancel()
+			srv, err := NewServer(ctx, "", "", e,
+				WithDiscoverer(NewStaticDiscoverer(tt.hello)),
+				WithDialer(pipeDialer(conns)))
+			if err != nil {
+				t.Fatalf("failed to create server: %s", err)
+			}
+			if err := srv.ListenAndAccept(); err != nil {
+				t.Fatalf("failed to start server: %s", err)
+			}
+			defer srv.Close()
+			conn := <-conns
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			codec := Codec(V1Codec{})
+			if tt.hello.Version >= ProtocolV2 {
+				// the handshake is written before the node is new
+				b := make([]byte, PacketSize)
+				if _, err := io.ReadFull(r, b); err != nil {
+					t.Fatalf("failed to read handshake: %s", err)
+				}
+				codec = V2Codec{}
+			}
+			<-e.new
+
+			pkt := NewPacket(ToucheT, 1, Red, 0, 1, false, false)
+			pkt.Animation = Animation{Kind: Blink, Period: 4 * frameInterval}
+			go srv.Send(pkt)
+			for i, c := range tt.frames {
+				b, err := codec.ReadFrame(r, nil)
+				if err != nil {
+					t.Fatalf("failed to read frame %v: %s", i, err)
+				}
+				got := Packet{}
+				if err := codec.Decode(b, &got); err != nil {
+					t.Fatalf("failed to decode frame %v: %s", i, err)
+				}
+				if got.Color != c {
+					t.Fatalf("expected frame %v to be %s but got %s", i, c, got.Color)
+				}
+				if i == 0 && tt.name == "native" && got.Animation != pkt.Animation {
+					t.Fatalf("expected animation %+v but got %+v", pkt.Animation, got.Animation)
+				}
+				// only the first frame is a new step
+				if frame := got.T == CommandT && got.Config&FrameConfig != 0; frame != (i > 0) {
+					t.Fatalf("unexpected frame %v: %+v", i, got)
+				}
+			}
+			// a new packet stops the animation
+			go srv.Send(NewPacket(ToucheT, 1, NoColor, 0, 2, false, false))
+			for {
+				b, err := codec.ReadFrame(r, nil)
+				if err != nil {
+					t.Fatalf("failed to read frame: %s", err)
+				}
+				got := Packet{}
+				if err := codec.Decode(b, &got); err != nil {
+					t.Fatalf("failed to decode frame: %s", err)
+				}
+				if got.Step == 2 {
+					break
+				}
+			}
+			conn.SetReadDeadline(time.Now().Add(8 * frameInterval))
+			if b, err := codec.ReadFrame(r, nil); err == nil {
+				t.Fatalf("expected no frames after the animation stopped but got %v", b)
+			}
+		})
+	}
+}
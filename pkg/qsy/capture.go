@@ -0,0 +1,306 @@
+package qsy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SendListener is a Listener that wants to know about the
+// packets sent to the nodes. PacketSent is called by the
+// goroutine sending the packet once it is encoded, so it must
+// be safe for concurrent use. Frames of emulated animations are
+// not reported.
+type SendListener interface {
+	Listener
+	PacketSent(Packet)
+}
+
+// WireListener is a Listener that wants every packet read from
+// and written to the nodes. Besides touches and commands it gets
+// keep alives, latency probes, animation frames, handshakes, ID
+// assignments and the hellos of the discoverer, which are read
+// as HelloT packets. Packets that can't be decoded are left out.
+// Its methods are called by the goroutines of the server and of
+// the nodes, so they must be safe for concurrent use.
+type WireListener interface {
+	Listener
+	PacketRead(Packet)
+	PacketWritten(Packet)
+}
+
+// RecordKind is the kind of event of a Record.
+type RecordKind string
+
+const (
+	// RecordIn is a packet received from a node.
+	RecordIn RecordKind = "in"
+	// RecordOut is a packet sent to a node.
+	RecordOut RecordKind = "out"
+	// RecordNew is a new node.
+	RecordNew RecordKind = "new"
+	// RecordLost is a lost node.
+	RecordLost RecordKind = "lost"
+	// RecordReconnect is a node that came back within the
+	// reconnect grace window.
+	RecordReconnect RecordKind = "reconnect"
+)
+
+// Record is an event of a capture. Captures are JSON lines, one
+// Record per line:
+//
+//	{"time":"2019-03-02T18:04:05.123456789Z","kind":"in","node":18,"packet":{...}}
+//
+// Packet is only set for RecordIn and RecordOut, it has the
+// fields of Packet with durations in nanoseconds. Every packet
+// exchanged with the nodes is captured, including the ones that
+// never reach a Listener, see WireListener. Packets that can't
+// be decoded are left out.
+type Record struct {
+	Time   time.Time  `json:"time"`
+	Kind   RecordKind `json:"kind"`
+	Node   uint16     `json:"node"`
+	Packet *Packet    `json:"packet,omitempty"`
+}
+
+// Recorder is a WireListener that writes every packet and node
+// event to a capture before passing the events to the wrapped
+// Listener, which can be nil.
+type Recorder struct {
+	l Listener
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewRecorder returns a Recorder that writes the capture to w
+// and wraps l.
+func NewRecorder(w io.Writer, l Listener) *Recorder {
+	return &Recorder{l: l, enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error writing the capture. The events
+// are passed to the wrapped Listener regardless.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// record writes the event to the capture.
+func (r *Recorder) record(kind RecordKind, id uint16, pkt *Packet) {
+	rec := Record{Time: time.Now(), Kind: kind, Node: id, Packet: pkt}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(rec); err != nil && r.err == nil {
+		r.err = errors.Wrap(err, "failed to write capture")
+	}
+}
+
+// Receive implements the Listener interface. The packet was
+// captured by PacketRead.
+func (r *Recorder) Receive(pkt Packet) {
+	if r.l != nil {
+		r.l.Receive(pkt)
+	}
+}
+
+// LostNode implements the Listener interface.
+func (r *Recorder) LostNode(id uint16) {
+	r.record(RecordLost, id, nil)
+	if r.l != nil {
+		r.l.LostNode(id)
+	}
+}
+
+// NewNode implements the Listener interface.
+func (r *Recorder) NewNode(id uint16) {
+	r.record(RecordNew, id, nil)
+	if r.l != nil {
+		r.l.NewNode(id)
+	}
+}
+
+// Touche implements the ToucheListener interface. Wrapped
+// listeners that are not a ToucheListener receive the packet.
+func (r *Recorder) Touche(t Touche) {
+	if tl, ok := r.l.(ToucheListener); ok {
+		tl.Touche(t)
+	} else if r.l != nil {
+		r.l.Receive(t.Packet)
+	}
+}
+
+// PacketSent implements the SendListener interface. The packet
+// is captured by PacketWritten.
+func (r *Recorder) PacketSent(pkt Packet) {
+	if sl, ok := r.l.(SendListener); ok {
+		sl.PacketSent(pkt)
+	}
+}
+
+// PacketRead implements the WireListener interface.
+func (r *Recorder) PacketRead(pkt Packet) {
+	r.record(RecordIn, pkt.ID, &pkt)
+	if wl, ok := r.l.(WireListener); ok {
+		wl.PacketRead(pkt)
+	}
+}
+
+// PacketWritten implements the WireListener interface.
+func (r *Recorder) PacketWritten(pkt Packet) {
+	r.record(RecordOut, pkt.ID, &pkt)
+	if wl, ok := r.l.(WireListener); ok {
+		wl.PacketWritten(pkt)
+	}
+}
+
+// NodeReconnected implements the ReconnectListener interface.
+func (r *Recorder) NodeReconnected(id uint16) {
+	r.record(RecordReconnect, id, nil)
+	if rl, ok := r.l.(ReconnectListener); ok {
+		rl.NodeReconnected(id)
+	}
+}
+
+// NodeConflict implements the ConflictListener interface.
+// Conflicts are not captured.
+func (r *Recorder) NodeConflict(cerr *ConflictError) {
+	if cl, ok := r.l.(ConflictListener); ok {
+		cl.NodeConflict(cerr)
+	}
+}
+
+// NodePaired implements the PairingListener interface.
+// Pairings are not captured.
+func (r *Recorder) NodePaired(p PairedNode) {
+	if pl, ok := r.l.(PairingListener); ok {
+		pl.NodePaired(p)
+	}
+}
+
+// RecordReader reads the records of a capture.
+type RecordReader struct {
+	s    *bufio.Scanner
+	line int
+}
+
+// NewRecordReader returns a RecordReader that reads the
+// capture from r.
+func NewRecordReader(r io.Reader) *RecordReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 4096), 1<<20)
+	return &RecordReader{s: s}
+}
+
+// Next returns the next record of the capture or io.EOF once
+// every record was read. Empty lines are skipped.
+func (r *RecordReader) Next() (Record, error) {
+	for r.s.Scan() {
+		r.line++
+		if len(r.s.Bytes()) == 0 {
+			continue
+		}
+		rec := Record{}
+		if err := json.Unmarshal(r.s.Bytes(), &rec); err != nil {
+			return Record{}, errors.Wrapf(err, "failed to decode record at line %v", r.line)
+		}
+		return rec, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return Record{}, errors.Wrap(err, "failed to read capture")
+	}
+	return Record{}, io.EOF
+}
+
+// Replay feeds the capture read from r to l. Records are
+// replayed with the time between them divided by speed, a speed
+// of zero or less replays them without waiting. Every packet is
+// replayed to a WireListener but, like the server does, only
+// touches are passed to Receive and only the written packets
+// that are not keep alives, probes, frames, handshakes or ID
+// assignments to a SendListener. Reconnections are replayed to
+// a ReconnectListener. Replay returns once the capture is over
+// or ctx is done.
+func Replay(ctx context.Context, r io.Reader, l Listener, speed float64) error {
+	var (
+		rr    = NewRecordReader(r)
+		start time.Time
+		first time.Time
+	)
+	for {
+		rec, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			first, start = rec.Time, time.Now()
+		}
+		if speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / speed))
+			t := time.NewTimer(time.Until(at))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		replay(rec, l)
+	}
+}
+
+// replay passes the record to l.
+func replay(rec Record, l Listener) {
+	wl, wire := l.(WireListener)
+	switch rec.Kind {
+	case RecordIn:
+		if rec.Packet == nil {
+			break
+		}
+		if wire {
+			wl.PacketRead(*rec.Packet)
+		}
+		if rec.Packet.T == ToucheT {
+			l.Receive(*rec.Packet)
+		}
+	case RecordOut:
+		if rec.Packet == nil {
+			break
+		}
+		if wire {
+			wl.PacketWritten(*rec.Packet)
+		}
+		if sl, ok := l.(SendListener); ok && !control(*rec.Packet) {
+			sl.PacketSent(*rec.Packet)
+		}
+	case RecordNew:
+		l.NewNode(rec.Node)
+	case RecordLost:
+		l.LostNode(rec.Node)
+	case RecordReconnect:
+		if rl, ok := l.(ReconnectListener); ok {
+			rl.NodeReconnected(rec.Node)
+		}
+	}
+}
+
+// control returns true if the packet is written by the server
+// itself rather than sent by its user.
+func control(pkt Packet) bool {
+	if pkt.T == KeepAliveT || pkt.T == HelloT {
+		return true
+	}
+	return pkt.Config&(FrameConfig|AssignIDConfig|ProbeConfig) != 0
+}
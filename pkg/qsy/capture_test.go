@@ -0,0 +1,169 @@
+package qsy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// sends is an events Listener that is also a SendListener.
+type sends struct {
+	*events
+	sent chan Packet
+}
+
+func (s sends) PacketSent(p Packet) {
+	s.sent <- p
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		e           = newEvents()
+		conns       = make(chan net.Conn, 1)
+		capture     = &syncBuffer{}
+	)
+	defer cancel()
+	srv, err := NewServer(ctx, "", "", NewRecorder(capture, e),
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 18, Addr: "pipe"})),
+		WithDialer(pipeDialer(conns)),
+		WithProbeInterval(0))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	conn := <-conns
+	<-e.new
+
+	out := NewPacket(ToucheT, 18, Red, 500, 1, false, true)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- srv.SendContext(ctx, out)
+	}()
+	b := make([]byte, PacketSize)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("failed to read command: %s", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("failed to send command: %s", err)
+	}
+	// keep alives never reach the listener but are captured
+	ka := NewPacket(KeepAliveT, 18, NoColor, 0, 0, false, false)
+	in := NewPacket(ToucheT, 18, Red, 230, 1, false, false)
+	for _, p := range []Packet{ka, in} {
+		b, _ = p.Encode()
+		if _, err := conn.Write(b); err != nil {
+			t.Fatalf("failed to write packet: %s", err)
+		}
+	}
+	if p := <-e.packets; p != in {
+		t.Fatalf("expected %+v but got %+v", in, p)
+	}
+	srv.Close()
+	<-e.lost
+	conn.Close()
+
+	hello := NewHelloPacket(18, 0, 0)
+	rr := NewRecordReader(strings.NewReader(capture.String()))
+	want := []Record{
+		{Kind: RecordIn, Node: 18, Packet: &hello},
+		{Kind: RecordNew, Node: 18},
+		{Kind: RecordOut, Node: 18, Packet: &out},
+		{Kind: RecordIn, Node: 18, Packet: &ka},
+		{Kind: RecordIn, Node: 18, Packet: &in},
+		{Kind: RecordLost, Node: 18},
+	}
+	for i, w := range want {
+		rec, err := rr.Next()
+		if err != nil {
+			t.Fatalf("failed to read record %v: %s", i, err)
+		}
+		if rec.Kind != w.Kind || rec.Node != w.Node || rec.Time.IsZero() {
+			t.Fatalf("expected record %v to be %+v but got %+v", i, w, rec)
+		}
+		if w.Packet != nil && (rec.Packet == nil || *rec.Packet != *w.Packet) {
+			t.Fatalf("expected record %v to have %+v but got %+v", i, w.Packet, rec.Packet)
+		}
+	}
+	if _, err := rr.Next(); err != io.EOF {
+		t.Fatalf("expected the end of the capture but got %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+
+	const capture = `{"time":"2019-03-02T18:04:05Z","kind":"new","node":3}
+{"time":"2019-03-02T18:04:05.05Z","kind":"out","node":3,"packet":{"Signature":[81,83,89],"T":2,"ID":3,"Color":61440,"Delay":500,"Step":1,"Config":0}}
+{"time":"2019-03-02T18:04:05.06Z","kind":"out","node":3,"packet":{"Signature":[81,83,89],"T":3,"ID":3,"Color":0,"Delay":0,"Step":0,"Config":32768}}
+
+{"time":"2019-03-02T18:04:05.07Z","kind":"in","node":3,"packet":{"Signature":[81,83,89],"T":3,"ID":3,"Color":0,"Delay":0,"Step":0,"Config":0}}
+{"time":"2019-03-02T18:04:05.1Z","kind":"in","node":3,"packet":{"Signature":[81,83,89],"T":2,"ID":3,"Color":61440,"Delay":250,"Step":1,"Config":0}}
+{"time":"2019-03-02T18:04:05.15Z","kind":"reconnect","node":3}
+{"time":"2019-03-02T18:04:05.2Z","kind":"lost","node":3}
+`
+	s := sends{events: newEvents(), sent: make(chan Packet, 10)}
+	start := time.Now()
+	if err := Replay(context.Background(), strings.NewReader(capture), s, 2); err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Fatalf("expected the replay to take 100ms but took %s", d)
+	}
+	if id := <-s.new; id != 3 {
+		t.Fatalf("expected new node 3 but got %v", id)
+	}
+	if p := <-s.sent; p.Delay != 500 {
+		t.Fatalf("expected sent packet with delay 500 but got %+v", p)
+	}
+	// keep alives are not passed to Receive
+	if p := <-s.packets; p.Delay != 250 || p.Color != Red {
+		t.Fatalf("expected received packet with delay 250 but got %+v", p)
+	}
+	if id := <-s.reconnected; id != 3 {
+		t.Fatalf("expected node 3 to reconnect but got %v", id)
+	}
+	if id := <-s.lost; id != 3 {
+		t.Fatalf("expected lost node 3 but got %v", id)
+	}
+	// neither are the probes passed to PacketSent
+	if len(s.sent) != 0 {
+		t.Fatalf("expected a single sent packet but got %+v", <-s.sent)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Replay(ctx, strings.NewReader(capture), newEvents(), 1); err != context.Canceled {
+		t.Fatalf("expected context.Canceled but got %v", err)
+	}
+	if err := Replay(context.Background(), strings.NewReader("{\"kind\":\n"), newEvents(), 0); err == nil {
+		t.Fatalf("expected error replaying a broken capture")
+	}
+}
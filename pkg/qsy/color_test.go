@@ -0,0 +1,83 @@
+package qsy
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestRGB(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		r, g, b uint8
+		color   Color
+	}{
+		{0xff, 0x00, 0x00, Red},
+		{0x00, 0xff, 0x00, Green},
+		{0xff, 0xff, 0xff, White},
+		{0x00, 0x00, 0x00, NoColor},
+		{0xff, 0x88, 0x00, Color(0xf800)},
+		{0x07, 0x09, 0xf7, Color(0x01f0)},
+	}
+	for _, tt := range tests {
+		c := RGB(tt.r, tt.g, tt.b)
+		if c != tt.color {
+			t.Errorf("RGB(%#x, %#x, %#x) = %#04x, want %#04x", tt.r, tt.g, tt.b, uint16(c), uint16(tt.color))
+		}
+	}
+	for c := Color(0); c < 0xfff0; c += 0x10 {
+		if got := RGB(c.R(), c.G(), c.B()); got != c {
+			t.Fatalf("RGB of the channels of %#04x = %#04x", uint16(c), uint16(got))
+		}
+	}
+}
+
+func TestColorString(t *testing.T) {
+	t.Parallel()
+
+	if s := Magenta.String(); s != "Magenta" {
+		t.Errorf("expected Magenta but got %s", s)
+	}
+	if s := RGB(0xff, 0x88, 0x00).String(); s != "#f80" {
+		t.Errorf("expected #f80 but got %s", s)
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		s     string
+		color Color
+	}{
+		{"#f80", Color(0xf800)},
+		{"#FF8800", Color(0xf800)},
+		{"#000", NoColor},
+		{"Green", Green},
+		{"lime", Green},
+		{" orange ", RGB(0xff, 0xa5, 0x00)},
+		{"NoColor", NoColor},
+		{"off", NoColor},
+	}
+	for _, tt := range tests {
+		c, err := ParseColor(tt.s)
+		if err != nil {
+			t.Errorf("failed to parse %q: %s", tt.s, err)
+			continue
+		}
+		if c != tt.color {
+			t.Errorf("parsed %q as %s, want %s", tt.s, c, tt.color)
+		}
+	}
+	for _, s := range []string{"", "#", "#ff", "#ff88", "#ggg", "#-10", "ultraviolet"} {
+		if _, err := ParseColor(s); errors.Cause(err) != ErrUnknownColor {
+			t.Errorf("expected ErrUnknownColor for %q but got %v", s, err)
+		}
+	}
+	for name, c := range Palette() {
+		if got, err := ParseColor(c.String()); err != nil || got != c {
+			t.Errorf("failed to parse %s back (%s): %s %v", c, name, got, err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package qsy
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultBufferSize is the default size of the channels
+	// used for forwarding events.
+	DefaultBufferSize = 50
+	// DefaultQueueSize is the default size of the outbound
+	// queue of each node.
+	DefaultQueueSize = 16
+	// DefaultWriteTimeout is the default amount of time a
+	// write to a node can take.
+	DefaultWriteTimeout = time.Second
+	// DefaultProbeInterval is the default amount of time
+	// between latency probes.
+	DefaultProbeInterval = time.Second
+)
+
+// ConfigError is the error returned when a configuration
+// value is not valid.
+type ConfigError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Config is the configuration of a Server. Use DefaultConfig
+// as the starting point, the zero value IS NOT valid.
+type Config struct {
+	// Interface is the network interface where the nodes
+	// live. It is only required when no Discoverer is set.
+	Interface string
+	// LocalAddress is the IP address associated with the
+	// network interface. It is only required when no Dialer
+	// is set.
+	LocalAddress string
+	// Group is the multicast group where nodes send hello
+	// packets.
+	Group net.IP
+	// Port is the port where nodes send hello packets and
+	// listen for connections.
+	Port int
+	// KeepAlive is the amount of time a node can go without
+	// sending a keep alive before being considered lost.
+	KeepAlive time.Duration
+	// BufferSize is the size of the channels used for
+	// forwarding events.
+	BufferSize int
+	// NoDelay sets TCP no-delay on the node connections.
+	NoDelay bool
+	// QueueSize is the amount of packets that can be waiting
+	// to be written to each node.
+	QueueSize int
+	// WriteTimeout bounds every write to a node.
+	WriteTimeout time.Duration
+	// Overflow decides which packet TrySend drops when the
+	// outbound queue of a node is full.
+	Overflow OverflowPolicy
+	// ProbeInterval is the time between latency probes sent
+	// to each node. Zero disables probing.
+	ProbeInterval time.Duration
+	// ReconnectGrace is the time a node that lost its
+	// connection has to say hello again and keep its identity.
+	// Zero, the default, reports lost nodes right away.
+	ReconnectGrace time.Duration
+	// AssignIDs makes the server assign a free ID to a node
+	// that says hello with an ID that is already in use.
+	AssignIDs bool
+	// ProtocolVersion is the latest protocol version the
+	// server speaks. Each node is spoken the latest version
+	// both of them know.
+	ProtocolVersion uint16
+	// Pairings stores the allow-list of nodes. If nil every
+	// node is accepted while searching.
+	Pairings PairingStore
+	// Discoverer finds new nodes. If nil the server listens
+	// for hello packets sent to Group on Interface.
+	Discoverer Discoverer
+	// Dialer connects to new nodes. If nil nodes are dialed
+	// over TCP from LocalAddress.
+	Dialer Dialer
+}
+
+// DefaultConfig returns the configuration used by QSY nodes.
+func DefaultConfig() Config {
+	return Config{
+		Group:           group,
+		Port:            QSYPort,
+		KeepAlive:       DefaultDelay * time.Second,
+		BufferSize:      DefaultBufferSize,
+		NoDelay:         true,
+		QueueSize:       DefaultQueueSize,
+		WriteTimeout:    DefaultWriteTimeout,
+		Overflow:        DropNewest,
+		ProbeInterval:   DefaultProbeInterval,
+		ProtocolVersion: LatestProtocol,
+	}
+}
+
+// Validate returns a *ConfigError describing the first invalid
+// value found in the configuration.
+func (c Config) Validate() error {
+	if c.Discoverer == nil {
+		if c.Interface == "" {
+			return &ConfigError{Field: "interface", Reason: "required when no discoverer is set"}
+		}
+		if ip := c.Group.To4(); ip == nil || !ip.IsMulticast() {
+			return &ConfigError{Field: "group", Reason: fmt.Sprintf("%v is not an IPv4 multicast address", c.Group)}
+		}
+	}
+	if c.Dialer == nil {
+		if c.LocalAddress == "" {
+			return &ConfigError{Field: "local address", Reason: "required when no dialer is set"}
+		}
+		if ip := net.ParseIP(c.LocalAddress); ip == nil || ip.To4() == nil {
+			return &ConfigError{Field: "local address", Reason: fmt.Sprintf("%q is not an IPv4 address", c.LocalAddress)}
+		}
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return &ConfigError{Field: "port", Reason: fmt.Sprintf("%d is out of range", c.Port)}
+	}
+	if c.KeepAlive <= 0 {
+		return &ConfigError{Field: "keep alive", Reason: "must be positive"}
+	}
+	if c.BufferSize < 0 {
+		return &ConfigError{Field: "buffer size", Reason: "can't be negative"}
+	}
+	if c.QueueSize < 0 {
+		return &ConfigError{Field: "queue size", Reason: "can't be negative"}
+	}
+	if c.WriteTimeout <= 0 {
+		return &ConfigError{Field: "write timeout", Reason: "must be positive"}
+	}
+	if c.Overflow != DropNewest && c.Overflow != DropOldest {
+		return &ConfigError{Field: "overflow policy", Reason: fmt.Sprintf("unknown policy %d", c.Overflow)}
+	}
+	if c.ProbeInterval < 0 {
+		return &ConfigError{Field: "probe interval", Reason: "can't be negative"}
+	}
+	if c.ReconnectGrace < 0 {
+		return &ConfigError{Field: "reconnect grace", Reason: "can't be negative"}
+	}
+	if _, err := LookupCodec(c.ProtocolVersion); err != nil {
+		return &ConfigError{Field: "protocol version", Reason: fmt.Sprintf("no codec for version %d", c.ProtocolVersion)}
+	}
+	return nil
+}
+
+// Option modifies the configuration of the server.
+type Option func(*Config)
+
+// WithInterface sets the network interface where nodes live.
+func WithInterface(inf string) Option {
+	return func(c *Config) {
+		c.Interface = inf
+	}
+}
+
+// WithLocalAddress sets the IP address used for dialing nodes.
+func WithLocalAddress(addr string) Option {
+	return func(c *Config) {
+		c.LocalAddress = addr
+	}
+}
+
+// WithGroup sets the multicast group where nodes say hello.
+func WithGroup(ip net.IP) Option {
+	return func(c *Config) {
+		c.Group = ip
+	}
+}
+
+// WithPort sets the port used for reaching the nodes.
+func WithPort(port int) Option {
+	return func(c *Config) {
+		c.Port = port
+	}
+}
+
+// WithKeepAlive sets the amount of time a node can go without
+// sending a keep alive.
+func WithKeepAlive(d time.Duration) Option {
+	return func(c *Config) {
+		c.KeepAlive = d
+	}
+}
+
+// WithBufferSize sets the size of the event channels.
+func WithBufferSize(size int) Option {
+	return func(c *Config) {
+		c.BufferSize = size
+	}
+}
+
+// WithNoDelay sets TCP no-delay on the node connections.
+func WithNoDelay(noDelay bool) Option {
+	return func(c *Config) {
+		c.NoDelay = noDelay
+	}
+}
+
+// WithQueueSize sets the size of the outbound queue of
+// each node.
+func WithQueueSize(size int) Option {
+	return func(c *Config) {
+		c.QueueSize = size
+	}
+}
+
+// WithWriteTimeout sets the maximum amount of time a write to
+// a node can take.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(c *Config) {
+		c.WriteTimeout = d
+	}
+}
+
+// WithOverflow sets the policy used by TrySend when the
+// outbound queue of a node is full.
+func WithOverflow(p OverflowPolicy) Option {
+	return func(c *Config) {
+		c.Overflow = p
+	}
+}
+
+// WithProbeInterval sets the time between latency probes,
+// zero disables probing.
+func WithProbeInterval(d time.Duration) Option {
+	return func(c *Config) {
+		c.ProbeInterval = d
+	}
+}
+
+// WithReconnectGrace sets the time a lost node has to come
+// back and keep its identity, zero disables reconnections.
+func WithReconnectGrace(d time.Duration) Option {
+	return func(c *Config) {
+		c.ReconnectGrace = d
+	}
+}
+
+// WithAssignIDs sets whether nodes with a conflicting ID are
+// assigned a free one. See Config.AssignIDs.
+func WithAssignIDs(assign bool) Option {
+	return func(c *Config) {
+		c.AssignIDs = assign
+	}
+}
+
+// WithProtocolVersion sets the latest protocol version the
+// server speaks. See Config.ProtocolVersion.
+func WithProtocolVersion(version uint16) Option {
+	return func(c *Config) {
+		c.ProtocolVersion = version
+	}
+}
+
+// WithPairings makes the server only accept the nodes in the
+// allow-list kept in store. See Server.Pair.
+func WithPairings(store PairingStore) Option {
+	return func(c *Config) {
+		c.Pairings = store
+	}
+}
+
+// WithDiscoverer makes the server discover nodes using d
+// instead of listening for multicast hello packets.
+func WithDiscoverer(d Discoverer) Option {
+	return func(c *Config) {
+		c.Discoverer = d
+	}
+}
+
+// WithDialer makes the server connect to nodes using d
+// instead of dialing them over TCP.
+func WithDialer(d Dialer) Option {
+	return func(c *Config) {
+		c.Dialer = d
+	}
+}
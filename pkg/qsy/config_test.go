@@ -0,0 +1,83 @@
+package qsy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := DefaultConfig()
+	valid.Interface = "wlan0"
+	valid.LocalAddress = "10.0.0.1"
+	cases := []struct {
+		name   string
+		opt    Option
+		field  string
+		hasErr bool
+	}{
+		{name: "default", opt: func(*Config) {}},
+		{name: "no interface", opt: WithInterface(""), field: "interface", hasErr: true},
+		{name: "no interface with discoverer", opt: func(c *Config) {
+			c.Interface = ""
+			c.Discoverer = NewStaticDiscoverer()
+		}},
+		{name: "unicast group", opt: WithGroup(net.IP{10, 0, 0, 1}), field: "group", hasErr: true},
+		{name: "no local address", opt: WithLocalAddress(""), field: "local address", hasErr: true},
+		{name: "hostname local address", opt: WithLocalAddress("terminal"), field: "local address", hasErr: true},
+		{name: "no local address with dialer", opt: func(c *Config) {
+			c.LocalAddress = ""
+			c.Dialer = UnixDialer{}
+		}},
+		{name: "port out of range", opt: WithPort(70000), field: "port", hasErr: true},
+		{name: "no keep alive", opt: WithKeepAlive(0), field: "keep alive", hasErr: true},
+		{name: "negative buffer", opt: WithBufferSize(-1), field: "buffer size", hasErr: true},
+		{name: "unbuffered", opt: WithBufferSize(0)},
+		{name: "negative queue", opt: WithQueueSize(-1), field: "queue size", hasErr: true},
+		{name: "no write timeout", opt: WithWriteTimeout(0), field: "write timeout", hasErr: true},
+		{name: "unknown overflow", opt: WithOverflow(OverflowPolicy(9)), field: "overflow policy", hasErr: true},
+		{name: "drop oldest", opt: WithOverflow(DropOldest)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(tt *testing.T) {
+			cfg := valid
+			c.opt(&cfg)
+			err := cfg.Validate()
+			if !c.hasErr {
+				if err != nil {
+					tt.Fatalf("expected config to be valid but got %s", err)
+				}
+				return
+			}
+			cerr, ok := err.(*ConfigError)
+			if !ok {
+				tt.Fatalf("expected *ConfigError but got %v", err)
+			}
+			if cerr.Field != c.field {
+				tt.Fatalf("expected error on %s but got %s", c.field, cerr)
+			}
+		})
+	}
+}
+
+func TestNewServerOptions(t *testing.T) {
+	t.Parallel()
+
+	srv, err := NewServer(context.Background(), "", "", nil,
+		WithDiscoverer(NewStaticDiscoverer()),
+		WithDialer(UnixDialer{}),
+		WithKeepAlive(time.Second),
+		WithBufferSize(3))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if srv.cfg.KeepAlive != time.Second || srv.cfg.BufferSize != 3 {
+		t.Fatalf("options were not applied: %+v", srv.cfg)
+	}
+	if _, err := NewServer(context.Background(), "", "", nil, WithDialer(UnixDialer{})); err == nil {
+		t.Fatalf("expected error without network interface")
+	}
+}
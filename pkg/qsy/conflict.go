@@ -0,0 +1,153 @@
+package qsy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AssignIDConfig is the config bit that marks a command as an
+// ID assignment. The new ID of the node travels in the Step
+// field, the node is expected to drop the connection and say
+// hello with its new ID.
+const AssignIDConfig = 1 << 14
+
+// ConflictError describes two nodes saying hello with the
+// same ID from different addresses. The node that holds the
+// ID keeps it and the other one is refused.
+type ConflictError struct {
+	ID uint16
+	// Addr is the address of the node that holds the ID.
+	Addr string
+	// ConflictAddr is the address of the refused node.
+	ConflictAddr string
+	// AssignedID is the ID assigned to the refused node, it
+	// is zero if no ID was assigned.
+	AssignedID uint16
+}
+
+func (e *ConflictError) Error() string {
+	msg := fmt.Sprintf("node id %v is used by %s and %s", e.ID, e.Addr, e.ConflictAddr)
+	if e.AssignedID != 0 {
+		msg += fmt.Sprintf(", assigned id %v to %s", e.AssignedID, e.ConflictAddr)
+	}
+	return msg
+}
+
+// ConflictListener is a Listener that wants to know about
+// duplicate node IDs. Listeners that don't implement it are
+// not notified of conflicts.
+type ConflictListener interface {
+	Listener
+	NodeConflict(*ConflictError)
+}
+
+// host returns the host of addr, or addr itself if it has no
+// port.
+func host(addr string) string {
+	h, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return h
+}
+
+// conflict refuses the hello of a node whose ID is held by the
+// node at addr. Every conflicting address is reported once for
+// as long as the ID is held. If ID assignment is enabled and the
+// refused node advertises CapAssignID it is told to use the
+// lowest free ID, as long as it would be accepted as a new
+// node: while pairing or, without pairing store, while
+// searching.
+func (srv *Server) conflict(h Hello, addr string) {
+	key := Hello{ID: h.ID, Addr: host(h.Addr)}
+	if srv.conflicts[key] {
+		return
+	}
+	srv.conflicts[key] = true
+	cerr := &ConflictError{ID: h.ID, Addr: addr, ConflictAddr: h.Addr}
+	if srv.cfg.AssignIDs && h.Caps.Has(CapAssignID) && srv.assignable() {
+		if id, ok := srv.freeID(); ok {
+			if err := srv.assign(h, id); err != nil {
+				log.Printf("failed to assign id %v to %s: %s", id, h.Addr, err)
+			} else {
+				srv.mu.Lock()
+				srv.assigned[id] = true
+				srv.mu.Unlock()
+				cerr.AssignedID = id
+			}
+		}
+	}
+	srv.events <- Error{ID: h.ID, Err: cerr}
+}
+
+// assignable returns true if a conflicting node can be
+// assigned a new ID in the current discovery state.
+func (srv *Server) assignable() bool {
+	switch srv.State() {
+	case Pairing:
+		return true
+	case Searching:
+		return srv.cfg.Pairings == nil
+	default:
+		return false
+	}
+}
+
+// forget forgets the conflicts reported for id, it is called
+// once the ID is released.
+func (srv *Server) forget(id uint16) {
+	for key := range srv.conflicts {
+		if key.ID == id {
+			delete(srv.conflicts, key)
+		}
+	}
+}
+
+// freeID returns the lowest ID that is neither connected,
+// within its reconnect grace window, paired nor assigned in the
+// current discovery state.
+func (srv *Server) freeID() (uint16, bool) {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	for id := uint16(1); id != 0; id++ {
+		if _, ok := srv.pool.Load(id); ok {
+			continue
+		}
+		if _, ok := srv.pending[id]; ok || srv.assigned[id] {
+			continue
+		}
+		if _, ok := srv.paired[id]; ok {
+			continue
+		}
+		return id, true
+	}
+	return 0, false
+}
+
+// assign connects to the node that said hello and sends it
+// the command to change its ID.
+func (srv *Server) assign(h Hello, id uint16) error {
+	pkt := NewPacket(CommandT, h.ID, NoColor, 0, id, false, false)
+	pkt.Config |= AssignIDConfig
+	codec := negotiate(h.Version, srv.cfg.ProtocolVersion)
+	conn, err := srv.dialer.Dial(srv.ctx, h)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(srv.cfg.WriteTimeout)); err != nil {
+		return errors.Wrap(err, "failed to set write deadline")
+	}
+	if err := srv.handshake(conn, h, codec); err != nil {
+		return errors.Wrap(err, "failed to negotiate protocol")
+	}
+	if err := writePacket(conn, codec, pkt); err != nil {
+		return errors.Wrap(err, "failed to write assignment")
+	}
+	srv.written(pkt)
+	return nil
+}
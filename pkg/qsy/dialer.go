@@ -0,0 +1,79 @@
+package qsy
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer establishes the connection with a node that said
+// hello.
+type Dialer interface {
+	Dial(ctx context.Context, h Hello) (Conn, error)
+}
+
+// DialerFunc is an adapter to allow the use of ordinary
+// functions as dialers.
+type DialerFunc func(ctx context.Context, h Hello) (Conn, error)
+
+// Dial implements the Dialer interface.
+func (f DialerFunc) Dial(ctx context.Context, h Hello) (Conn, error) {
+	return f(ctx, h)
+}
+
+// TCPDialer dials nodes over TCP. It is the dialer used by
+// default.
+type TCPDialer struct {
+	// LocalAddr is the local address used for dialing. If
+	// it is nil a local address is automatically chosen.
+	LocalAddr *net.TCPAddr
+	// Port is the port nodes whose hello has no port are
+	// dialed on. If it is zero QSYPort is used.
+	Port int
+	// NoDelay sets TCP no-delay on the connections.
+	NoDelay bool
+}
+
+// Dial implements the Dialer interface. The node is dialed on
+// the port of the hello address, such as the one discovered
+// over mDNS, or on the dialer's port if it has none.
+func (d *TCPDialer) Dial(ctx context.Context, h Hello) (Conn, error) {
+	addr := h.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := d.Port
+		if port == 0 {
+			port = QSYPort
+		}
+		addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	}
+	dialer := net.Dialer{}
+	if d.LocalAddr != nil {
+		dialer.LocalAddr = d.LocalAddr
+	}
+	c, err := dialer.DialContext(ctx, tcpv, addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initiate connection to node")
+	}
+	tconn := c.(*net.TCPConn)
+	if err := tconn.SetNoDelay(d.NoDelay); err != nil {
+		tconn.Close()
+		return nil, errors.Wrap(err, "failed to set no delay on node conn")
+	}
+	return tconn, nil
+}
+
+// UnixDialer dials nodes over unix sockets. The address of the
+// hello is the path of the socket.
+type UnixDialer struct{}
+
+// Dial implements the Dialer interface.
+func (UnixDialer) Dial(ctx context.Context, h Hello) (Conn, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, "unix", h.Addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initiate connection to node")
+	}
+	return c, nil
+}
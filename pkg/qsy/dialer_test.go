@@ -0,0 +1,58 @@
+package qsy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTCPDialer(t *testing.T) {
+	t.Parallel()
+
+	ln, err := net.ListenTCP(tcpv, &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	d := &TCPDialer{Port: port, NoDelay: true}
+	c, err := d.Dial(context.Background(), Hello{ID: 1, Addr: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("failed to dial address without port: %s", err)
+	}
+	c.Close()
+
+	// the port discovered over mDNS is used instead of the
+	// dialer's
+	var (
+		service  = mustName("_qsy._tcp.local.")
+		instance = mustName("cone1._qsy._tcp.local.")
+		target   = mustName("cone1.local.")
+		hdr      = func(n dnsmessage.Name) dnsmessage.ResourceHeader {
+			return dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassINET, TTL: 120}
+		}
+	)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	b.PTRResource(hdr(service), dnsmessage.PTRResource{PTR: instance})
+	b.StartAdditionals()
+	b.SRVResource(hdr(instance), dnsmessage.SRVResource{Port: uint16(port), Target: target})
+	b.TXTResource(hdr(instance), dnsmessage.TXTResource{TXT: []string{"id=1"}})
+	b.AResource(hdr(target), dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("failed to build response: %s", err)
+	}
+	hellos, err := parseMDNS(msg, service)
+	if err != nil || len(hellos) != 1 {
+		t.Fatalf("failed to parse response: %v %s", hellos, err)
+	}
+	d.Port = 9
+	c, err = d.Dial(context.Background(), hellos[0])
+	if err != nil {
+		t.Fatalf("failed to dial %s: %s", hellos[0].Addr, err)
+	}
+	c.Close()
+}
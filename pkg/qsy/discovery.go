@@ -0,0 +1,455 @@
+package qsy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	mdnsIDKey      = "id="
+	mdnsVersionKey = "proto="
+	mdnsCapsKey    = "caps="
+)
+
+var (
+	// ErrDiscovererClosed is the error returned by Next once
+	// the discoverer was closed.
+	ErrDiscovererClosed = errors.New("discoverer is closed")
+
+	mdnsGroup = &net.UDPAddr{IP: net.IP{224, 0, 0, 251}, Port: 5353}
+	// errSkip is used by parseMDNS for records it does not
+	// care about.
+	errSkip = errors.New("skip record")
+)
+
+// Hello is a connection request from a node.
+type Hello struct {
+	ID uint16
+	// Addr is the address the node is dialed on. Without a
+	// port the dialer chooses it.
+	Addr string
+	// Version is the latest protocol version spoken by the
+	// node, zero means ProtocolV1.
+	Version uint16
+	Caps    Capability
+}
+
+// Discoverer finds nodes that are willing to connect to the
+// server.
+type Discoverer interface {
+	// Next blocks until a node says hello. Once Next returns
+	// an error no more hellos will be delivered.
+	Next() (Hello, error)
+	// Close unblocks any call to Next and releases the
+	// resources held by the discoverer.
+	Close() error
+}
+
+// multicastDiscoverer discovers nodes by listening to the
+// hello packets they send to a multicast group.
+type multicastDiscoverer struct {
+	pconn *ipv4.PacketConn
+}
+
+// NewMulticastDiscoverer returns a Discoverer that listens for
+// hello packets sent to the group on the given port. inf
+// specifies the network interface used for joining the group.
+// This is how the server discovers nodes by default.
+func NewMulticastDiscoverer(inf string, group net.IP, port int) (Discoverer, error) {
+	i, err := net.InterfaceByName(inf)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid network interface")
+	}
+	c, err := net.ListenPacket(udpv, net.JoinHostPort(defaultRoute, fmt.Sprintf("%v", port)))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid route config")
+	}
+	p := ipv4.NewPacketConn(c)
+	if err = p.JoinGroup(i, &net.UDPAddr{IP: group}); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "failed to join group")
+	}
+	return &multicastDiscoverer{pconn: p}, nil
+}
+
+// Next implements the Discoverer interface.
+func (d *multicastDiscoverer) Next() (Hello, error) {
+	b := make([]byte, PacketSize)
+	for {
+		c, _, src, err := d.pconn.ReadFrom(b)
+		if err != nil {
+			return Hello{}, errors.Wrap(err, "failed to read from udp conn")
+		}
+		// the source port is not the one the node listens on
+		h, err := parseHello(b[:c], host(src.String()))
+		if err != nil {
+			continue
+		}
+		return h, nil
+	}
+}
+
+// parseHello returns the hello of the node at addr that sent
+// the packet in b. The version and capabilities of the node are
+// only taken from hellos with VersionConfig set.
+func parseHello(b []byte, addr string) (Hello, error) {
+	pkt := Packet{}
+	if err := Decode(b, &pkt); err != nil {
+		return Hello{}, err
+	}
+	if pkt.T != HelloT {
+		return Hello{}, errors.Wrapf(ErrUnknownType, "type %v is not a hello", pkt.T)
+	}
+	h := Hello{ID: pkt.ID, Addr: addr}
+	if pkt.Config&VersionConfig != 0 {
+		h.Version = pkt.Step
+		h.Caps = Capability(pkt.Delay)
+	}
+	return h, nil
+}
+
+// Close implements the Discoverer interface.
+func (d *multicastDiscoverer) Close() error {
+	return d.pconn.Close()
+}
+
+// staticDiscoverer discovers a fixed list of nodes.
+type staticDiscoverer struct {
+	hellos chan Hello
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewStaticDiscoverer returns a Discoverer that says hello once
+// for each of the given nodes. Once all of them were delivered
+// Next blocks until the discoverer is closed.
+func NewStaticDiscoverer(hellos ...Hello) Discoverer {
+	d := &staticDiscoverer{
+		hellos: make(chan Hello, len(hellos)),
+		done:   make(chan struct{}),
+	}
+	for _, h := range hellos {
+		d.hellos <- h
+	}
+	return d
+}
+
+// Next implements the Discoverer interface.
+func (d *staticDiscoverer) Next() (Hello, error) {
+	select {
+	case <-d.done:
+		return Hello{}, ErrDiscovererClosed
+	default:
+	}
+	select {
+	case h := <-d.hellos:
+		return h, nil
+	case <-d.done:
+		return Hello{}, ErrDiscovererClosed
+	}
+}
+
+// Close implements the Discoverer interface.
+func (d *staticDiscoverer) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return nil
+}
+
+// mdnsDiscoverer discovers nodes that publish a DNS-SD service
+// over multicast DNS.
+type mdnsDiscoverer struct {
+	conn     *net.UDPConn
+	service  dnsmessage.Name
+	interval time.Duration
+	hellos   chan Hello
+
+	once sync.Once
+	done chan struct{}
+}
+
+// NewMDNSDiscoverer returns a Discoverer that browses the DNS-SD
+// service (e.g. "_qsy._tcp.local.") using one-shot multicast DNS
+// queries every interval. Nodes must publish their ID in a TXT
+// record as "id=<ID>", they can also publish their protocol
+// version as "proto=<version>" and their capabilities as
+// "caps=<capabilities>". A node is delivered when it first shows up
+// in a browse and again only after it was missing from one.
+// inf specifies the network interface used for the queries.
+func NewMDNSDiscoverer(inf, service string, interval time.Duration) (Discoverer, error) {
+	i, err := net.InterfaceByName(inf)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid network interface")
+	}
+	if !strings.HasSuffix(service, ".") {
+		service += "."
+	}
+	name, err := dnsmessage.NewName(service)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid service name")
+	}
+	if interval <= 0 {
+		return nil, errors.New("browse interval must be positive")
+	}
+	c, err := net.ListenUDP(udpv, &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mdns conn")
+	}
+	if err := ipv4.NewPacketConn(c).SetMulticastInterface(i); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "failed to set multicast interface")
+	}
+	d := &mdnsDiscoverer{
+		conn:     c,
+		service:  name,
+		interval: interval,
+		hellos:   make(chan Hello),
+		done:     make(chan struct{}),
+	}
+	go d.browse()
+	return d, nil
+}
+
+// Next implements the Discoverer interface.
+func (d *mdnsDiscoverer) Next() (Hello, error) {
+	select {
+	case h := <-d.hellos:
+		return h, nil
+	case <-d.done:
+		return Hello{}, ErrDiscovererClosed
+	}
+}
+
+// Close implements the Discoverer interface.
+func (d *mdnsDiscoverer) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.done)
+		err = d.conn.Close()
+	})
+	return err
+}
+
+// browse queries for the service every interval and delivers
+// the nodes that were not present on the previous browse.
+func (d *mdnsDiscoverer) browse() {
+	responses := make(chan []Hello)
+	go d.read(responses)
+	query, err := mdnsQuery(d.service)
+	if err != nil {
+		d.Close()
+		return
+	}
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	var (
+		previous = map[Hello]bool{}
+		current  = map[Hello]bool{}
+	)
+	for {
+		if _, err := d.conn.WriteTo(query, mdnsGroup); err != nil {
+			d.Close()
+			return
+		}
+		round := true
+		for round {
+			select {
+			case hs := <-responses:
+				for _, h := range hs {
+					if current[h] {
+						continue
+					}
+					current[h] = true
+					if previous[h] {
+						continue
+					}
+					select {
+					case d.hellos <- h:
+					case <-d.done:
+						return
+					}
+				}
+			case <-t.C:
+				previous, current = current, map[Hello]bool{}
+				round = false
+			case <-d.done:
+				return
+			}
+		}
+	}
+}
+
+func (d *mdnsDiscoverer) read(responses chan<- []Hello) {
+	b := make([]byte, 9000)
+	for {
+		n, _, err := d.conn.ReadFrom(b)
+		if err != nil {
+			d.Close()
+			return
+		}
+		hs, err := parseMDNS(b[:n], d.service)
+		if err != nil || len(hs) == 0 {
+			continue
+		}
+		select {
+		case responses <- hs:
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// mdnsQuery returns a PTR question for service.
+func mdnsQuery(service dnsmessage.Name) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  service,
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseMDNS returns the nodes of service found in the
+// mDNS response msg. Instances missing any of the PTR, SRV, TXT
+// or A records are ignored.
+func parseMDNS(msg []byte, service dnsmessage.Name) ([]Hello, error) {
+	var (
+		p         dnsmessage.Parser
+		instances []string
+		srvs      = map[string]dnsmessage.SRVResource{}
+		ids       = map[string]uint16{}
+		versions  = map[string]uint16{}
+		caps      = map[string]Capability{}
+		ips       = map[string]net.IP{}
+	)
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !h.Response {
+		return nil, nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	record := func(rh dnsmessage.ResourceHeader) error {
+		name := strings.ToLower(rh.Name.String())
+		switch rh.Type {
+		case dnsmessage.TypePTR:
+			r, err := p.PTRResource()
+			if err != nil {
+				return err
+			}
+			if strings.EqualFold(rh.Name.String(), service.String()) {
+				instances = append(instances, strings.ToLower(r.PTR.String()))
+			}
+		case dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			if err != nil {
+				return err
+			}
+			srvs[name] = r
+		case dnsmessage.TypeTXT:
+			r, err := p.TXTResource()
+			if err != nil {
+				return err
+			}
+			for _, txt := range r.TXT {
+				switch {
+				case strings.HasPrefix(txt, mdnsIDKey):
+					if id, err := strconv.ParseUint(txt[len(mdnsIDKey):], 10, 16); err == nil {
+						ids[name] = uint16(id)
+					}
+				case strings.HasPrefix(txt, mdnsVersionKey):
+					if v, err := strconv.ParseUint(txt[len(mdnsVersionKey):], 10, 16); err == nil {
+						versions[name] = uint16(v)
+					}
+				case strings.HasPrefix(txt, mdnsCapsKey):
+					if c, err := strconv.ParseUint(txt[len(mdnsCapsKey):], 0, 32); err == nil {
+						caps[name] = Capability(c)
+					}
+				}
+			}
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return err
+			}
+			ips[name] = net.IP(r.A[:])
+		default:
+			return errSkip
+		}
+		return nil
+	}
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := record(rh); err == errSkip {
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := record(rh); err == errSkip {
+			if err := p.SkipAdditional(); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	hellos := []Hello{}
+	for _, instance := range instances {
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+		id, ok := ids[instance]
+		if !ok {
+			continue
+		}
+		ip, ok := ips[strings.ToLower(srv.Target.String())]
+		if !ok {
+			continue
+		}
+		hellos = append(hellos, Hello{
+			ID:      id,
+			Addr:    net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))),
+			Version: versions[instance],
+			Caps:    caps[instance],
+		})
+	}
+	return hellos, nil
+}
@@ -0,0 +1,101 @@
+package qsy
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestStaticDiscoverer(t *testing.T) {
+	t.Parallel()
+
+	hellos := []Hello{{ID: 1, Addr: "10.0.0.2:3000"}, {ID: 2, Addr: "10.0.0.3:3000"}}
+	d := NewStaticDiscoverer(hellos...)
+	for _, expected := range hellos {
+		h, err := d.Next()
+		if err != nil {
+			t.Fatalf("failed to discover: %s", err)
+		}
+		if h != expected {
+			t.Fatalf("expected %v but got %v", expected, h)
+		}
+	}
+	go d.Close()
+	if _, err := d.Next(); err != ErrDiscovererClosed {
+		t.Fatalf("expected discoverer closed error but got %v", err)
+	}
+}
+
+func TestParseHello(t *testing.T) {
+	t.Parallel()
+
+	// v1 firmware never set the fields of the version
+	legacy := NewPacket(HelloT, 18, NoColor, 0xdead, 0xbeef, false, false)
+	tests := []struct {
+		name     string
+		pkt      Packet
+		expected Hello
+	}{
+		{"v1 with junk", legacy, Hello{ID: 18, Addr: "10.0.0.18"}},
+		{"v2", NewHelloPacket(18, ProtocolV2, CapProbe), Hello{ID: 18, Addr: "10.0.0.18", Version: ProtocolV2, Caps: CapProbe}},
+	}
+	for _, tt := range tests {
+		b, _ := tt.pkt.Encode()
+		h, err := parseHello(b, "10.0.0.18")
+		if err != nil {
+			t.Fatalf("%s: failed to parse hello: %s", tt.name, err)
+		}
+		if h != tt.expected {
+			t.Fatalf("%s: expected %+v but got %+v", tt.name, tt.expected, h)
+		}
+	}
+	b, _ := NewPacket(ToucheT, 18, NoColor, 0, 0, false, false).Encode()
+	if _, err := parseHello(b, "10.0.0.18"); errors.Cause(err) != ErrUnknownType {
+		t.Fatalf("expected unknown type error but got %v", err)
+	}
+}
+
+func TestParseMDNS(t *testing.T) {
+	t.Parallel()
+
+	var (
+		service  = mustName("_qsy._tcp.local.")
+		instance = mustName("cone18._qsy._tcp.local.")
+		orphan   = mustName("cone19._qsy._tcp.local.")
+		host     = mustName("cone18.local.")
+		hdr      = func(n dnsmessage.Name) dnsmessage.ResourceHeader {
+			return dnsmessage.ResourceHeader{Name: n, Class: dnsmessage.ClassINET, TTL: 120}
+		}
+	)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartAnswers()
+	b.PTRResource(hdr(service), dnsmessage.PTRResource{PTR: instance})
+	b.PTRResource(hdr(service), dnsmessage.PTRResource{PTR: orphan})
+	b.StartAdditionals()
+	b.SRVResource(hdr(instance), dnsmessage.SRVResource{Port: 3000, Target: host})
+	b.TXTResource(hdr(instance), dnsmessage.TXTResource{TXT: []string{"v=1", "id=18", "proto=2", "caps=0x3"}})
+	b.AResource(hdr(host), dnsmessage.AResource{A: [4]byte{10, 0, 0, 18}})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatalf("failed to build response: %s", err)
+	}
+	hellos, err := parseMDNS(msg, service)
+	if err != nil {
+		t.Fatalf("failed to parse response: %s", err)
+	}
+	if len(hellos) != 1 {
+		t.Fatalf("expected one node but got %v", hellos)
+	}
+	if expected := (Hello{ID: 18, Addr: "10.0.0.18:3000", Version: ProtocolV2, Caps: CapProbe | CapAssignID}); hellos[0] != expected {
+		t.Fatalf("expected %v but got %v", expected, hellos[0])
+	}
+}
+
+func mustName(name string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
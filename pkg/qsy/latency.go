@@ -0,0 +1,246 @@
+package qsy
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+const (
+	// ProbeConfig is the config bit that marks a keep alive
+	// as a latency probe. The server sends probes with a
+	// sequence number in Step, nodes that support them answer
+	// with a keep alive carrying the same bit and Step and the
+	// node clock in milliseconds as Delay.
+	ProbeConfig = 1 << 15
+
+	// rttWindow is the amount of recent samples used for
+	// computing latency statistics.
+	rttWindow = 32
+	// maxProbes is the maximum amount of unanswered probes
+	// that are remembered.
+	maxProbes = 8
+	// maxSteps is the maximum amount of commanded steps
+	// without touche that are remembered.
+	maxSteps = 64
+)
+
+var (
+	// RTTBuckets are the upper bounds of the buckets of the
+	// round-trip latency histogram. The last bucket of the
+	// histogram counts the samples above every bound.
+	RTTBuckets = []time.Duration{
+		time.Millisecond,
+		2 * time.Millisecond,
+		5 * time.Millisecond,
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		500 * time.Millisecond,
+	}
+)
+
+// RTTStats summarizes the round-trip latency measured with
+// probes.
+type RTTStats struct {
+	Samples uint64
+	// Min, Median and P95 are computed over the most recent
+	// samples.
+	Min    time.Duration
+	Median time.Duration
+	P95    time.Duration
+	// Histogram counts every sample per bucket of RTTBuckets.
+	Histogram []uint64
+}
+
+// Touche is a touche along with the timing measured by the
+// server.
+type Touche struct {
+	Packet
+	// Observed is the time between the server writing the
+	// command of the step and reading the touche.
+	Observed time.Duration
+	// Reaction is Observed without the median round-trip
+	// latency of the node.
+	Reaction time.Duration
+	// Bound is the uncertainty of Reaction, the actual reaction
+	// time is within Reaction ± Bound. If the latency of the
+	// node was not measured yet Bound is equal to Observed.
+	Bound time.Duration
+}
+
+// ToucheListener is a Listener that also wants the timing of
+// each touche. For touches of steps commanded by the server,
+// Touche is called instead of Receive.
+type ToucheListener interface {
+	Listener
+	Touche(Touche)
+}
+
+// latency keeps track of the round-trip latency and clock
+// offset of a node. It is not safe for concurrent use.
+type latency struct {
+	epoch  time.Time
+	seq    uint16
+	probes map[uint16]time.Time
+	// lightOn holds the time each step was commanded.
+	lightOn map[uint16]time.Time
+
+	samples   uint64
+	rtts      [rttWindow]time.Duration
+	offsets   [rttWindow]time.Duration
+	histogram []uint64
+}
+
+func newLatency(epoch time.Time) latency {
+	return latency{
+		epoch:     epoch,
+		probes:    map[uint16]time.Time{},
+		lightOn:   map[uint16]time.Time{},
+		histogram: make([]uint64, len(RTTBuckets)+1),
+	}
+}
+
+// probe returns a new probe packet for the node.
+func (l *latency) probe(id uint16) Packet {
+	l.seq++
+	if l.seq == 0 {
+		l.seq++
+	}
+	p := NewPacket(KeepAliveT, id, NoColor, 0, l.seq, false, false)
+	p.Config |= ProbeConfig
+	return p
+}
+
+// written records the time the encoded packet b was written.
+func (l *latency) written(b []byte, at time.Time) {
+	if len(b) < PacketSize {
+		return
+	}
+	step := binary.BigEndian.Uint16(b[StepHeader:])
+	config := binary.BigEndian.Uint16(b[ConfigHeader:])
+	if b[TypeHeader] == KeepAliveT {
+		if config&ProbeConfig == 0 {
+			return
+		}
+		if len(l.probes) >= maxProbes {
+			for seq := range l.probes {
+				delete(l.probes, seq)
+			}
+		}
+		l.probes[step] = at
+		return
+	}
+	if step == 0 || Color(binary.BigEndian.Uint16(b[ColorRGHeader:])) == NoColor {
+		return
+	}
+	if len(l.lightOn) >= maxSteps {
+		for step := range l.lightOn {
+			delete(l.lightOn, step)
+		}
+	}
+	l.lightOn[step] = at
+}
+
+// answered records the answer to a probe. It returns false if
+// the packet does not answer a known probe.
+func (l *latency) answered(pkt Packet, at time.Time) bool {
+	if pkt.Config&ProbeConfig == 0 {
+		return false
+	}
+	sent, ok := l.probes[pkt.Step]
+	if !ok {
+		return false
+	}
+	delete(l.probes, pkt.Step)
+	rtt := at.Sub(sent)
+	// the node clock is read half way through the round trip
+	mid := sent.Add(rtt / 2).Sub(l.epoch)
+	offset := time.Duration(pkt.Delay)*time.Millisecond - mid
+	i := l.samples % rttWindow
+	l.rtts[i] = rtt
+	l.offsets[i] = offset
+	l.samples++
+	b := sort.Search(len(RTTBuckets), func(i int) bool { return rtt <= RTTBuckets[i] })
+	l.histogram[b]++
+	return true
+}
+
+// window returns the recent samples.
+func (l *latency) window() int {
+	if l.samples < rttWindow {
+		return int(l.samples)
+	}
+	return rttWindow
+}
+
+// last returns the last round-trip latency measured.
+func (l *latency) last() time.Duration {
+	if l.samples == 0 {
+		return 0
+	}
+	return l.rtts[(l.samples-1)%rttWindow]
+}
+
+// stats returns the round-trip statistics.
+func (l *latency) stats() RTTStats {
+	s := RTTStats{
+		Samples:   l.samples,
+		Histogram: append([]uint64(nil), l.histogram...),
+	}
+	n := l.window()
+	if n == 0 {
+		return s
+	}
+	rtts := append([]time.Duration(nil), l.rtts[:n]...)
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	s.Min = rtts[0]
+	s.Median = rtts[n/2]
+	s.P95 = rtts[(n*95-1)/100]
+	return s
+}
+
+// offset returns the estimated offset of the node clock and
+// its error bound. As in NTP the sample with the lowest round
+// trip is used, the error is at most half of that round trip.
+func (l *latency) offset() (time.Duration, time.Duration) {
+	n := l.window()
+	if n == 0 {
+		return 0, 0
+	}
+	best := 0
+	for i := 1; i < n; i++ {
+		if l.rtts[i] < l.rtts[best] {
+			best = i
+		}
+	}
+	return l.offsets[best], l.rtts[best] / 2
+}
+
+// touche returns the timing of the touche or nil if the server
+// did not command its step.
+func (l *latency) touche(pkt Packet, at time.Time) *Touche {
+	on, ok := l.lightOn[pkt.Step]
+	if !ok {
+		return nil
+	}
+	delete(l.lightOn, pkt.Step)
+	t := &Touche{Packet: pkt, Observed: at.Sub(on)}
+	if l.samples == 0 {
+		t.Reaction = t.Observed
+		t.Bound = t.Observed
+		return t
+	}
+	s := l.stats()
+	t.Reaction = t.Observed - s.Median
+	if t.Reaction < 0 {
+		t.Reaction = 0
+	}
+	t.Bound = (s.P95 - s.Min) / 2
+	if t.Bound < s.Median-s.Min {
+		t.Bound = s.Median - s.Min
+	}
+	return t
+}
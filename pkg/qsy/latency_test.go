@@ -0,0 +1,62 @@
+package qsy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	t.Parallel()
+
+	var (
+		epoch = time.Now()
+		l     = newLatency(epoch)
+	)
+	rtts := []time.Duration{4, 6, 8, 30, 5}
+	for i, rtt := range rtts {
+		rtt *= time.Millisecond
+		probe := l.probe(18)
+		b, _ := probe.Encode()
+		sent := epoch.Add(time.Duration(i) * time.Second)
+		l.written(b, sent)
+		// the node clock is one second ahead
+		clock := sent.Add(rtt/2).Sub(epoch) + time.Second
+		answer := NewPacket(KeepAliveT, 18, NoColor, uint32(clock/time.Millisecond), probe.Step, false, false)
+		answer.Config |= ProbeConfig
+		if !l.answered(answer, sent.Add(rtt)) {
+			t.Fatalf("probe %v was not answered", probe.Step)
+		}
+	}
+	if l.answered(NewPacket(KeepAliveT, 18, NoColor, 0, 0, false, false), epoch) {
+		t.Fatalf("plain keep alive should not answer a probe")
+	}
+	s := l.stats()
+	if s.Samples != 5 || s.Min != 4*time.Millisecond || s.Median != 6*time.Millisecond || s.P95 != 30*time.Millisecond {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if l.last() != 5*time.Millisecond {
+		t.Fatalf("expected last rtt to be 5ms but got %s", l.last())
+	}
+	// 4ms and 5ms are in the 5ms bucket, 30ms in the 50ms one
+	if s.Histogram[2] != 2 || s.Histogram[3] != 2 || s.Histogram[5] != 1 {
+		t.Fatalf("unexpected histogram: %v", s.Histogram)
+	}
+	offset, bound := l.offset()
+	if offset != time.Second || bound != 2*time.Millisecond {
+		t.Fatalf("expected offset of 1s ± 2ms but got %s ± %s", offset, bound)
+	}
+
+	cmd, _ := NewPacket(CommandT, 18, Red, 0, 3, false, false).Encode()
+	on := epoch.Add(time.Minute)
+	l.written(cmd, on)
+	touche := l.touche(NewPacket(ToucheT, 18, Red, 200, 3, false, false), on.Add(300*time.Millisecond))
+	if touche == nil {
+		t.Fatalf("expected touche timing")
+	}
+	if touche.Observed != 300*time.Millisecond || touche.Reaction != 294*time.Millisecond || touche.Bound != 13*time.Millisecond {
+		t.Fatalf("unexpected touche timing: %+v", touche)
+	}
+	if l.touche(NewPacket(ToucheT, 18, Red, 200, 3, false, false), on) != nil {
+		t.Fatalf("touche of the same step should only be timed once")
+	}
+}
@@ -1,10 +1,51 @@
 package qsy
 
 import (
+	"bufio"
+	"context"
 	"log"
+	"sync"
 	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNodeClosed is the error returned when sending to a
+	// node whose connection was closed.
+	ErrNodeClosed = errors.New("node connection is closed")
+	// ErrQueueFull is the error returned by TrySend when the
+	// outbound queue of the node is full.
+	ErrQueueFull = errors.New("node outbound queue is full")
+	// ErrDropped is the error returned when a queued packet
+	// is evicted to make room for a newer one.
+	ErrDropped = errors.New("packet was dropped from the outbound queue")
 )
 
+// OverflowPolicy decides what TrySend does when the outbound
+// queue of a node is full.
+type OverflowPolicy uint8
+
+const (
+	// DropNewest drops the packet being sent.
+	DropNewest OverflowPolicy = iota
+	// DropOldest evicts the oldest queued packet to make room
+	// for the one being sent.
+	DropOldest
+)
+
+// request is a packet waiting to be written to the node.
+// If result is not nil the outcome of the write is sent
+// through it. A zero deadline means the node's write timeout
+// is used. Frames of emulated animations don't change the time
+// their step was turned on.
+type request struct {
+	b        []byte
+	deadline time.Time
+	result   chan error
+	frame    bool
+}
+
 // Conn has the methods necessary for the node
 // to operate
 type Conn interface {
@@ -12,83 +53,498 @@ type Conn interface {
 	Write(b []byte) (int, error)
 	Close() error
 	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// NodeInfo describes a connected node and the traffic
+// exchanged with it.
+type NodeInfo struct {
+	ID   uint16
+	Addr string
+	// ConnectedAt is the time the connection was established.
+	ConnectedAt time.Time
+	// Version is the protocol version spoken with the node.
+	Version uint16
+	// Caps are the capabilities advertised by the node.
+	Caps Capability
+	// LastKeepAlive is the time of the last keep alive, it is
+	// zero if the node did not send one yet.
+	LastKeepAlive time.Time
+	PacketsIn     uint64
+	PacketsOut    uint64
+	BytesIn       uint64
+	BytesOut      uint64
+	// DecodeErrors is the amount of packets that could not
+	// be decoded, the following counters break it down by
+	// cause.
+	DecodeErrors    uint64
+	BadSignatures   uint64
+	UnknownTypes    uint64
+	ShortPackets    uint64
+	ReservedConfigs uint64
+	// Reconnects is the amount of times the node came back
+	// within the reconnect grace window.
+	Reconnects uint64
+	// RTT is the last measured round-trip latency, it is zero
+	// if it was not measured yet.
+	RTT     time.Duration
+	Latency RTTStats
+	// ClockOffset is the estimated difference between the node
+	// clock and the time elapsed since ConnectedAt, the error
+	// of the estimation is at most ClockOffsetError.
+	ClockOffset      time.Duration
+	ClockOffsetError time.Duration
 }
 
 // node represents a single node, it holds the information
 // relevant to that node.
 type node struct {
 	conn     Conn
+	codec    Codec
 	id       uint16
 	addr     string
-	requests chan []byte
+	requests chan request
+	timeout  time.Duration
+	overflow OverflowPolicy
+	probes   time.Duration
+	// wire gets every packet read and written if not nil.
+	wire WireListener
+
+	wg   sync.WaitGroup
+	once sync.Once
+	done chan struct{}
+
+	mu   sync.Mutex
+	info NodeInfo
+	lat  latency
+	// anim is closed to stop the emulated animation, animDone
+	// is closed once it stopped.
+	anim     chan struct{}
+	animDone chan struct{}
 }
 
-// newNode returns a node with the specified config.
-func newNode(conn Conn, id uint16, addr string) *node {
+// newNode returns a node with the specified config. The
+// outbound queue and write timeout are taken from cfg. The node
+// speaks ProtocolV1 until its codec is changed.
+func newNode(conn Conn, id uint16, addr string, cfg Config) *node {
+	now := time.Now()
 	return &node{
 		conn:     conn,
+		codec:    V1Codec{},
 		id:       id,
 		addr:     addr,
-		requests: make(chan []byte),
+		requests: make(chan request, cfg.QueueSize),
+		timeout:  cfg.WriteTimeout,
+		overflow: cfg.Overflow,
+		probes:   cfg.ProbeInterval,
+		done:     make(chan struct{}),
+		info: NodeInfo{
+			ID:          id,
+			Addr:        addr,
+			ConnectedAt: now,
+			Version:     ProtocolV1,
+		},
+		lat: newLatency(now),
 	}
 }
 
-// Listen listens over the TCPConn for incoming packets.
-func (n *node) Listen(packets chan<- Packet, lost chan<- uint16, kadelay int64) {
-	go n.write(lost)
-	go n.read(packets, lost, kadelay)
+// Info returns a copy of the information of the node.
+func (n *node) Info() NodeInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	info := n.info
+	info.RTT = n.lat.last()
+	info.Latency = n.lat.stats()
+	info.ClockOffset, info.ClockOffsetError = n.lat.offset()
+	return info
+}
+
+// Listen listens over the TCPConn for incoming packets. If
+// probing is enabled it also probes the node latency.
+func (n *node) Listen(events chan<- Event, lost chan<- *node, kadelay time.Duration) {
+	n.wg.Add(2)
+	go func() {
+		defer n.wg.Done()
+		n.write(lost)
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.read(events, lost, kadelay)
+	}()
+	if n.probes > 0 {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.probe()
+		}()
+	}
+}
+
+// probe queues a latency probe every probe interval. Probes
+// are skipped while the outbound queue is full.
+func (n *node) probe() {
+	t := time.NewTicker(n.probes)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n.mu.Lock()
+			p := n.lat.probe(n.id)
+			n.mu.Unlock()
+			b, err := n.codec.Encode(p)
+			if err != nil {
+				continue
+			}
+			select {
+			case n.requests <- request{b: b}:
+			default:
+			}
+		case <-n.done:
+			return
+		}
+	}
 }
 
 // write writes the requested bytes into the connection.
-func (n *node) write(lost chan<- uint16) {
-	for b := range n.requests {
-		if _, err := n.conn.Write(b); err != nil {
-			log.Printf("failed to write to node: %s", err)
-			lost <- n.id
+// Every write is bounded by the write timeout.
+func (n *node) write(lost chan<- *node) {
+	for {
+		select {
+		case r := <-n.requests:
+			deadline := time.Now().Add(n.timeout)
+			if !r.deadline.IsZero() && r.deadline.Before(deadline) {
+				deadline = r.deadline
+			}
+			err := n.conn.SetWriteDeadline(deadline)
+			if err == nil {
+				var c int
+				at := time.Now()
+				c, err = n.conn.Write(r.b)
+				n.mu.Lock()
+				n.info.BytesOut += uint64(c)
+				if err == nil {
+					n.info.PacketsOut++
+					if !r.frame {
+						n.lat.written(r.b, at)
+					}
+				}
+				n.mu.Unlock()
+			}
+			if err == nil && n.wire != nil {
+				n.written(r.b)
+			}
+			if r.result != nil {
+				r.result <- err
+			}
+			if err != nil {
+				log.Printf("failed to write to node: %s", err)
+				n.lose(lost)
+				return
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// encode encodes the packet with the codec of the node. Every
+// packet stops the animation being emulated. If the packet has
+// an animation that the node can't play the server emulates it:
+// the first frame is returned and the rest are queued as the
+// light changes, see FrameConfig.
+func (n *node) encode(pkt Packet) ([]byte, error) {
+	if err := pkt.Animation.Validate(); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.anim != nil {
+		close(n.anim)
+		<-n.animDone
+		n.anim = nil
+	}
+	native := n.info.Caps.Has(CapAnimation) && n.codec.Version() >= ProtocolV2
+	if native || pkt.Animation.Kind == Steady || pkt.T == KeepAliveT {
+		return n.codec.Encode(pkt)
+	}
+	b, err := n.codec.Encode(frame(pkt, 0))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-n.done:
+		// the node is closed, there is nothing to animate
+		return b, nil
+	default:
+	}
+	n.anim = make(chan struct{})
+	n.animDone = make(chan struct{})
+	n.wg.Add(1)
+	go func(stop, done chan struct{}) {
+		defer n.wg.Done()
+		defer close(done)
+		n.animate(pkt, stop)
+	}(n.anim, n.animDone)
+	return b, nil
+}
+
+// animate queues the frames of the animation of pkt until it is
+// over or stop is closed. Frames wait for room in the outbound
+// queue.
+func (n *node) animate(pkt Packet, stop <-chan struct{}) {
+	var (
+		start = time.Now()
+		d     = time.Duration(pkt.Delay) * time.Millisecond
+		last  = frame(pkt, 0).Color
+		t     = time.NewTicker(frameInterval)
+	)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			elapsed := now.Sub(start)
+			if pkt.Animation.over(elapsed, d) {
+				return
+			}
+			f := frame(pkt, elapsed)
+			if f.Color == last {
+				continue
+			}
+			last = f.Color
+			f.T = CommandT
+			f.Config |= FrameConfig
+			b, err := n.codec.Encode(f)
+			if err != nil {
+				continue
+			}
+			select {
+			case n.requests <- request{b: b, frame: true}:
+			case <-stop:
+				return
+			case <-n.done:
+				return
+			}
+		case <-stop:
+			return
+		case <-n.done:
 			return
 		}
 	}
 }
 
 // read reads from the requests incoming packets. It handles
-// the keep alive delays.
-func (n *node) read(packets chan<- Packet, lost chan<- uint16, kadelay int64) {
-	if err := n.conn.SetReadDeadline(time.Now().Add(time.Duration(kadelay) * time.Second)); err != nil {
+// the keep alive delays, answers to latency probes and the
+// timing of touches. Packets, keep alives and decode errors
+// are sent as events, in the order they were read. After
+// corruption the stream is read again from the next signature.
+func (n *node) read(events chan<- Event, lost chan<- *node, kadelay time.Duration) {
+	if err := n.conn.SetReadDeadline(time.Now().Add(kadelay)); err != nil {
 		log.Printf("failed to set read deadline: %s", err)
-		lost <- n.id
+		n.lose(lost)
 		return
 	}
+	r := bufio.NewReader(n.conn)
+	buf := framePool.Get().(*[]byte)
+	defer framePool.Put(buf)
+	emit := func(e Event) bool {
+		select {
+		case events <- e:
+			return true
+		case <-n.done:
+			return false
+		}
+	}
 	for {
-		b := make([]byte, PacketSize)
-		if _, err := n.conn.Read(b); err != nil {
-			lost <- n.id
+		b, err := n.codec.ReadFrame(r, *buf)
+		if errors.Cause(err) == ErrBadSignature {
+			n.mu.Lock()
+			n.decodeError(err)
+			n.mu.Unlock()
+			log.Printf("lost sync with node %v: %s", n.id, err)
+			if !emit(Error{ID: n.id, Err: err}) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			n.lose(lost)
 			return
 		}
+		at := time.Now()
 		pkt := Packet{}
-		if err := Decode(b, &pkt); err != nil {
-			log.Printf("failed to decode packet, id: %v", n.id)
+		var touche *Touche
+		err = n.codec.Decode(b, &pkt)
+		n.mu.Lock()
+		n.info.BytesIn += uint64(len(b))
+		if err != nil {
+			n.decodeError(err)
+		} else {
+			n.info.PacketsIn++
+			switch pkt.T {
+			case KeepAliveT:
+				if !n.lat.answered(pkt, at) {
+					n.info.LastKeepAlive = at
+				}
+			case ToucheT:
+				touche = n.lat.touche(pkt, at)
+			}
+		}
+		n.mu.Unlock()
+		if err != nil {
+			log.Printf("failed to decode packet, id: %v: %s", n.id, err)
+			if !emit(Error{ID: n.id, Err: err}) {
+				return
+			}
 			continue
 		}
+		if n.wire != nil {
+			n.wire.PacketRead(pkt)
+		}
 		if pkt.T == KeepAliveT {
-			if err := n.conn.SetReadDeadline(time.Now().Add(time.Duration(kadelay) * time.Second)); err != nil {
+			if err := n.conn.SetReadDeadline(time.Now().Add(kadelay)); err != nil {
 				log.Printf("failed to set read deadline: %s", err)
-				lost <- n.id
+				n.lose(lost)
+				return
+			}
+			if !emit(KeepAlive{ID: n.id, Time: at}) {
+				return
+			}
+			continue
+		}
+		if pkt.T != ToucheT {
+			err := errors.Wrapf(ErrUnknownType, "unexpected type %v from node", pkt.T)
+			if !emit(Error{ID: n.id, Err: err}) {
 				return
 			}
 			continue
 		}
-		packets <- pkt
+		if !emit(Touch{ID: n.id, Packet: pkt, Timing: touche, Time: at}) {
+			return
+		}
+	}
+}
+
+// written reports the frame written to the node to the
+// WireListener.
+func (n *node) written(b []byte) {
+	pkt := Packet{}
+	if err := n.codec.Decode(b, &pkt); err != nil {
+		return
+	}
+	n.wire.PacketWritten(pkt)
+}
+
+// decodeError counts the decode error. It must be called with
+// mu held.
+func (n *node) decodeError(err error) {
+	n.info.DecodeErrors++
+	switch errors.Cause(err) {
+	case ErrBadSignature:
+		n.info.BadSignatures++
+	case ErrUnknownType:
+		n.info.UnknownTypes++
+	case ErrShortPacket:
+		n.info.ShortPackets++
+	case ErrReservedConfig:
+		n.info.ReservedConfigs++
+	}
+}
+
+// lose reports the node as lost unless it was already closed.
+func (n *node) lose(lost chan<- *node) {
+	select {
+	case lost <- n:
+	case <-n.done:
 	}
 }
 
 // Send sends the encoded packet to the requests channel.
 // Listen will pickup that requests and write to the conn.
-// This is so that we don't expose the channel.
+// This is so that we don't expose the channel. Send is a
+// NOP once the node is closed.
 func (n *node) Send(b []byte) {
-	n.requests <- b
+	select {
+	case n.requests <- request{b: b}:
+	case <-n.done:
+	}
+}
+
+// SendContext queues the encoded packet and waits for it to
+// be written, returning the result of the write. The deadline
+// of ctx is used as write deadline if it comes before the
+// write timeout.
+func (n *node) SendContext(ctx context.Context, b []byte) error {
+	r := request{b: b, result: make(chan error, 1)}
+	if d, ok := ctx.Deadline(); ok {
+		r.deadline = d
+	}
+	select {
+	case n.requests <- r:
+	case <-n.done:
+		return ErrNodeClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-r.result:
+		return err
+	case <-n.done:
+		return ErrNodeClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// TrySend queues the encoded packet without blocking. If the
+// queue is full the overflow policy of the node decides which
+// packet is dropped.
+func (n *node) TrySend(b []byte) error {
+	r := request{b: b}
+	for {
+		select {
+		case <-n.done:
+			return ErrNodeClosed
+		default:
+		}
+		select {
+		case n.requests <- r:
+			return nil
+		default:
+		}
+		if n.overflow != DropOldest {
+			return ErrQueueFull
+		}
+		select {
+		case old := <-n.requests:
+			if old.result != nil {
+				old.result <- ErrDropped
+			}
+		default:
+			if cap(n.requests) == 0 {
+				return ErrQueueFull
+			}
+		}
+	}
+}
+
+// Close closes the connection, the goroutines started by
+// Listen exit shortly after. Close can be called more than
+// once.
 func (n *node) Close() error {
-	close(n.requests)
-	return n.conn.Close()
+	var err error
+	n.once.Do(func() {
+		// encode starts animations while holding mu, so that
+		// none is started once Wait may be called
+		n.mu.Lock()
+		close(n.done)
+		n.mu.Unlock()
+		err = n.conn.Close()
+	})
+	return err
+}
+
+// Wait waits for the goroutines started by Listen and the
+// emulated animations to exit.
+func (n *node) Wait() {
+	n.wg.Wait()
 }
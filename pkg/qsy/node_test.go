@@ -1,6 +1,7 @@
 package qsy
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -12,7 +13,8 @@ const (
 )
 
 type mockNode struct {
-	read func(b []byte) (int, error)
+	read  func(b []byte) (int, error)
+	write func(b []byte) (int, error)
 }
 
 // m.read is used to mock whatever operation we want
@@ -26,70 +28,114 @@ func (m mockNode) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
+func (m mockNode) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
 func (m mockNode) Close() error {
 	return nil
 }
 
 func (m mockNode) Write(b []byte) (int, error) {
-	return 0, nil
+	if m.write != nil {
+		return m.write(b)
+	}
+	return len(b), nil
 }
 
 func TestReadPacket(t *testing.T) {
 	t.Parallel()
 
 	var (
-		i       = 0
+		frames  = [][]byte{touchePacket(), helloPacket()}
 		pkt     = Packet{}
-		packets = make(chan Packet, 50)
-		lost    = make(chan uint16, 50)
-		kadelay = int64(5)
-		node    = &node{
-			conn: mockNode{
-				read: func(b []byte) (int, error) {
-					// return a packet only once
-					if i != 0 {
-						return 0, errors.New("ups")
-					}
-					i++
-					copy(b, helloPacket())
-					return len(b), nil
-				},
+		packets = make(chan Event, 50)
+		lost    = make(chan *node, 50)
+		kadelay = 5 * time.Second
+		node    = newNode(mockNode{
+			read: func(b []byte) (int, error) {
+				if len(frames) == 0 {
+					return 0, errors.New("ups")
+				}
+				c := copy(b, frames[0])
+				frames = frames[1:]
+				return c, nil
 			},
-			id:       uint16(18),
-			addr:     nodeAddr,
-			requests: make(chan []byte),
-		}
+		}, uint16(18), nodeAddr, DefaultConfig())
 	)
-	Decode(helloPacket(), &pkt)
+	Decode(touchePacket(), &pkt)
 	node.read(packets, lost, kadelay)
-	p := <-packets
+	p := (<-packets).(Touch).Packet
 	if p != pkt {
 		t.Fatalf("packet is not valid.\n\tExpected: %s\n\tGot: %s\n", pkt, p)
 	}
+	// only touches are touch events
+	if e, ok := (<-packets).(Error); !ok || errors.Cause(e.Err) != ErrUnknownType {
+		t.Fatalf("expected hello to be an unknown type error but got %#v", e)
+	}
 	node.Close()
 	close(packets)
 	close(lost)
 }
 
-func TestReadLostNode(t *testing.T) {
+func TestReadCorrupt(t *testing.T) {
 	t.Parallel()
+
+	unknown := touchePacket()
+	unknown[TypeHeader] = 9
 	var (
-		lost    = make(chan uint16, 50)
-		packets = make(chan Packet, 50)
-		kadelay = int64(5)
-		node    = &node{
-			conn: mockNode{
-				read: func(b []byte) (int, error) {
-					return 0, errors.New("uh-oh")
-				},
+		chunks = [][]byte{
+			// garbage followed by half a packet
+			append([]byte("garbage"), touchePacket()[:5]...),
+			touchePacket()[5:],
+			unknown,
+			touchePacket(),
+		}
+		packets = make(chan Event, 50)
+		lost    = make(chan *node, 50)
+		node    = newNode(mockNode{
+			read: func(b []byte) (int, error) {
+				if len(chunks) == 0 {
+					return 0, errors.New("ups")
+				}
+				c := copy(b, chunks[0])
+				chunks = chunks[1:]
+				return c, nil
 			},
-			id:       uint16(18),
-			addr:     nodeAddr,
-			requests: make(chan []byte),
+		}, uint16(18), nodeAddr, DefaultConfig())
+	)
+	node.read(packets, lost, 5*time.Second)
+	close(packets)
+	want := []EventType{ErrorEvent, TouchEvent, ErrorEvent, TouchEvent}
+	for i, w := range want {
+		if e := <-packets; e == nil || e.Type() != w {
+			t.Fatalf("expected event %v to be %s but got %#v", i, w, e)
 		}
+	}
+	if e, ok := <-packets; ok {
+		t.Fatalf("unexpected event %#v", e)
+	}
+	info := node.Info()
+	if info.DecodeErrors != 2 || info.BadSignatures != 1 || info.UnknownTypes != 1 {
+		t.Fatalf("unexpected decode errors: %+v", info)
+	}
+	node.Close()
+}
+
+func TestReadLostNode(t *testing.T) {
+	t.Parallel()
+	var (
+		lost    = make(chan *node, 50)
+		packets = make(chan Event, 50)
+		kadelay = 5 * time.Second
+		node    = newNode(mockNode{
+			read: func(b []byte) (int, error) {
+				return 0, errors.New("uh-oh")
+			},
+		}, uint16(18), nodeAddr, DefaultConfig())
 	)
 	node.read(packets, lost, kadelay)
-	lid := <-lost
+	lid := (<-lost).id
 	if lid != uint16(18) {
 		t.Fatalf("lost node id is not valid. Expected: %v - Got: %v\n", uint16(1), lid)
 	}
@@ -97,3 +143,125 @@ func TestReadLostNode(t *testing.T) {
 	close(lost)
 	close(packets)
 }
+
+func TestSendContext(t *testing.T) {
+	t.Parallel()
+
+	var (
+		lost = make(chan *node, 1)
+		fail = errors.New("broken pipe")
+		node = newNode(mockNode{
+			read: func(b []byte) (int, error) {
+				select {}
+			},
+			write: func(b []byte) (int, error) {
+				if b[0] == 'X' {
+					return 0, fail
+				}
+				return len(b), nil
+			},
+		}, uint16(18), nodeAddr, DefaultConfig())
+	)
+	go node.write(lost)
+	defer node.Close()
+	if err := node.SendContext(context.Background(), []byte("QSY")); err != nil {
+		t.Fatalf("expected write to succeed but got %s", err)
+	}
+	if err := node.SendContext(context.Background(), []byte("XXX")); err != fail {
+		t.Fatalf("expected write error but got %v", err)
+	}
+	if id := (<-lost).id; id != 18 {
+		t.Fatalf("expected node 18 to be lost but got %v", id)
+	}
+	// the writer exited, sending must not block forever
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := node.SendContext(ctx, []byte("QSY")); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded but got %v", err)
+	}
+	node.Close()
+	if err := node.SendContext(context.Background(), []byte("QSY")); err != ErrNodeClosed {
+		t.Fatalf("expected node closed but got %v", err)
+	}
+}
+
+func TestTrySend(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		overflow OverflowPolicy
+		err      error
+		dropped  error
+	}{
+		{name: "drop newest", overflow: DropNewest, err: ErrQueueFull, dropped: ErrNodeClosed},
+		{name: "drop oldest", overflow: DropOldest, err: nil, dropped: ErrDropped},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(tt *testing.T) {
+			cfg := DefaultConfig()
+			cfg.QueueSize = 1
+			cfg.Overflow = c.overflow
+			// nobody writes so the queue never drains
+			node := newNode(mockNode{}, uint16(18), nodeAddr, cfg)
+			queued := make(chan error)
+			go func() {
+				queued <- node.SendContext(context.Background(), []byte("QSY"))
+			}()
+			for len(node.requests) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			if err := node.TrySend([]byte("QSY")); err != c.err {
+				tt.Fatalf("expected %v but got %v", c.err, err)
+			}
+			node.Close()
+			if err := <-queued; err != c.dropped {
+				tt.Fatalf("expected queued packet to end with %v but got %v", c.dropped, err)
+			}
+			if err := node.TrySend([]byte("QSY")); err != ErrNodeClosed {
+				tt.Fatalf("expected node closed but got %v", err)
+			}
+		})
+	}
+}
+
+func TestNodeInfo(t *testing.T) {
+	t.Parallel()
+
+	var (
+		i       = 0
+		packets = make(chan Event, 2)
+		lost    = make(chan *node, 2)
+		reads   = [][]byte{keepAlivePacket(), touchePacket()}
+		node    = newNode(mockNode{
+			read: func(b []byte) (int, error) {
+				if i == len(reads) {
+					return 0, errors.New("eof")
+				}
+				c := copy(b, reads[i])
+				i++
+				return c, nil
+			},
+		}, uint16(18), nodeAddr, DefaultConfig())
+	)
+	node.Listen(packets, lost, 5*time.Second)
+	if err := node.SendContext(context.Background(), touchePacket()); err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	<-lost
+	node.Close()
+	node.Wait()
+	info := node.Info()
+	if info.ID != 18 || info.Addr != nodeAddr {
+		t.Fatalf("wrong node identity: %+v", info)
+	}
+	if info.PacketsIn != 2 || info.BytesIn != 2*PacketSize {
+		t.Fatalf("expected 2 packets in but got %+v", info)
+	}
+	if info.PacketsOut != 1 || info.BytesOut != PacketSize {
+		t.Fatalf("expected 1 packet out but got %+v", info)
+	}
+	if info.LastKeepAlive.IsZero() || info.ConnectedAt.IsZero() {
+		t.Fatalf("expected keep alive and connection times to be set: %+v", info)
+	}
+}
@@ -1,9 +1,10 @@
 package qsy
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
+
+	"github.com/pkg/errors"
 )
 
 const (
@@ -36,45 +37,25 @@ const (
 	NoColor = Color(0)
 )
 
-// Color is a RGB color encoded with 16 bits.
-type Color uint16
-
-// String implements the Stringer interface.
-func (c Color) String() string {
-	switch c {
-	case Red:
-		return "Red"
-	case Green:
-		return "Green"
-	case Blue:
-		return "Blue"
-	case Cyan:
-		return "Cyan"
-	case Magenta:
-		return "Magenta"
-	case Yellow:
-		return "Yellow"
-	case White:
-		return "White"
-	case NoColor:
-		return "NoColor"
-	default:
-		return "Unknown"
-	}
-}
+// configMask has the config bits that are not reserved: the
+// node settings, VersionConfig, FrameConfig, AssignIDConfig and
+// ProbeConfig.
+const configMask = settingsMask | VersionConfig | FrameConfig | AssignIDConfig | ProbeConfig
 
-// newConfig returns a config with the specified
-// configurations set.
-func newConfig(sound, distance bool) uint16 {
-	c := uint16(0)
-	if sound {
-		c = c | 1<<1
-	}
-	if distance {
-		c = c | 1<<0
-	}
-	return c
-}
+var (
+	// ErrBadSignature is the error returned when a packet does
+	// not start with the 'QSY' signature.
+	ErrBadSignature = errors.New("bad packet signature")
+	// ErrUnknownType is the error returned when the type of a
+	// packet is not known.
+	ErrUnknownType = errors.New("unknown packet type")
+	// ErrShortPacket is the error returned when there are not
+	// enough bytes for a packet.
+	ErrShortPacket = errors.New("short packet")
+	// ErrReservedConfig is the error returned when a packet
+	// has reserved config bits set.
+	ErrReservedConfig = errors.New("reserved config bits are set")
+)
 
 // Packet represents an incoming or outgoing QSY Packet.
 type Packet struct {
@@ -85,6 +66,9 @@ type Packet struct {
 	Delay     uint32
 	Step      uint16
 	Config    uint16
+	// Animation does not fit the packet, it travels as a
+	// ProtocolV2 field.
+	Animation Animation
 }
 
 // NewPacket returns a new packet given the specified parameters.
@@ -96,25 +80,82 @@ func NewPacket(t uint8, id uint16, color Color, delay uint32, step uint16, sound
 		Color:     color,
 		Delay:     delay,
 		Step:      step,
-		Config:    newConfig(sound, distance),
+		Config:    Settings{Sound: sound, Distance: distance}.Config(),
 	}
 }
 
 // Encode returns the encoded bytes of the given packet.
 func (pkt Packet) Encode() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, pkt); err != nil {
+	return pkt.MarshalBinary()
+}
+
+// MarshalBinary implements the encoding.BinaryMarshaler
+// interface.
+func (pkt Packet) MarshalBinary() ([]byte, error) {
+	b := make([]byte, PacketSize)
+	if _, err := pkt.MarshalTo(b); err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return b, nil
+}
+
+// MarshalTo encodes the packet into b without allocating. It
+// returns the amount of bytes written or ErrShortPacket if b is
+// shorter than PacketSize.
+func (pkt Packet) MarshalTo(b []byte) (int, error) {
+	if len(b) < PacketSize {
+		return 0, ErrShortPacket
+	}
+	copy(b[QHeader:], pkt.Signature[:])
+	b[TypeHeader] = pkt.T
+	binary.BigEndian.PutUint16(b[IDHeader:], pkt.ID)
+	binary.BigEndian.PutUint16(b[ColorRGHeader:], uint16(pkt.Color))
+	binary.BigEndian.PutUint32(b[DelayHeader:], pkt.Delay)
+	binary.BigEndian.PutUint16(b[StepHeader:], pkt.Step)
+	binary.BigEndian.PutUint16(b[ConfigHeader:], pkt.Config)
+	return PacketSize, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler
+// interface. It decodes the first PacketSize bytes of b without
+// allocating and validates the packet, see Decode.
+func (pkt *Packet) UnmarshalBinary(b []byte) error {
+	if len(b) < PacketSize {
+		return errors.Wrapf(ErrShortPacket, "%v bytes", len(b))
+	}
+	copy(pkt.Signature[:], b[QHeader:TypeHeader])
+	pkt.T = b[TypeHeader]
+	pkt.ID = binary.BigEndian.Uint16(b[IDHeader:])
+	pkt.Color = Color(binary.BigEndian.Uint16(b[ColorRGHeader:]))
+	pkt.Delay = binary.BigEndian.Uint32(b[DelayHeader:])
+	pkt.Step = binary.BigEndian.Uint16(b[StepHeader:])
+	pkt.Config = binary.BigEndian.Uint16(b[ConfigHeader:])
+	pkt.Animation = Animation{}
+	return pkt.Validate()
 }
 
 func (pkt Packet) String() string {
 	return fmt.Sprintf("Type: %v - ID: %v - Color: %s", pkt.T, pkt.ID, pkt.Color)
 }
 
-// Decode decodes the bytes into the packet struct.
+// Validate returns ErrBadSignature, ErrUnknownType or
+// ErrReservedConfig if the packet is not valid.
+func (pkt Packet) Validate() error {
+	if pkt.Signature != [3]byte{'Q', 'S', 'Y'} {
+		return errors.Wrapf(ErrBadSignature, "%q", string(pkt.Signature[:]))
+	}
+	if pkt.T > KeepAliveT {
+		return errors.Wrapf(ErrUnknownType, "type %v", pkt.T)
+	}
+	if reserved := pkt.Config &^ configMask; reserved != 0 {
+		return errors.Wrapf(ErrReservedConfig, "%#04x", reserved)
+	}
+	return nil
+}
+
+// Decode decodes the bytes into the packet struct. It returns
+// ErrShortPacket if b is shorter than PacketSize and validates
+// the decoded packet.
 func Decode(b []byte, pkt *Packet) error {
-	buf := bytes.NewBuffer(b)
-	return binary.Read(buf, binary.BigEndian, pkt)
+	return pkt.UnmarshalBinary(b)
 }
@@ -1,6 +1,11 @@
 package qsy
 
-import "testing"
+import (
+	"bufio"
+	"testing"
+
+	"github.com/pkg/errors"
+)
 
 func TestEncode(t *testing.T) {
 	var (
@@ -32,6 +37,141 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecodeErrors(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name   string
+		modify func(b []byte) []byte
+		err    error
+	}{
+		{name: "valid", modify: func(b []byte) []byte { return b }},
+		{name: "bad signature", modify: func(b []byte) []byte {
+			b[YHeader] = 'Z'
+			return b
+		}, err: ErrBadSignature},
+		{name: "unknown type", modify: func(b []byte) []byte {
+			b[TypeHeader] = KeepAliveT + 1
+			return b
+		}, err: ErrUnknownType},
+		{name: "reserved config", modify: func(b []byte) []byte {
+			b[ConfigHeader] = 1 << 3
+			return b
+		}, err: ErrReservedConfig},
+		{name: "short", modify: func(b []byte) []byte { return b[:PacketSize-1] }, err: ErrShortPacket},
+	}
+	for _, c := range cases {
+		pkt := Packet{}
+		if err := Decode(c.modify(touchePacket()), &pkt); errors.Cause(err) != c.err {
+			t.Fatalf("%s: expected %v but got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestMarshalTo(t *testing.T) {
+	t.Parallel()
+
+	pkt := NewPacket(ToucheT, uint16(18), Red, uint32(0), uint16(0), false, true)
+	b := make([]byte, PacketSize)
+	if c, err := pkt.MarshalTo(b); err != nil || c != PacketSize {
+		t.Fatalf("failed to marshal packet: %v bytes, %v", c, err)
+	}
+	if string(b) != string(touchePacket()) {
+		t.Fatalf("expected %v but got %v", touchePacket(), b)
+	}
+	if _, err := pkt.MarshalTo(b[:PacketSize-1]); err != ErrShortPacket {
+		t.Fatalf("expected ErrShortPacket but got %v", err)
+	}
+	got := Packet{}
+	if err := got.UnmarshalBinary(b); err != nil || got != pkt {
+		t.Fatalf("expected %+v but got %+v, %v", pkt, got, err)
+	}
+}
+
+func TestCodecAllocs(t *testing.T) {
+	var (
+		pkt = NewPacket(ToucheT, uint16(18), Red, uint32(0), uint16(0), false, true)
+		b   = make([]byte, PacketSize)
+		r   = bufio.NewReader(&loopReader{b: touchePacket()})
+		buf = make([]byte, PacketSize)
+	)
+	allocs := testing.AllocsPerRun(100, func() {
+		pkt.MarshalTo(b)
+		pkt.UnmarshalBinary(b)
+		frame, _ := V1Codec{}.ReadFrame(r, buf)
+		Decode(frame, &pkt)
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations but got %v", allocs)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	pkt := NewPacket(CommandT, uint16(18), Red, uint32(500), uint16(3), true, false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkt.Encode()
+	}
+}
+
+func BenchmarkMarshalTo(b *testing.B) {
+	var (
+		pkt = NewPacket(CommandT, uint16(18), Red, uint32(500), uint16(3), true, false)
+		buf = make([]byte, PacketSize)
+	)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkt.MarshalTo(buf)
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	var (
+		pkt = Packet{}
+		buf = touchePacket()
+	)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pkt.UnmarshalBinary(buf)
+	}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	var (
+		pkt = Packet{}
+		r   = bufio.NewReader(&loopReader{b: touchePacket()})
+		buf = framePool.Get().(*[]byte)
+	)
+	defer framePool.Put(buf)
+	b.ReportAllocs()
+	b.SetBytes(PacketSize)
+	for i := 0; i < b.N; i++ {
+		frame, err := V1Codec{}.ReadFrame(r, *buf)
+		if err != nil {
+			b.Fatalf("failed to read frame: %s", err)
+		}
+		if err := Decode(frame, &pkt); err != nil {
+			b.Fatalf("failed to decode frame: %s", err)
+		}
+	}
+}
+
+// loopReader reads b over and over.
+type loopReader struct {
+	b []byte
+	i int
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	c := 0
+	for c < len(p) {
+		n := copy(p[c:], l.b[l.i:])
+		l.i = (l.i + n) % len(l.b)
+		c += n
+	}
+	return c, nil
+}
+
 func helloPacket() []byte {
 	p := make([]byte, PacketSize)
 	p[QHeader] = 'Q'
@@ -75,3 +215,14 @@ func touchePacket() []byte {
 	p[ConfigHeader+0x01] = uint8(1)
 	return p
 }
+
+func keepAlivePacket() []byte {
+	p := make([]byte, PacketSize)
+	p[QHeader] = 'Q'
+	p[SHeader] = 'S'
+	p[YHeader] = 'Y'
+	p[TypeHeader] = KeepAliveT
+	p[IDHeader] = uint8(0)
+	p[IDHeader+0x01] = uint8(18)
+	return p
+}
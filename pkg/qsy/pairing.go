@@ -0,0 +1,287 @@
+package qsy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoPairingStore is the error returned when pairing without
+// a pairing store configured.
+var ErrNoPairingStore = errors.New("no pairing store configured")
+
+// DiscoveryState decides which nodes saying hello are
+// accepted. Nodes that are connected or within their reconnect
+// grace window are always accepted.
+type DiscoveryState uint8
+
+const (
+	// Idle refuses every new node.
+	Idle DiscoveryState = iota
+	// Searching accepts the nodes in the allow-list, or any
+	// node if there is no pairing store.
+	Searching
+	// Pairing accepts any node and adds it to the allow-list.
+	Pairing
+)
+
+// String implements the Stringer interface.
+func (s DiscoveryState) String() string {
+	switch s {
+	case Idle:
+		return "Idle"
+	case Searching:
+		return "Searching"
+	case Pairing:
+		return "Pairing"
+	default:
+		return "Unknown"
+	}
+}
+
+// PairedNode is a node in the allow-list. A node is allowed if
+// it says hello with the same ID from the same host, an empty
+// Addr allows the ID from any host.
+type PairedNode struct {
+	ID   uint16 `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// PairingStore persists the allow-list of paired nodes.
+type PairingStore interface {
+	Load() ([]PairedNode, error)
+	Save([]PairedNode) error
+}
+
+// FileStore is a PairingStore that keeps the allow-list in a
+// JSON file.
+type FileStore struct {
+	Path string
+}
+
+// NewFileStore returns a FileStore that uses the file at path.
+// The file is created on the first save.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+// Load reads the allow-list from the file. A missing file is an
+// empty allow-list.
+func (s *FileStore) Load() ([]PairedNode, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pairings")
+	}
+	paired := []PairedNode{}
+	if err := json.Unmarshal(b, &paired); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode pairings from %s", s.Path)
+	}
+	return paired, nil
+}
+
+// Save replaces the allow-list in the file. The file is written
+// next to the old one and renamed so a failed save does not
+// lose the previous allow-list.
+func (s *FileStore) Save(paired []PairedNode) error {
+	b, err := json.MarshalIndent(paired, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode pairings")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path))
+	if err != nil {
+		return errors.Wrap(err, "failed to create pairings file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "failed to write pairings")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "failed to write pairings")
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return errors.Wrap(err, "failed to replace pairings")
+	}
+	return nil
+}
+
+// MemoryStore is a PairingStore that keeps the allow-list in
+// memory.
+type MemoryStore struct {
+	mu     sync.Mutex
+	paired []PairedNode
+}
+
+// NewMemoryStore returns a MemoryStore with the given nodes.
+func NewMemoryStore(paired ...PairedNode) *MemoryStore {
+	return &MemoryStore{paired: paired}
+}
+
+// Load returns a copy of the allow-list.
+func (s *MemoryStore) Load() ([]PairedNode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PairedNode(nil), s.paired...), nil
+}
+
+// Save replaces the allow-list.
+func (s *MemoryStore) Save(paired []PairedNode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paired = append([]PairedNode(nil), paired...)
+	return nil
+}
+
+// PairingListener is a Listener that wants to know when a node
+// is added to the allow-list. Listeners that don't implement it
+// are not notified of pairings.
+type PairingListener interface {
+	Listener
+	NodePaired(PairedNode)
+}
+
+// State returns the current discovery state.
+func (srv *Server) State() DiscoveryState {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.state
+}
+
+// Pair accepts and pairs any node that says hello during d.
+// Once d elapses the server goes back to the state it was in
+// before pairing, unless the state was changed meanwhile.
+// Pair returns ErrNoPairingStore if there is no pairing store.
+func (srv *Server) Pair(d time.Duration) error {
+	if srv.cfg.Pairings == nil {
+		return ErrNoPairingStore
+	}
+	if err := srv.ctx.Err(); err != nil || srv.closed() {
+		return ErrServerClosed
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.state != Pairing {
+		srv.prev = srv.state
+	}
+	srv.setState(Pairing)
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if srv.pairing == t {
+			srv.setState(srv.prev)
+		}
+	})
+	srv.pairing = t
+	return nil
+}
+
+// Paired returns the allow-list sorted by ID.
+func (srv *Server) Paired() []PairedNode {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.pairedNodes()
+}
+
+// Unpair removes the node from the allow-list. The node is not
+// disconnected but it is refused the next time it says hello
+// as a new node. It returns ErrNotExist if the node is not
+// paired.
+func (srv *Server) Unpair(id uint16) error {
+	if srv.cfg.Pairings == nil {
+		return ErrNoPairingStore
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if _, ok := srv.paired[id]; !ok {
+		return errors.Wrapf(ErrNotExist, "id %v", id)
+	}
+	delete(srv.paired, id)
+	return srv.savePairings()
+}
+
+// setState changes the discovery state and stops the pairing
+// timer. The IDs assigned in the previous state are freed, the
+// nodes that did not say hello with them yet are admitted or
+// not depending on the new state. It must be called with mu
+// held.
+func (srv *Server) setState(s DiscoveryState) {
+	if srv.pairing != nil {
+		srv.pairing.Stop()
+		srv.pairing = nil
+	}
+	if s != srv.state {
+		for id := range srv.assigned {
+			delete(srv.assigned, id)
+		}
+	}
+	srv.state = s
+}
+
+// allowed returns true if the node is in the allow-list or
+// there is no pairing store.
+func (srv *Server) allowed(h Hello) bool {
+	if srv.cfg.Pairings == nil {
+		return true
+	}
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	p, ok := srv.paired[h.ID]
+	return ok && (p.Addr == "" || p.Addr == host(h.Addr))
+}
+
+// admit returns true if a new node can connect in the current
+// discovery state.
+func (srv *Server) admit(h Hello) bool {
+	switch srv.State() {
+	case Searching:
+		return srv.allowed(h)
+	case Pairing:
+		return true
+	default:
+		return false
+	}
+}
+
+// pair adds the node to the allow-list, replacing any node
+// paired with the same ID.
+func (srv *Server) pair(h Hello) {
+	p := PairedNode{ID: h.ID, Addr: host(h.Addr)}
+	srv.mu.Lock()
+	srv.paired[h.ID] = p
+	err := srv.savePairings()
+	srv.mu.Unlock()
+	if err != nil {
+		log.Printf("failed to save pairing of node %v: %s", h.ID, err)
+	}
+	srv.events <- paired{p}
+}
+
+// savePairings saves the allow-list. It must be called with mu
+// held.
+func (srv *Server) savePairings() error {
+	return srv.cfg.Pairings.Save(srv.pairedNodes())
+}
+
+// pairedNodes returns the allow-list sorted by ID. It must be
+// called with mu held.
+func (srv *Server) pairedNodes() []PairedNode {
+	paired := make([]PairedNode, 0, len(srv.paired))
+	for _, p := range srv.paired {
+		paired = append(paired, p)
+	}
+	sort.Slice(paired, func(i, j int) bool {
+		return paired[i].ID < paired[j].ID
+	})
+	return paired
+}
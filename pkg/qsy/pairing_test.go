@@ -0,0 +1,135 @@
+package qsy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "qsy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewFileStore(filepath.Join(dir, "pairings.json"))
+	paired, err := s.Load()
+	if err != nil || len(paired) != 0 {
+		t.Fatalf("expected empty allow-list but got %v, %v", paired, err)
+	}
+	expected := []PairedNode{{ID: 1, Addr: "10.0.0.1"}, {ID: 2}}
+	if err := s.Save(expected); err != nil {
+		t.Fatalf("failed to save: %s", err)
+	}
+	paired, err = s.Load()
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	if !reflect.DeepEqual(paired, expected) {
+		t.Fatalf("expected %v but got %v", expected, paired)
+	}
+	if err := ioutil.WriteFile(s.Path, []byte("{"), 0644); err != nil {
+		t.Fatalf("failed to corrupt file: %s", err)
+	}
+	if _, err := s.Load(); err == nil {
+		t.Fatalf("expected error loading corrupt file")
+	}
+}
+
+func TestPairing(t *testing.T) {
+	t.Parallel()
+
+	var (
+		e     = newEvents()
+		conns = make(chan net.Conn, 1)
+		hs    = newHellos()
+		store = NewMemoryStore(PairedNode{ID: 1, Addr: "10.0.0.1"})
+	)
+	srv, err := NewServer(context.Background(), "", "", e,
+		WithDiscoverer(hs),
+		WithDialer(pipeDialer(conns)),
+		WithPairings(store))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	if s := srv.State(); s != Searching {
+		t.Fatalf("expected server to be searching but is %s", s)
+	}
+	// nodes of another kit are refused
+	hs.c <- Hello{ID: 1, Addr: "10.0.1.1:3000"}
+	hs.c <- Hello{ID: 2, Addr: "10.0.0.2:3000"}
+	hs.c <- Hello{ID: 1, Addr: "10.0.0.1:3000"}
+	<-conns
+	if id := <-e.new; id != 1 {
+		t.Fatalf("expected paired node 1 but got %v", id)
+	}
+
+	if err := srv.Pair(time.Minute); err != nil {
+		t.Fatalf("failed to pair: %s", err)
+	}
+	hs.c <- Hello{ID: 2, Addr: "10.0.0.2:3000"}
+	<-conns
+	if id := <-e.new; id != 2 {
+		t.Fatalf("expected new node 2 but got %v", id)
+	}
+	if p := <-e.paired; p != (PairedNode{ID: 2, Addr: "10.0.0.2"}) {
+		t.Fatalf("unexpected pairing: %+v", p)
+	}
+	expected := []PairedNode{{ID: 1, Addr: "10.0.0.1"}, {ID: 2, Addr: "10.0.0.2"}}
+	if paired, _ := store.Load(); !reflect.DeepEqual(paired, expected) {
+		t.Fatalf("expected stored %v but got %v", expected, paired)
+	}
+
+	// pairing ends after the given time
+	srv.StopSearch()
+	if err := srv.Pair(time.Millisecond); err != nil {
+		t.Fatalf("failed to pair: %s", err)
+	}
+	for srv.State() == Pairing {
+		time.Sleep(time.Millisecond)
+	}
+	if s := srv.State(); s != Idle {
+		t.Fatalf("expected server to go back to idle but is %s", s)
+	}
+
+	if err := srv.Unpair(2); err != nil {
+		t.Fatalf("failed to unpair: %s", err)
+	}
+	if err := srv.Unpair(2); err == nil {
+		t.Fatalf("expected error unpairing twice")
+	}
+	if paired := srv.Paired(); !reflect.DeepEqual(paired, expected[:1]) {
+		t.Fatalf("expected %v but got %v", expected[:1], paired)
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatalf("failed to close server: %s", err)
+	}
+	if len(e.new) != 0 || len(e.paired) != 0 {
+		t.Fatalf("expected unpaired nodes to be refused")
+	}
+}
+
+func TestPairWithoutStore(t *testing.T) {
+	t.Parallel()
+
+	srv, err := NewServer(context.Background(), "", "", nil,
+		WithDiscoverer(NewStaticDiscoverer()),
+		WithDialer(UnixDialer{}))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.Pair(time.Second); err != ErrNoPairingStore {
+		t.Fatalf("expected ErrNoPairingStore but got %v", err)
+	}
+}
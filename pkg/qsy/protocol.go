@@ -0,0 +1,349 @@
+package qsy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ProtocolV1 is the original protocol, every packet is
+	// PacketSize bytes long. Nodes that say hello without a
+	// version speak ProtocolV1.
+	ProtocolV1 = 1
+	// ProtocolV2 extends every v1 packet with TLV fields. A v2
+	// frame is the v1 packet followed by the length of the
+	// fields and the fields themselves, each of them being its
+	// type, the length of the value and the value.
+	ProtocolV2 = 2
+	// LatestProtocol is the latest protocol version.
+	LatestProtocol = ProtocolV2
+
+	// MaxExtensionSize is the maximum size of the TLV fields
+	// of a v2 frame.
+	MaxExtensionSize = 1024
+
+	// VersionConfig is the config bit of the hellos that carry
+	// the protocol version of the node in Step and its
+	// capabilities in Delay. ProtocolV1 firmware leaves it unset,
+	// whatever it has in those fields is ignored.
+	VersionConfig = 1 << 12
+)
+
+// ErrUnknownVersion is the error returned when there is no
+// codec for a protocol version.
+var ErrUnknownVersion = errors.New("unknown protocol version")
+
+// Capability is a set of features advertised by a node in its
+// hello, see VersionConfig.
+type Capability uint32
+
+const (
+	// CapProbe means the node answers latency probes.
+	CapProbe Capability = 1 << iota
+	// CapAssignID means the node takes the IDs assigned by
+	// the server.
+	CapAssignID
+	// CapAnimation means the node plays animations, it only
+	// gets them when it speaks ProtocolV2 or later.
+	CapAnimation
+)
+
+// NewHelloPacket returns the hello of a node that speaks up to
+// version and advertises caps.
+func NewHelloPacket(id uint16, version uint16, caps Capability) Packet {
+	pkt := NewPacket(HelloT, id, NoColor, uint32(caps), version, false, false)
+	pkt.Config |= VersionConfig
+	return pkt
+}
+
+// Has returns true if every capability in o is in c.
+func (c Capability) Has(o Capability) bool {
+	return c&o == o
+}
+
+// String implements the Stringer interface.
+func (c Capability) String() string {
+	names := []string{}
+	if c.Has(CapProbe) {
+		names = append(names, "Probe")
+	}
+	if c.Has(CapAssignID) {
+		names = append(names, "AssignID")
+	}
+	if c.Has(CapAnimation) {
+		names = append(names, "Animation")
+	}
+	if rest := c &^ (CapProbe | CapAssignID | CapAnimation); rest != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(rest)))
+	}
+	return strings.Join(names, "|")
+}
+
+// Codec encodes and decodes the packets of a protocol version.
+type Codec interface {
+	// Version returns the protocol version of the codec.
+	Version() uint16
+	// Encode returns the frame of the packet.
+	Encode(Packet) ([]byte, error)
+	// ReadFrame reads a single frame from r into buf, which is
+	// grown if it is too small, and returns the frame. If r is
+	// not at the start of a frame it skips to the next signature
+	// and returns ErrBadSignature, the frame can be read with
+	// the following call.
+	ReadFrame(r *bufio.Reader, buf []byte) ([]byte, error)
+	// Decode decodes the frame into the packet.
+	Decode(b []byte, pkt *Packet) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint16]Codec{}
+)
+
+func init() {
+	RegisterCodec(V1Codec{})
+	RegisterCodec(V2Codec{})
+}
+
+// RegisterCodec makes the codec available for its protocol
+// version, replacing any codec registered for it.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Version()] = c
+}
+
+// LookupCodec returns the codec registered for the protocol
+// version.
+func LookupCodec(version uint16) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[version]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownVersion, "version %v", version)
+	}
+	return c, nil
+}
+
+// negotiate returns the codec of the latest protocol version
+// spoken by both the node and the server, which speaks up to
+// max.
+func negotiate(node, max uint16) Codec {
+	if node < max {
+		max = node
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	versions := make([]int, 0, len(codecs))
+	for v := range codecs {
+		versions = append(versions, int(v))
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	for _, v := range versions {
+		if v <= int(max) {
+			return codecs[uint16(v)]
+		}
+	}
+	return V1Codec{}
+}
+
+// V1Codec is the codec of ProtocolV1.
+type V1Codec struct{}
+
+// Version implements the Codec interface.
+func (V1Codec) Version() uint16 {
+	return ProtocolV1
+}
+
+// Encode implements the Codec interface.
+func (V1Codec) Encode(pkt Packet) ([]byte, error) {
+	return pkt.MarshalBinary()
+}
+
+// ReadFrame implements the Codec interface.
+func (V1Codec) ReadFrame(r *bufio.Reader, buf []byte) ([]byte, error) {
+	if err := resync(r); err != nil {
+		return nil, err
+	}
+	b := grow(buf, PacketSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Decode implements the Codec interface.
+func (V1Codec) Decode(b []byte, pkt *Packet) error {
+	return Decode(b, pkt)
+}
+
+// extension is a TLV field of ProtocolV2. It carries packet
+// data that does not fit the v1 packet.
+type extension struct {
+	// encode returns the value of the field, ok is false if
+	// pkt does not need the field.
+	encode func(pkt Packet) (value []byte, ok bool)
+	decode func(pkt *Packet, value []byte) error
+}
+
+// extensions holds the TLV fields known by V2Codec indexed by
+// type. Unknown fields are skipped when decoding.
+var extensions = map[uint8]extension{}
+
+// V2Codec is the codec of ProtocolV2.
+type V2Codec struct{}
+
+// Version implements the Codec interface.
+func (V2Codec) Version() uint16 {
+	return ProtocolV2
+}
+
+// Encode implements the Codec interface.
+func (V2Codec) Encode(pkt Packet) ([]byte, error) {
+	b, err := pkt.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	types := make([]int, 0, len(extensions))
+	for t := range extensions {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	ext := []byte{}
+	for _, t := range types {
+		value, ok := extensions[uint8(t)].encode(pkt)
+		if !ok {
+			continue
+		}
+		if len(value) > 0xff {
+			return nil, errors.Errorf("field %v is too long", t)
+		}
+		ext = append(ext, uint8(t), uint8(len(value)))
+		ext = append(ext, value...)
+	}
+	if len(ext) > MaxExtensionSize {
+		return nil, errors.New("fields are too long")
+	}
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[PacketSize:], uint16(len(ext)))
+	return append(b, ext...), nil
+}
+
+// ReadFrame implements the Codec interface.
+func (V2Codec) ReadFrame(r *bufio.Reader, buf []byte) ([]byte, error) {
+	if err := resync(r); err != nil {
+		return nil, err
+	}
+	b := grow(buf, PacketSize+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(b[PacketSize:]))
+	if size > MaxExtensionSize {
+		return nil, errors.Errorf("fields are too long: %v bytes", size)
+	}
+	b = grow(b, PacketSize+2+size)
+	if _, err := io.ReadFull(r, b[PacketSize+2:]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// grow returns b resized to n bytes, keeping its contents. It
+// only allocates if the capacity of b is less than n.
+func grow(b []byte, n int) []byte {
+	if cap(b) >= n {
+		return b[:n]
+	}
+	grown := make([]byte, n)
+	copy(grown, b)
+	return grown
+}
+
+// framePool holds the buffers used for reading frames.
+var framePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, PacketSize+2, PacketSize+2+MaxExtensionSize)
+		return &b
+	},
+}
+
+// Decode implements the Codec interface.
+func (V2Codec) Decode(b []byte, pkt *Packet) error {
+	if len(b) < PacketSize+2 {
+		return errors.Wrapf(ErrShortPacket, "%v bytes", len(b))
+	}
+	if err := Decode(b[:PacketSize], pkt); err != nil {
+		return err
+	}
+	ext := b[PacketSize+2:]
+	if size := int(binary.BigEndian.Uint16(b[PacketSize:])); size != len(ext) {
+		return errors.Errorf("expected %v bytes of fields but got %v", size, len(ext))
+	}
+	for len(ext) > 0 {
+		if len(ext) < 2 || len(ext) < 2+int(ext[1]) {
+			return errors.New("truncated field")
+		}
+		t, value := ext[0], ext[2:2+int(ext[1])]
+		ext = ext[2+len(value):]
+		e, ok := extensions[t]
+		if !ok {
+			continue
+		}
+		if err := e.decode(pkt, value); err != nil {
+			return errors.Wrapf(err, "failed to decode field %v", t)
+		}
+	}
+	return nil
+}
+
+// resync skips the bytes before the next 'QSY' signature. It
+// returns ErrBadSignature if any byte was skipped.
+func resync(r *bufio.Reader) error {
+	skipped := 0
+	for {
+		b, err := r.Peek(3)
+		if err != nil {
+			return err
+		}
+		if b[0] == 'Q' && b[1] == 'S' && b[2] == 'Y' {
+			break
+		}
+		if _, err := r.Discard(1); err != nil {
+			return err
+		}
+		skipped++
+	}
+	if skipped > 0 {
+		return errors.Wrapf(ErrBadSignature, "skipped %v bytes", skipped)
+	}
+	return nil
+}
+
+// handshakePacket returns the hello that tells a node that
+// speaks ProtocolV2 or later the version the server will use. It
+// is a v1 hello carrying the version, ok is false for nodes that
+// only speak ProtocolV1 as they don't get one.
+func handshakePacket(h Hello, c Codec) (pkt Packet, ok bool) {
+	if h.Version < ProtocolV2 {
+		return Packet{}, false
+	}
+	return NewHelloPacket(h.ID, c.Version(), 0), true
+}
+
+// writePacket writes the packet encoded with the codec.
+func writePacket(w io.Writer, c Codec, pkt Packet) error {
+	b, err := c.Encode(pkt)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
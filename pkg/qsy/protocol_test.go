@@ -0,0 +1,196 @@
+package qsy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCodecs(t *testing.T) {
+	t.Parallel()
+
+	pkt := NewPacket(CommandT, 18, Red, 500, 3, true, false)
+	for _, v := range []uint16{ProtocolV1, ProtocolV2} {
+		c, err := LookupCodec(v)
+		if err != nil {
+			t.Fatalf("failed to lookup codec %v: %s", v, err)
+		}
+		b, err := c.Encode(pkt)
+		if err != nil {
+			t.Fatalf("failed to encode with v%v: %s", v, err)
+		}
+		// frames are read one at a time
+		frame, err := c.ReadFrame(bufio.NewReader(bytes.NewReader(append(b, b...))), nil)
+		if err != nil {
+			t.Fatalf("failed to read v%v frame: %s", v, err)
+		}
+		if !bytes.Equal(frame, b) {
+			t.Fatalf("expected v%v frame %v but got %v", v, b, frame)
+		}
+		got := Packet{}
+		if err := c.Decode(frame, &got); err != nil {
+			t.Fatalf("failed to decode v%v frame: %s", v, err)
+		}
+		if got != pkt {
+			t.Fatalf("expected %+v but got %+v", pkt, got)
+		}
+	}
+	if _, err := LookupCodec(9); err == nil {
+		t.Fatalf("expected error looking up unknown version")
+	}
+}
+
+func TestV2UnknownFields(t *testing.T) {
+	t.Parallel()
+
+	pkt := NewPacket(ToucheT, 18, Green, 120, 4, false, false)
+	b, _ := pkt.Encode()
+	b = append(b, 0, 9, 0xf0, 2, 'h', 'i', 0xf1, 0, 0xf2, 1, 'x')
+	c := V2Codec{}
+	frame, err := c.ReadFrame(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		t.Fatalf("failed to read frame: %s", err)
+	}
+	got := Packet{}
+	if err := c.Decode(frame, &got); err != nil {
+		t.Fatalf("failed to decode frame: %s", err)
+	}
+	if got != pkt {
+		t.Fatalf("expected %+v but got %+v", pkt, got)
+	}
+	// the last field is cut short
+	frame[PacketSize+1] = 8
+	if err := c.Decode(frame[:len(frame)-1], &got); err == nil {
+		t.Fatalf("expected error decoding truncated field")
+	}
+}
+
+func TestResync(t *testing.T) {
+	t.Parallel()
+
+	pkt := NewPacket(ToucheT, 18, Green, 120, 4, false, false)
+	for _, c := range []Codec{V1Codec{}, V2Codec{}} {
+		b, _ := c.Encode(pkt)
+		stream := append([]byte("QSQ?"), b...)
+		// partial reads are put together
+		r := bufio.NewReader(iotest.OneByteReader(bytes.NewReader(stream)))
+		if _, err := c.ReadFrame(r, nil); errors.Cause(err) != ErrBadSignature {
+			t.Fatalf("v%v: expected ErrBadSignature but got %v", c.Version(), err)
+		}
+		frame, err := c.ReadFrame(r, nil)
+		if err != nil {
+			t.Fatalf("v%v: failed to read frame after resync: %s", c.Version(), err)
+		}
+		got := Packet{}
+		if err := c.Decode(frame, &got); err != nil || got != pkt {
+			t.Fatalf("v%v: expected %+v but got %+v, %v", c.Version(), pkt, got, err)
+		}
+		if _, err := c.ReadFrame(r, nil); err != io.EOF {
+			t.Fatalf("v%v: expected EOF but got %v", c.Version(), err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		node, server, expected uint16
+	}{
+		{node: 0, server: ProtocolV2, expected: ProtocolV1},
+		{node: ProtocolV1, server: ProtocolV2, expected: ProtocolV1},
+		{node: ProtocolV2, server: ProtocolV2, expected: ProtocolV2},
+		{node: ProtocolV2, server: ProtocolV1, expected: ProtocolV1},
+		{node: 9, server: ProtocolV2, expected: ProtocolV2},
+	}
+	for _, c := range cases {
+		if v := negotiate(c.node, c.server).Version(); v != c.expected {
+			t.Fatalf("expected node v%v and server v%v to speak v%v but got v%v", c.node, c.server, c.expected, v)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		server   uint16
+		expected uint16
+	}{
+		{name: "latest", server: LatestProtocol, expected: ProtocolV2},
+		{name: "v1 server", server: ProtocolV1, expected: ProtocolV1},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				e     = newEvents()
+				conns = make(chan net.Conn, 1)
+			)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv, err := NewServer(ctx, "", "", e,
+				WithDiscoverer(NewStaticDiscoverer(Hello{ID: 18, Version: ProtocolV2, Caps: CapAssignID})),
+				WithDialer(pipeDialer(conns)),
+				WithProtocolVersion(c.server))
+			if err != nil {
+				t.Fatalf("failed to create server: %s", err)
+			}
+			if err := srv.ListenAndAccept(); err != nil {
+				t.Fatalf("failed to start server: %s", err)
+			}
+			defer srv.Close()
+			node := <-conns
+			defer node.Close()
+			r := bufio.NewReader(node)
+			b, err := V1Codec{}.ReadFrame(r, nil)
+			if err != nil {
+				t.Fatalf("failed to read handshake: %s", err)
+			}
+			hs := Packet{}
+			if err := Decode(b, &hs); err != nil {
+				t.Fatalf("failed to decode handshake: %s", err)
+			}
+			if hs.T != HelloT || hs.Config&VersionConfig == 0 || hs.Step != c.expected {
+				t.Fatalf("expected handshake for v%v but got %+v", c.expected, hs)
+			}
+			<-e.new
+			info, err := srv.NodeInfo(18)
+			if err != nil {
+				t.Fatalf("failed to get node info: %s", err)
+			}
+			if info.Version != c.expected || info.Caps != CapAssignID {
+				t.Fatalf("unexpected version %v and capabilities %s", info.Version, info.Caps)
+			}
+
+			codec, _ := LookupCodec(c.expected)
+			pkt := NewPacket(CommandT, 18, Blue, 0, 1, false, false)
+			go srv.SendContext(ctx, pkt)
+			if b, err = codec.ReadFrame(r, nil); err != nil {
+				t.Fatalf("failed to read command: %s", err)
+			}
+			got := Packet{}
+			if err := codec.Decode(b, &got); err != nil || got != pkt {
+				t.Fatalf("expected %+v but got %+v, %v", pkt, got, err)
+			}
+		})
+	}
+}
+
+func TestCapabilityString(t *testing.T) {
+	t.Parallel()
+
+	if s := (CapProbe | CapAssignID | 1<<9).String(); s != "Probe|AssignID|0x200" {
+		t.Fatalf("unexpected capabilities %q", s)
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
-	"golang.org/x/net/ipv4"
 	"golang.org/x/sync/syncmap"
 )
 
@@ -16,7 +18,7 @@ const (
 	// QSYPort is the port used to communicate with nodes.
 	QSYPort = 3000
 	// DefaultDelay is the default amount of seconds to
-	// wait for keep alive cleanups.
+	// wait for keep alive cleanups. See Config.KeepAlive.
 	DefaultDelay = 5
 	defaultRoute = "0.0.0.0"
 	tcpv         = "tcp4"
@@ -27,24 +29,41 @@ var (
 	// ErrNotExist is an error when a given node is
 	// not in the pool.
 	ErrNotExist = errors.New("node does not exist")
+	// ErrServerClosed is the error returned when the server
+	// was closed.
+	ErrServerClosed = errors.New("server is closed")
 
 	group = net.IP{224, 0, 0, 12}
 )
 
-type newConn struct {
-	id   uint16
-	addr string
-}
-
 // Listener has a Receive method called when a new packet
 // comes in and a Lost method called when a node gets
-// disconnected.
+// disconnected. The methods are called one at a time in the
+// order of the events, a Listener that blocks holds back the
+// events that follow.
 type Listener interface {
 	Receive(Packet)
 	LostNode(nodeID uint16)
 	NewNode(id uint16)
 }
 
+// ReconnectListener is a Listener that wants to know when a
+// node comes back within the reconnect grace window. Listeners
+// that don't implement it are not notified of reconnections.
+type ReconnectListener interface {
+	Listener
+	NodeReconnected(id uint16)
+}
+
+// pendingNode is a node that lost its connection and has until
+// the timer fires to come back.
+type pendingNode struct {
+	id         uint16
+	addr       string
+	timer      *time.Timer
+	reconnects uint64
+}
+
 // Server handles all-things QSY.
 // It is in charge of:
 // 	* Managing the pool of connected nodes
@@ -57,63 +76,96 @@ type Server struct {
 
 	ctx context.Context
 
-	pconn    *ipv4.PacketConn
-	laddr    *net.TCPAddr
-	route    string
-	listener Listener
+	discoverer Discoverer
+	dialer     Dialer
+	listener   Listener
+	wire       WireListener
 
-	incoming     chan newConn
-	packets      chan Packet
-	lost         chan uint16
-	connected    chan uint16
-	disconnected chan uint16
+	incoming  chan Hello
+	events    chan Event
+	lost      chan *node
+	expired   chan *pendingNode
+	pending   map[uint16]*pendingNode
+	conflicts map[Hello]bool
+	assigned  map[uint16]bool
+	hub       *hub
 
-	delay int64
+	cfg Config
 
-	run bool
+	run       bool
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	wg        sync.WaitGroup
 
-	mu        sync.RWMutex
-	searching bool
+	mu      sync.RWMutex
+	state   DiscoveryState
+	prev    DiscoveryState
+	pairing *time.Timer
+	paired  map[uint16]PairedNode
 }
 
 // NewServer returns a new QSY server.
 // The parameters for configuring the server are:
-//      * ctx: context used for cancellation.
+//	* ctx: context used for cancellation.
 //	* inf: specifies the network interface where
-//	  the addresses live.
-//	* group: the IP for the multicast group used for listening
-// 	  hello packets over udp.
-//	  If no route is provided then the default route will be used.
+//	  the addresses live. It can be empty if a
+//	  discoverer is provided.
 //	* localAddress: the tcp address associated with the network
-//	  interface.
+//	  interface. It can be empty if a dialer is provided.
 //	* listener: the listener that will receive specific events
-func NewServer(ctx context.Context, inf string, localAddress string, listener Listener) (*Server, error) {
-	if inf == "" || localAddress == "" {
-		return nil, errors.New("please provide the network interface, multicast group and local tcp address")
+//	* opts: options applied on top of DefaultConfig.
+func NewServer(ctx context.Context, inf string, localAddress string, listener Listener, opts ...Option) (*Server, error) {
+	cfg := DefaultConfig()
+	cfg.Interface = inf
+	cfg.LocalAddress = localAddress
+	for _, opt := range opts {
+		opt(&cfg)
 	}
-	i, err := net.InterfaceByName(inf)
-	if err != nil {
-		return nil, errors.Wrap(err, "invalid network interface")
+	return NewServerConfig(ctx, cfg, listener)
+}
+
+// NewServerConfig returns a new QSY server configured with cfg.
+// It returns a *ConfigError if cfg is not valid.
+func NewServerConfig(ctx context.Context, cfg Config, listener Listener) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
-	laddr, err := net.ResolveTCPAddr(tcpv, localAddress+":0")
-	if err != nil {
-		return nil, errors.Wrap(err, "invalid local address")
+	srv := &Server{
+		ctx:        ctx,
+		cfg:        cfg,
+		discoverer: cfg.Discoverer,
+		dialer:     cfg.Dialer,
+		listener:   listener,
+		done:       make(chan struct{}),
+		paired:     map[uint16]PairedNode{},
+		hub:        newHub(),
 	}
-	c, err := net.ListenPacket(udpv, net.JoinHostPort(defaultRoute, fmt.Sprintf("%v", QSYPort)))
-	if err != nil {
-		return nil, errors.Wrap(err, "invalid route config")
+	if wl, ok := listener.(WireListener); ok {
+		srv.wire = wl
 	}
-	p := ipv4.NewPacketConn(c)
-	if err = p.JoinGroup(i, &net.UDPAddr{IP: group}); err != nil {
-		return nil, errors.Wrap(err, "failed to join group")
+	if cfg.Pairings != nil {
+		paired, err := cfg.Pairings.Load()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load pairings")
+		}
+		for _, p := range paired {
+			srv.paired[p.ID] = p
+		}
 	}
-	srv := &Server{
-		route:    defaultRoute,
-		ctx:      ctx,
-		pconn:    p,
-		laddr:    laddr,
-		delay:    DefaultDelay,
-		listener: listener,
+	if srv.dialer == nil {
+		laddr, err := net.ResolveTCPAddr(tcpv, net.JoinHostPort(cfg.LocalAddress, "0"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid local address")
+		}
+		srv.dialer = &TCPDialer{LocalAddr: laddr, Port: cfg.Port, NoDelay: cfg.NoDelay}
+	}
+	if srv.discoverer == nil {
+		d, err := NewMulticastDiscoverer(cfg.Interface, cfg.Group, cfg.Port)
+		if err != nil {
+			return nil, err
+		}
+		srv.discoverer = d
 	}
 	return srv, nil
 }
@@ -125,17 +177,141 @@ func NewServer(ctx context.Context, inf string, localAddress string, listener Li
 // you will find that if you implement Listener interface.
 // Send can be called concurrently.
 func (srv *Server) Send(packet Packet) error {
-	b, err := packet.Encode()
+	v, ok := srv.pool.Load(packet.ID)
+	if !ok {
+		return errors.Wrapf(ErrNotExist, "id %v", packet.ID)
+	}
+	n := v.(*node)
+	b, err := n.encode(packet)
 	if err != nil {
 		return errors.Wrap(err, "failed to encode packet")
 	}
-	n, ok := srv.pool.Load(packet.ID)
+	srv.sent(packet)
+	n.Send(b)
+	return nil
+}
+
+// SendContext sends the given packet and waits for it to be
+// written to the node. It returns the result of the write,
+// ErrNodeClosed if the node was lost before writing, or the
+// error of ctx if it is done first. The write is bounded by the
+// configured write timeout and the deadline of ctx, whichever
+// comes first. SendContext can be called concurrently.
+func (srv *Server) SendContext(ctx context.Context, packet Packet) error {
+	v, ok := srv.pool.Load(packet.ID)
 	if !ok {
 		return errors.Wrapf(ErrNotExist, "id %v", packet.ID)
 	}
-	node := n.(*node)
-	node.Send(b)
-	return nil
+	n := v.(*node)
+	b, err := n.encode(packet)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode packet")
+	}
+	srv.sent(packet)
+	return n.SendContext(ctx, b)
+}
+
+// TrySend queues the given packet without blocking. If the
+// outbound queue of the node is full the configured overflow
+// policy is applied: with DropNewest ErrQueueFull is returned,
+// with DropOldest the oldest queued packet is dropped instead.
+// TrySend can be called concurrently.
+func (srv *Server) TrySend(packet Packet) error {
+	v, ok := srv.pool.Load(packet.ID)
+	if !ok {
+		return errors.Wrapf(ErrNotExist, "id %v", packet.ID)
+	}
+	n := v.(*node)
+	b, err := n.encode(packet)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode packet")
+	}
+	srv.sent(packet)
+	return n.TrySend(b)
+}
+
+// sent tells the listener about the packet if it is a
+// SendListener.
+func (srv *Server) sent(packet Packet) {
+	if sl, ok := srv.listener.(SendListener); ok {
+		sl.PacketSent(packet)
+	}
+}
+
+// SendErrors maps the ID of each node that could not be
+// sent to with the error that happened.
+type SendErrors map[uint16]error
+
+func (e SendErrors) Error() string {
+	ids := make([]int, 0, len(e))
+	for id := range e {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	msgs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("node %d: %s", id, e[uint16(id)]))
+	}
+	return "failed to send to nodes: " + strings.Join(msgs, "; ")
+}
+
+// SendMany sends every packet to the node specified within
+// it. Nodes are written concurrently while packets for the same
+// node are written in order. It returns nil if every write
+// succeeded or SendErrors with the first error of each node
+// that failed. SendMany waits for the writes the same way
+// SendContext does.
+func (srv *Server) SendMany(packets []Packet) error {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		errs    = SendErrors{}
+		order   = []uint16{}
+		perNode = map[uint16][]Packet{}
+	)
+	for _, p := range packets {
+		if _, ok := perNode[p.ID]; !ok {
+			order = append(order, p.ID)
+		}
+		perNode[p.ID] = append(perNode[p.ID], p)
+	}
+	for _, id := range order {
+		wg.Add(1)
+		go func(id uint16, pkts []Packet) {
+			defer wg.Done()
+			for _, p := range pkts {
+				if err := srv.SendContext(srv.ctx, p); err != nil {
+					mu.Lock()
+					errs[id] = err
+					mu.Unlock()
+					return
+				}
+			}
+		}(id, perNode[id])
+	}
+	wg.Wait()
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// SendGroup sends a copy of packet to each of the nodes in
+// ids. See SendMany.
+func (srv *Server) SendGroup(ids []uint16, packet Packet) error {
+	packets := make([]Packet, 0, len(ids))
+	for _, id := range ids {
+		p := packet
+		p.ID = id
+		packets = append(packets, p)
+	}
+	return srv.SendMany(packets)
+}
+
+// Broadcast sends a copy of packet to every connected node.
+// See SendMany.
+func (srv *Server) Broadcast(packet Packet) error {
+	return srv.SendGroup(srv.Nodes(), packet)
 }
 
 // Nodes returns an array with all the ids of the currently
@@ -149,6 +325,30 @@ func (srv *Server) Nodes() []uint16 {
 	return ids
 }
 
+// NodeInfo returns the information of the node with the
+// given id or ErrNotExist if it is not connected.
+func (srv *Server) NodeInfo(id uint16) (NodeInfo, error) {
+	n, ok := srv.pool.Load(id)
+	if !ok {
+		return NodeInfo{}, errors.Wrapf(ErrNotExist, "id %v", id)
+	}
+	return n.(*node).Info(), nil
+}
+
+// Snapshot returns the information of every connected node
+// sorted by ID.
+func (srv *Server) Snapshot() []NodeInfo {
+	infos := []NodeInfo{}
+	srv.pool.Range(func(key interface{}, value interface{}) bool {
+		infos = append(infos, value.(*node).Info())
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
 // ListenAndAccept runs the qsy server, listening over udp for incoming
 // connection requests, and establishing new connections over tcp.
 func (srv *Server) ListenAndAccept() error {
@@ -158,162 +358,345 @@ func (srv *Server) ListenAndAccept() error {
 	if err := srv.ctx.Err(); err != nil {
 		return errors.Wrap(err, "server was stopped")
 	}
+	if srv.closed() {
+		return ErrServerClosed
+	}
 	srv.run = true
-	srv.packets = make(chan Packet, 50)
-	srv.lost = make(chan uint16, 50)
-	srv.connected = make(chan uint16, 50)
-	srv.disconnected = make(chan uint16, 50)
-	srv.incoming = make(chan newConn, 50)
+	srv.events = make(chan Event, srv.cfg.BufferSize)
+	srv.lost = make(chan *node, srv.cfg.BufferSize)
+	srv.expired = make(chan *pendingNode)
+	srv.incoming = make(chan Hello, srv.cfg.BufferSize)
+	srv.pending = map[uint16]*pendingNode{}
+	srv.conflicts = map[Hello]bool{}
+	srv.assigned = map[uint16]bool{}
 	srv.mu.Lock()
-	srv.searching = true
+	srv.setState(Searching)
 	srv.mu.Unlock()
+	srv.wg.Add(3)
 	go srv.listen()
 	go srv.accept()
-	if srv.listener != nil {
-		go srv.forward()
-	}
+	go srv.forward()
+	go func() {
+		select {
+		case <-srv.ctx.Done():
+			srv.shutdown()
+		case <-srv.done:
+		}
+	}()
 	return nil
 }
 
-// forward forwards events to the listeners. Events so far are:
-// * Incoming packet that it's not keep alive
+// Close stops the server. It stops discovering nodes, closes the
+// connection with every node, delivers the final LostNode events
+// and returns once every goroutine of the server has exited.
+// Cancelling the server's context is equivalent to calling Close
+// without waiting.
+func (srv *Server) Close() error {
+	srv.shutdown()
+	srv.Wait()
+	return srv.closeErr
+}
+
+// Wait blocks until the server is stopped and every goroutine
+// has exited, including the calls made to the Listener.
+func (srv *Server) Wait() {
+	srv.wg.Wait()
+}
+
+// shutdown signals every goroutine of the server to exit and
+// unblocks the discoverer.
+func (srv *Server) shutdown() {
+	srv.closeOnce.Do(func() {
+		close(srv.done)
+		srv.closeErr = srv.discoverer.Close()
+	})
+}
+
+// closed returns true if the server was stopped.
+func (srv *Server) closed() bool {
+	select {
+	case <-srv.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// forward forwards the events to the listener and the
+// subscribers. Every event goes through the events channel and
+// the listener is called for one event at a time, so the events
+// of a node keep their order. Events so far are:
+// * Incoming packet, keep alives are not sent to the listener
 // * Disconnected node
 // * New node connection
+// * Reconnected node
+// * Conflicting node IDs and decode errors, only conflicts
+//   are sent to the listener
+// * Paired node, only sent to the listener
+// forward returns once accept closed the events channel, then
+// it closes the channels of the subscribers.
 func (srv *Server) forward() {
-	for {
-		select {
-		case p := <-srv.packets:
-			go srv.listener.Receive(p)
-		case id := <-srv.disconnected:
-			go srv.listener.LostNode(id)
-		case id := <-srv.connected:
-			go srv.listener.NewNode(id)
-		case <-srv.ctx.Done():
-			return
+	defer srv.wg.Done()
+	call := func(f func()) {
+		if srv.listener != nil {
+			f()
 		}
 	}
+	for e := range srv.events {
+		switch e := e.(type) {
+		case Touch:
+			if tl, ok := srv.listener.(ToucheListener); ok && e.Timing != nil {
+				call(func() { tl.Touche(*e.Timing) })
+				break
+			}
+			call(func() { srv.listener.Receive(e.Packet) })
+		case NodeDown:
+			call(func() { srv.listener.LostNode(e.ID) })
+		case NodeUp:
+			if !e.Reconnect {
+				call(func() { srv.listener.NewNode(e.ID) })
+			} else if rl, ok := srv.listener.(ReconnectListener); ok {
+				call(func() { rl.NodeReconnected(e.ID) })
+			}
+		case Error:
+			if cerr, ok := e.Err.(*ConflictError); ok {
+				if cl, ok := srv.listener.(ConflictListener); ok {
+					call(func() { cl.NodeConflict(cerr) })
+				}
+			}
+		case paired:
+			if pl, ok := srv.listener.(PairingListener); ok {
+				call(func() { pl.NodePaired(e.PairedNode) })
+			}
+		}
+		srv.hub.publish(e)
+	}
+	srv.hub.close()
 }
 
 // accept listens on incoming connections and handles lost connections.
+// accept is the only writer of the node and pairing events,
+// once the server is closed it closes the events channel after
+// every node has exited.
 func (srv *Server) accept() {
+	defer srv.wg.Done()
 	for {
 		select {
-		case nconn := <-srv.incoming:
-			if _, ok := srv.pool.Load(nconn.id); ok {
-				srv.lost <- nconn.id
-				break
+		case h := <-srv.incoming:
+			srv.hello(h)
+		case n := <-srv.lost:
+			srv.drop(n)
+		case p := <-srv.expired:
+			if srv.pending[p.id] == p {
+				delete(srv.pending, p.id)
+				srv.disconnect(p.id)
 			}
-			tconn, err := srv.dial(nconn)
-			if err != nil {
-				log.Printf("failed to dial new conn: %s", err)
-				break
-			}
-			if err := tconn.SetNoDelay(true); err != nil {
-				log.Printf("failed to set no delay on node conn: %s", err)
-				srv.lost <- nconn.id
-				break
-			}
-			n := newNode(tconn, nconn.id, nconn.addr)
-			srv.pool.Store(n.id, n)
-			srv.connected <- n.id
-			n.Listen(srv.packets, srv.lost, srv.delay)
-		case nid := <-srv.lost:
-			n, ok := srv.pool.Load(nid)
-			if !ok {
-				break
-			}
-			node := n.(*node)
-			if err := node.Close(); err != nil {
-				log.Printf("failed to close node %v: %s", nid, err)
-			}
-			srv.pool.Delete(nid)
-			srv.disconnected <- nid
-		case <-srv.ctx.Done():
+		case <-srv.done:
 			srv.pool.Range(func(id interface{}, n interface{}) bool {
-				node := n.(*node)
-				if err := node.Close(); err != nil {
-					log.Printf("failed to close node %v: %s", id, err)
-				}
+				srv.drop(n.(*node))
 				return true
 			})
-			close(srv.lost)
-			close(srv.packets)
-			close(srv.disconnected)
-			close(srv.connected)
+			for id, p := range srv.pending {
+				p.timer.Stop()
+				delete(srv.pending, id)
+				srv.disconnect(id)
+			}
+			close(srv.events)
+			srv.mu.Lock()
+			srv.setState(Idle)
+			srv.mu.Unlock()
 			return
 		}
 	}
 }
 
-func (srv *Server) dial(n newConn) (*net.TCPConn, error) {
-	taddr, err := net.ResolveTCPAddr(tcpv, n.addr)
+// hello handles a connection request. A node that is known,
+// either connected or within its reconnect grace window, takes
+// over its previous identity. Without grace window a hello of
+// a connected node means its connection is stale so the node
+// is dropped. A hello for a known ID from a different host is
+// a conflict and is refused. New nodes are accepted depending
+// on the discovery state, see DiscoveryState, including the
+// nodes whose ID was assigned by the server. New nodes that are
+// not in the allow-list get paired.
+func (srv *Server) hello(h Hello) {
+	var (
+		reconnects uint64
+		old        *node
+	)
+	if srv.wire != nil {
+		srv.wire.PacketRead(NewHelloPacket(h.ID, h.Version, h.Caps))
+	}
+	if n, ok := srv.pool.Load(h.ID); ok {
+		old = n.(*node)
+		if host(old.addr) != host(h.Addr) {
+			srv.conflict(h, old.addr)
+			return
+		}
+		if srv.cfg.ReconnectGrace == 0 {
+			srv.drop(old)
+			return
+		}
+		reconnects = old.Info().Reconnects + 1
+	} else if p, ok := srv.pending[h.ID]; ok {
+		if host(p.addr) != host(h.Addr) {
+			srv.conflict(h, p.addr)
+			return
+		}
+		reconnects = p.reconnects + 1
+	} else if !srv.admit(h) {
+		return
+	}
+	conn, err := srv.dialer.Dial(srv.ctx, h)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to resolve node addres")
+		log.Printf("failed to dial new conn: %s", err)
+		return
+	}
+	codec := negotiate(h.Version, srv.cfg.ProtocolVersion)
+	err = conn.SetWriteDeadline(time.Now().Add(srv.cfg.WriteTimeout))
+	if err == nil {
+		err = srv.handshake(conn, h, codec)
 	}
-	taddr.Port = QSYPort
-	tconn, err := net.DialTCP(tcpv, srv.laddr, taddr)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to initiate connection to node")
+		log.Printf("failed to negotiate protocol with node %v: %s", h.ID, err)
+		conn.Close()
+		return
+	}
+	if old != nil {
+		srv.release(old)
 	}
-	return tconn, nil
+	if p, ok := srv.pending[h.ID]; ok {
+		p.timer.Stop()
+		delete(srv.pending, h.ID)
+	}
+	srv.mu.Lock()
+	delete(srv.assigned, h.ID)
+	srv.mu.Unlock()
+	if reconnects == 0 && !srv.allowed(h) {
+		srv.pair(h)
+	}
+	n := newNode(conn, h.ID, h.Addr, srv.cfg)
+	n.wire = srv.wire
+	n.codec = codec
+	n.info.Version = codec.Version()
+	n.info.Caps = h.Caps
+	n.info.Reconnects = reconnects
+	if !h.Caps.Has(CapProbe) {
+		n.probes = 0
+	}
+	srv.pool.Store(n.id, n)
+	srv.events <- NodeUp{ID: n.id, Reconnect: reconnects > 0}
+	n.Listen(srv.events, srv.lost, srv.cfg.KeepAlive)
+}
+
+// handshake tells the node the protocol version, see handshake,
+// and reports the hello written to the WireListener.
+func (srv *Server) handshake(conn Conn, h Hello, c Codec) error {
+	pkt, ok := handshakePacket(h, c)
+	if !ok {
+		return nil
+	}
+	if err := writePacket(conn, V1Codec{}, pkt); err != nil {
+		return err
+	}
+	srv.written(pkt)
+	return nil
+}
+
+// written reports the packet written to a node outside of its
+// outbound queue to the WireListener.
+func (srv *Server) written(pkt Packet) {
+	if srv.wire != nil {
+		srv.wire.PacketWritten(pkt)
+	}
+}
+
+// drop removes the node from the pool. If there is a reconnect
+// grace window the node has until it expires to come back,
+// otherwise, or if the server is closed, it is reported as lost
+// right away. Nodes that were already replaced are ignored.
+func (srv *Server) drop(n *node) {
+	if !srv.release(n) {
+		return
+	}
+	if srv.cfg.ReconnectGrace == 0 || srv.closed() {
+		srv.disconnect(n.id)
+		return
+	}
+	p := &pendingNode{id: n.id, addr: n.addr, reconnects: n.Info().Reconnects}
+	p.timer = time.AfterFunc(srv.cfg.ReconnectGrace, func() {
+		select {
+		case srv.expired <- p:
+		case <-srv.done:
+		}
+	})
+	srv.pending[n.id] = p
+}
+
+// disconnect reports the node as lost, its ID is free from
+// then on.
+func (srv *Server) disconnect(id uint16) {
+	srv.forget(id)
+	srv.events <- NodeDown{ID: id}
 }
 
-// Search allows to accept incoming connection requests. If the server
-// was stopped this is a NOP.
+// release closes the connection with the node, waits for its
+// goroutines to exit and removes it from the pool. It returns
+// false if the node is not the one in the pool.
+func (srv *Server) release(n *node) bool {
+	if err := n.Close(); err != nil {
+		log.Printf("failed to close node %v: %s", n.id, err)
+	}
+	n.Wait()
+	if current, ok := srv.pool.Load(n.id); !ok || current.(*node) != n {
+		return false
+	}
+	srv.pool.Delete(n.id)
+	return true
+}
+
+// Search allows to accept incoming connection requests from
+// nodes in the allow-list, it ends pairing. If the server was
+// stopped this is a NOP.
 func (srv *Server) Search() {
-	if err := srv.ctx.Err(); err != nil {
+	if err := srv.ctx.Err(); err != nil || srv.closed() {
 		return
 	}
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	srv.searching = true
+	srv.setState(Searching)
 }
 
-// StopSearch stops accepting incoming connection requests. If the
-// server was stopped this is a NOP.
+// StopSearch stops accepting incoming connection requests, it
+// ends pairing. If the server was stopped this is a NOP.
 func (srv *Server) StopSearch() {
-	if err := srv.ctx.Err(); err != nil {
+	if err := srv.ctx.Err(); err != nil || srv.closed() {
 		return
 	}
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
-	srv.searching = false
+	srv.setState(Idle)
 }
 
-// listen listens for new udp hello packets and forwards
+// listen listens for new hellos from the discoverer and forwards
 // them through the incoming channel. Note that listen does
 // not decide what to do with the incoming connection requests.
-// listen runs in its own go routine.
+// listen runs in its own go routine until the discoverer is
+// closed.
 func (srv *Server) listen() {
+	defer srv.wg.Done()
 	for {
-		srv.mu.RLock()
-		if !srv.searching {
-			srv.mu.RUnlock()
-			continue
-		}
-		srv.mu.RUnlock()
-
-		b := make([]byte, 16)
-		_, _, src, err := srv.pconn.ReadFrom(b)
+		h, err := srv.discoverer.Next()
 		if err != nil {
-			log.Printf("failed to read from udp conn: %s", err)
-			break
-		}
-		if b[QHeader] != 'Q' || b[SHeader] != 'S' || b[YHeader] != 'Y' {
-			continue
-		}
-		pkt := Packet{}
-		if err := Decode(b, &pkt); err != nil {
-			log.Printf("failed to decode packet: %v\nPacket bytes: %v", err, b)
-			continue
+			if !srv.closed() {
+				log.Printf("failed to discover nodes: %s", err)
+			}
+			return
 		}
-		if pkt.T != HelloT {
-			continue
+		select {
+		case srv.incoming <- h:
+		case <-srv.done:
+			return
 		}
-		srv.incoming <- newConn{id: pkt.ID, addr: src.String()}
-	}
-	close(srv.incoming)
-	if err := srv.pconn.Close(); err != nil {
-		log.Printf("failed to close udp conn: %s", err)
 	}
 }
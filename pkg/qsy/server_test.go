@@ -2,12 +2,209 @@ package qsy
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
 
+// events is a Listener that forwards every event through
+// channels.
+type events struct {
+	packets     chan Packet
+	lost        chan uint16
+	new         chan uint16
+	reconnected chan uint16
+	conflicts   chan *ConflictError
+	paired      chan PairedNode
+}
+
+func newEvents() *events {
+	return &events{
+		packets:     make(chan Packet, 10),
+		lost:        make(chan uint16, 10),
+		new:         make(chan uint16, 10),
+		reconnected: make(chan uint16, 10),
+		conflicts:   make(chan *ConflictError, 10),
+		paired:      make(chan PairedNode, 10),
+	}
+}
+
+func (e *events) Receive(p Packet) {
+	e.packets <- p
+}
+
+func (e *events) LostNode(id uint16) {
+	e.lost <- id
+}
+
+func (e *events) NewNode(id uint16) {
+	e.new <- id
+}
+
+func (e *events) NodeReconnected(id uint16) {
+	e.reconnected <- id
+}
+
+func (e *events) NodeConflict(err *ConflictError) {
+	e.conflicts <- err
+}
+
+func (e *events) NodePaired(p PairedNode) {
+	e.paired <- p
+}
+
+// hellos is a Discoverer whose hellos are sent by the test.
+type hellos struct {
+	c    chan Hello
+	once sync.Once
+	done chan struct{}
+}
+
+func newHellos() *hellos {
+	return &hellos{c: make(chan Hello), done: make(chan struct{})}
+}
+
+func (h *hellos) Next() (Hello, error) {
+	select {
+	case hello := <-h.c:
+		return hello, nil
+	case <-h.done:
+		return Hello{}, ErrDiscovererClosed
+	}
+}
+
+func (h *hellos) Close() error {
+	h.once.Do(func() { close(h.done) })
+	return nil
+}
+
+// pipeDialer returns a dialer that connects nodes through in
+// memory pipes. The node side of each pipe is sent through
+// conns.
+func pipeDialer(conns chan<- net.Conn) Dialer {
+	return DialerFunc(func(ctx context.Context, h Hello) (Conn, error) {
+		srv, node := net.Pipe()
+		conns <- node
+		return srv, nil
+	})
+}
+
 func TestServer(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		e           = newEvents()
+		conns       = make(chan net.Conn, 1)
+	)
+	defer cancel()
+	srv, err := NewServer(ctx, "", "", e,
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 18, Addr: "pipe"})),
+		WithDialer(pipeDialer(conns)),
+		WithReconnectGrace(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	node := <-conns
+	defer node.Close()
+	if id := <-e.new; id != 18 {
+		t.Fatalf("expected new node 18 but got %v", id)
+	}
+
+	pkt := NewPacket(CommandT, 18, Red, 500, 1, false, false)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- srv.SendContext(ctx, pkt)
+	}()
+	b := make([]byte, PacketSize)
+	if _, err := io.ReadFull(node, b); err != nil {
+		t.Fatalf("failed to read command: %s", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("failed to send command: %s", err)
+	}
+	p := Packet{}
+	Decode(b, &p)
+	if p != pkt {
+		t.Fatalf("wrong command.\n\tExpected: %s\n\tGot: %s", pkt, p)
+	}
+
+	touche, _ := NewPacket(ToucheT, 18, Red, 300, 1, false, false).Encode()
+	if _, err := node.Write(touche); err != nil {
+		t.Fatalf("failed to write touche: %s", err)
+	}
+	if p := <-e.packets; p.T != ToucheT || p.ID != 18 || p.Delay != 300 {
+		t.Fatalf("unexpected packet received: %s", p)
+	}
+	info, err := srv.NodeInfo(18)
+	if err != nil {
+		t.Fatalf("failed to get node info: %s", err)
+	}
+	if info.Addr != "pipe" || info.PacketsIn != 1 || info.PacketsOut != 1 {
+		t.Fatalf("unexpected node info: %+v", info)
+	}
+	if snap := srv.Snapshot(); len(snap) != 1 || snap[0].ID != 18 {
+		t.Fatalf("unexpected snapshot: %+v", snap)
+	}
+
+	node.Close()
+	if id := <-e.lost; id != 18 {
+		t.Fatalf("expected lost node 18 but got %v", id)
+	}
+}
+
+// calls is a Listener that records the order of its calls.
+// Receive is slow so that calls made concurrently overtake it.
+type calls chan string
+
+func (c calls) Receive(p Packet) {
+	time.Sleep(time.Millisecond)
+	c <- fmt.Sprintf("receive %v", p.Step)
+}
+
+func (c calls) LostNode(id uint16) { c <- "lost" }
+func (c calls) NewNode(id uint16)  { c <- "new" }
+
+func TestListenerOrder(t *testing.T) {
+	t.Parallel()
+
+	var (
+		c     = make(calls, 100)
+		conns = make(chan net.Conn, 1)
+	)
+	srv, err := NewServer(context.Background(), "", "", c,
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 18})),
+		WithDialer(pipeDialer(conns)))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	node := <-conns
+	expected := []string{"new"}
+	for i := uint16(1); i <= 50; i++ {
+		b, _ := NewPacket(ToucheT, 18, Red, 100, i, false, false).Encode()
+		if _, err := node.Write(b); err != nil {
+			t.Fatalf("failed to write touche: %s", err)
+		}
+		expected = append(expected, fmt.Sprintf("receive %v", i))
+	}
+	node.Close()
+	expected = append(expected, "lost")
+	for i, e := range expected {
+		if got := <-c; got != e {
+			t.Fatalf("call %v: expected %q but got %q", i, e, got)
+		}
+	}
 }
 
 type r struct{}
@@ -42,3 +239,363 @@ func BenchmarkServer(b *testing.B) {
 	}
 	<-ctx.Done()
 }
+
+func TestServerClose(t *testing.T) {
+	t.Parallel()
+
+	var (
+		e     = newEvents()
+		conns = make(chan net.Conn, 2)
+	)
+	srv, err := NewServer(context.Background(), "", "", e,
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 1}, Hello{ID: 2})),
+		WithDialer(pipeDialer(conns)))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	<-e.new
+	<-e.new
+	if err := srv.Close(); err != nil {
+		t.Fatalf("failed to close server: %s", err)
+	}
+	// every LostNode was delivered before Close returned
+	lost := map[uint16]bool{}
+	for len(e.lost) > 0 {
+		lost[<-e.lost] = true
+	}
+	if !lost[1] || !lost[2] {
+		t.Fatalf("expected nodes 1 and 2 to be lost but got %v", lost)
+	}
+	if err := srv.Send(NewPacket(CommandT, 1, Red, 0, 0, false, false)); err == nil {
+		t.Fatalf("expected error sending to closed server")
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatalf("closing twice should not fail: %s", err)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv, err := NewServer(ctx, "", "", nil,
+		WithDiscoverer(NewStaticDiscoverer()),
+		WithDialer(pipeDialer(make(chan net.Conn, 1))))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	cancel()
+	srv.Wait()
+	if err := srv.ListenAndAccept(); err == nil {
+		t.Fatalf("expected error restarting a stopped server")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	t.Parallel()
+
+	var (
+		e     = newEvents()
+		conns = make(chan net.Conn, 3)
+	)
+	srv, err := NewServer(context.Background(), "", "", e,
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 1}, Hello{ID: 2}, Hello{ID: 3})),
+		WithDialer(pipeDialer(conns)))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	received := make(chan Packet, 10)
+	for i := 0; i < 3; i++ {
+		<-e.new
+		go func(c net.Conn) {
+			b := make([]byte, PacketSize)
+			for {
+				if _, err := io.ReadFull(c, b); err != nil {
+					return
+				}
+				p := Packet{}
+				Decode(b, &p)
+				received <- p
+			}
+		}(<-conns)
+	}
+
+	if err := srv.Broadcast(NewPacket(CommandT, 0, Blue, 100, 2, false, false)); err != nil {
+		t.Fatalf("failed to broadcast: %s", err)
+	}
+	ids := map[uint16]bool{}
+	for i := 0; i < 3; i++ {
+		p := <-received
+		if p.Color != Blue || p.Step != 2 {
+			t.Fatalf("unexpected packet: %s", p)
+		}
+		ids[p.ID] = true
+	}
+	if len(ids) != 3 {
+		t.Fatalf("expected every node to receive the packet but got %v", ids)
+	}
+
+	err = srv.SendGroup([]uint16{1, 7}, NewPacket(CommandT, 0, Red, 100, 3, false, false))
+	errs, ok := err.(SendErrors)
+	if !ok {
+		t.Fatalf("expected SendErrors but got %v", err)
+	}
+	if len(errs) != 1 || errs[7] == nil {
+		t.Fatalf("expected only node 7 to fail but got %s", errs)
+	}
+	if p := <-received; p.ID != 1 || p.Step != 3 {
+		t.Fatalf("unexpected packet: %s", p)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	t.Parallel()
+
+	var (
+		e     = newEvents()
+		conns = make(chan net.Conn, 1)
+		hs    = newHellos()
+	)
+	srv, err := NewServer(context.Background(), "", "", e,
+		WithDiscoverer(hs),
+		WithDialer(pipeDialer(conns)),
+		WithReconnectGrace(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	hs.c <- Hello{ID: 18}
+	if id := <-e.new; id != 18 {
+		t.Fatalf("expected new node 18 but got %v", id)
+	}
+	// the connection drops and the node comes back
+	(<-conns).Close()
+	for len(srv.Nodes()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	srv.StopSearch()
+	hs.c <- Hello{ID: 18}
+	if id := <-e.reconnected; id != 18 {
+		t.Fatalf("expected node 18 to reconnect but got %v", id)
+	}
+	// the node says hello while the server still holds its
+	// stale connection
+	stale := <-conns
+	hs.c <- Hello{ID: 18}
+	if id := <-e.reconnected; id != 18 {
+		t.Fatalf("expected node 18 to reconnect but got %v", id)
+	}
+	<-conns
+	if _, err := stale.Write([]byte("QSY")); err == nil {
+		t.Fatalf("expected stale connection to be closed")
+	}
+	info, err := srv.NodeInfo(18)
+	if err != nil {
+		t.Fatalf("failed to get node info: %s", err)
+	}
+	if info.Reconnects != 2 {
+		t.Fatalf("expected 2 reconnects but got %v", info.Reconnects)
+	}
+	// unknown nodes are not accepted while not searching
+	hs.c <- Hello{ID: 19}
+	hs.c <- Hello{ID: 18}
+	<-e.reconnected
+	<-conns
+	if err := srv.Close(); err != nil {
+		t.Fatalf("failed to close server: %s", err)
+	}
+	if len(conns) != 0 || len(e.new) != 0 {
+		t.Fatalf("expected node 19 to be ignored")
+	}
+	if len(e.lost) != 1 || <-e.lost != 18 {
+		t.Fatalf("expected only node 18 to be lost on close")
+	}
+}
+
+func TestReconnectExpired(t *testing.T) {
+	t.Parallel()
+
+	var (
+		e     = newEvents()
+		conns = make(chan net.Conn, 1)
+	)
+	srv, err := NewServer(context.Background(), "", "", e,
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 18})),
+		WithDialer(pipeDialer(conns)),
+		WithReconnectGrace(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	<-e.new
+	(<-conns).Close()
+	if id := <-e.lost; id != 18 {
+		t.Fatalf("expected node 18 to be lost but got %v", id)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	t.Parallel()
+
+	tt := []struct {
+		name     string
+		assign   bool
+		assigned uint16
+	}{
+		{name: "refused", assign: false},
+		{name: "assigned", assign: true, assigned: 2},
+	}
+	for _, tc := range tt {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var (
+				e     = newEvents()
+				conns = make(chan net.Conn, 1)
+				hs    = newHellos()
+			)
+			srv, err := NewServer(context.Background(), "", "", e,
+				WithDiscoverer(hs),
+				WithDialer(pipeDialer(conns)),
+				WithReconnectGrace(time.Minute),
+				WithAssignIDs(tc.assign))
+			if err != nil {
+				t.Fatalf("failed to create server: %s", err)
+			}
+			if err := srv.ListenAndAccept(); err != nil {
+				t.Fatalf("failed to start server: %s", err)
+			}
+			defer srv.Close()
+			hs.c <- Hello{ID: 1, Addr: "10.0.0.1:3000"}
+			<-conns
+			<-e.new
+			hs.c <- Hello{ID: 18, Addr: "10.0.0.1:3000"}
+			<-conns
+			<-e.new
+			// the same host may say hello from another port
+			hs.c <- Hello{ID: 18, Addr: "10.0.0.1:4000"}
+			<-conns
+			if id := <-e.reconnected; id != 18 {
+				t.Fatalf("expected node 18 to reconnect but got %v", id)
+			}
+
+			hs.c <- Hello{ID: 18, Addr: "10.0.0.2:3000", Caps: CapAssignID}
+			if tc.assign {
+				b := make([]byte, PacketSize)
+				if _, err := io.ReadFull(<-conns, b); err != nil {
+					t.Fatalf("failed to read assignment: %s", err)
+				}
+				p := Packet{}
+				if err := Decode(b, &p); err != nil {
+					t.Fatalf("failed to decode assignment: %s", err)
+				}
+				if p.T != CommandT || p.ID != 18 || p.Config&AssignIDConfig == 0 || p.Step != tc.assigned {
+					t.Fatalf("unexpected assignment: %+v", p)
+				}
+			}
+			cerr := <-e.conflicts
+			expected := ConflictError{ID: 18, Addr: "10.0.0.1:4000", ConflictAddr: "10.0.0.2:3000", AssignedID: tc.assigned}
+			if *cerr != expected {
+				t.Fatalf("expected %+v but got %+v", expected, *cerr)
+			}
+			// conflicts are reported once
+			hs.c <- Hello{ID: 18, Addr: "10.0.0.2:3000", Caps: CapAssignID}
+			if tc.assign {
+				hs.c <- Hello{ID: tc.assigned, Addr: "10.0.0.2:3000"}
+				<-conns
+				if id := <-e.new; id != tc.assigned {
+					t.Fatalf("expected assigned node %v but got %v", tc.assigned, id)
+				}
+
+				// assigned IDs are admitted like any new node
+				hs.c <- Hello{ID: 18, Addr: "10.0.0.3:3000", Caps: CapAssignID}
+				b := make([]byte, PacketSize)
+				if _, err := io.ReadFull(<-conns, b); err != nil {
+					t.Fatalf("failed to read assignment: %s", err)
+				}
+				if cerr := <-e.conflicts; cerr.AssignedID != tc.assigned+1 {
+					t.Fatalf("expected assigned id %v but got %+v", tc.assigned+1, *cerr)
+				}
+				// but not once the discovery state changed
+				srv.StopSearch()
+				hs.c <- Hello{ID: tc.assigned + 1, Addr: "10.0.0.3:3000"}
+				hs.c <- Hello{ID: 1, Addr: "10.0.0.1:3000"}
+				<-conns
+				if id := <-e.reconnected; id != 1 {
+					t.Fatalf("expected node 1 to reconnect but got %v", id)
+				}
+			}
+			if err := srv.Close(); err != nil {
+				t.Fatalf("failed to close server: %s", err)
+			}
+			if len(e.conflicts) != 0 {
+				t.Fatalf("expected a single conflict")
+			}
+			if len(e.new) != 0 {
+				t.Fatalf("expected conflicting node to be refused")
+			}
+		})
+	}
+}
+
+func TestConflictSkipsPairedIDs(t *testing.T) {
+	t.Parallel()
+
+	var (
+		e     = newEvents()
+		conns = make(chan net.Conn, 1)
+		hs    = newHellos()
+		// node 2 is paired but offline
+		store = NewMemoryStore(PairedNode{ID: 1, Addr: "10.0.0.1"}, PairedNode{ID: 2, Addr: "10.0.0.3"})
+	)
+	srv, err := NewServer(context.Background(), "", "", e,
+		WithDiscoverer(hs),
+		WithDialer(pipeDialer(conns)),
+		WithPairings(store),
+		WithAssignIDs(true))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	hs.c <- Hello{ID: 1, Addr: "10.0.0.1:3000"}
+	<-conns
+	<-e.new
+	if err := srv.Pair(time.Minute); err != nil {
+		t.Fatalf("failed to pair: %s", err)
+	}
+
+	hs.c <- Hello{ID: 1, Addr: "10.0.0.2:3000", Caps: CapAssignID}
+	b := make([]byte, PacketSize)
+	if _, err := io.ReadFull(<-conns, b); err != nil {
+		t.Fatalf("failed to read assignment: %s", err)
+	}
+	p := Packet{}
+	if err := Decode(b, &p); err != nil {
+		t.Fatalf("failed to decode assignment: %s", err)
+	}
+	if p.Step != 3 {
+		t.Fatalf("expected paired node 2 to be skipped and id 3 assigned but got %v", p.Step)
+	}
+	if cerr := <-e.conflicts; cerr.AssignedID != 3 {
+		t.Fatalf("expected assigned id 3 but got %+v", *cerr)
+	}
+}
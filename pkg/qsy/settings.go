@@ -0,0 +1,75 @@
+package qsy
+
+const (
+	// DistanceConfig is the config bit that makes the node
+	// detect proximity with its distance sensor instead of
+	// touch.
+	DistanceConfig = 1 << 0
+	// SoundConfig is the config bit that makes the node beep
+	// when it is touched.
+	SoundConfig = 1 << 1
+
+	// MaxLevel is the highest sensitivity and brightness level.
+	MaxLevel = 15
+
+	// The sensitivity and brightness levels take 4 config bits
+	// each, right after SoundConfig.
+	sensitivityShift = 2
+	brightnessShift  = 6
+	sensitivityMask  = MaxLevel << sensitivityShift
+	brightnessMask   = MaxLevel << brightnessShift
+
+	// settingsMask has the config bits used by Settings.
+	settingsMask = DistanceConfig | SoundConfig | sensitivityMask | brightnessMask
+)
+
+// Settings are the per node settings carried in the config of
+// a packet. A zero level leaves the default of the node, levels
+// above MaxLevel are taken as MaxLevel.
+type Settings struct {
+	Sound    bool
+	Distance bool
+	// Sensitivity is the level of the distance sensor, the
+	// higher the level the farther away it detects.
+	Sensitivity uint8
+	// Brightness is the level of the light of the node.
+	Brightness uint8
+}
+
+// Config returns the config bits of the settings.
+func (s Settings) Config() uint16 {
+	c := uint16(0)
+	if s.Sound {
+		c |= SoundConfig
+	}
+	if s.Distance {
+		c |= DistanceConfig
+	}
+	c |= clampLevel(s.Sensitivity) << sensitivityShift
+	c |= clampLevel(s.Brightness) << brightnessShift
+	return c
+}
+
+// clampLevel returns l as a config level.
+func clampLevel(l uint8) uint16 {
+	if l > MaxLevel {
+		return MaxLevel
+	}
+	return uint16(l)
+}
+
+// Settings returns the settings in the config of the packet.
+func (pkt Packet) Settings() Settings {
+	return Settings{
+		Sound:       pkt.Config&SoundConfig != 0,
+		Distance:    pkt.Config&DistanceConfig != 0,
+		Sensitivity: uint8(pkt.Config & sensitivityMask >> sensitivityShift),
+		Brightness:  uint8(pkt.Config & brightnessMask >> brightnessShift),
+	}
+}
+
+// Configure replaces the settings in the config of the packet,
+// the rest of the config bits are kept.
+func (pkt *Packet) Configure(s Settings) {
+	pkt.Config = pkt.Config&^settingsMask | s.Config()
+}
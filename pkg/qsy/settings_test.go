@@ -0,0 +1,40 @@
+package qsy
+
+import "testing"
+
+func TestSettings(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		settings Settings
+		config   uint16
+	}{
+		{Settings{}, 0},
+		{Settings{Sound: true}, SoundConfig},
+		{Settings{Distance: true}, DistanceConfig},
+		{Settings{Sensitivity: 1}, 1 << 2},
+		{Settings{Brightness: MaxLevel}, 0x3c0},
+		{Settings{Sound: true, Distance: true, Sensitivity: 7, Brightness: 9}, 0x25f},
+	}
+	for _, tt := range tests {
+		if c := tt.settings.Config(); c != tt.config {
+			t.Errorf("config of %+v = %#x, want %#x", tt.settings, c, tt.config)
+		}
+		pkt := NewPacket(ToucheT, 1, Red, 0, 1, false, false)
+		pkt.Config |= ProbeConfig
+		pkt.Configure(tt.settings)
+		if s := pkt.Settings(); s != tt.settings {
+			t.Errorf("expected settings %+v but got %+v", tt.settings, s)
+		}
+		if pkt.Config&ProbeConfig == 0 {
+			t.Errorf("configuring %+v cleared the probe bit", tt.settings)
+		}
+		if err := pkt.Validate(); err != nil {
+			t.Errorf("failed to validate %+v: %s", tt.settings, err)
+		}
+	}
+	s := Settings{Sensitivity: MaxLevel + 1, Brightness: 255}
+	if c := s.Config(); c != sensitivityMask|brightnessMask {
+		t.Errorf("expected levels to be clamped but got %#x", c)
+	}
+}
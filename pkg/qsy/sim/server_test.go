@@ -0,0 +1,321 @@
+package sim
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"qsydev.com/term/internal/executor"
+	"qsydev.com/term/internal/terminal"
+	"qsydev.com/term/pkg/qsy"
+)
+
+type listener struct {
+	packets     chan qsy.Packet
+	touches     chan qsy.Touche
+	lost        chan uint16
+	new         chan uint16
+	reconnected chan uint16
+	conflicts   chan *qsy.ConflictError
+}
+
+func newListener() *listener {
+	return &listener{
+		packets:     make(chan qsy.Packet, 10),
+		touches:     make(chan qsy.Touche, 10),
+		lost:        make(chan uint16, 10),
+		new:         make(chan uint16, 10),
+		reconnected: make(chan uint16, 10),
+		conflicts:   make(chan *qsy.ConflictError, 10),
+	}
+}
+
+func (l *listener) Receive(p qsy.Packet) {
+	l.packets <- p
+}
+
+func (l *listener) Touche(t qsy.Touche) {
+	l.touches <- t
+}
+
+func (l *listener) LostNode(id uint16) {
+	l.lost <- id
+}
+
+func (l *listener) NewNode(id uint16) {
+	l.new <- id
+}
+
+func (l *listener) NodeReconnected(id uint16) {
+	l.reconnected <- id
+}
+
+func (l *listener) NodeConflict(err *qsy.ConflictError) {
+	l.conflicts <- err
+}
+
+// freePort returns a port that is free both for udp and tcp.
+func freePort(t *testing.T) int {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatalf("failed to find free port: %s", err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestServer(t *testing.T) {
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		port        = freePort(t)
+		l           = newListener()
+	)
+	defer cancel()
+	srv, err := qsy.NewServer(ctx, "lo", "127.0.0.1", l,
+		qsy.WithPort(port), qsy.WithProbeInterval(10*time.Millisecond),
+		qsy.WithReconnectGrace(2*time.Second))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	f, err := Start(ctx, Config{
+		Nodes:         3,
+		FirstID:       1,
+		IP:            net.IP{127, 0, 2, 1},
+		Port:          port,
+		HelloAddr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		HelloInterval: 100 * time.Millisecond,
+		KeepAlive:     50 * time.Millisecond,
+		Reaction:      Fixed(50 * time.Millisecond),
+		ClockOffset:   time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("failed to start fleet: %s", err)
+	}
+	defer f.Close()
+
+	connected := map[uint16]bool{}
+	for len(connected) < 3 {
+		select {
+		case id := <-l.new:
+			connected[id] = true
+		case <-ctx.Done():
+			t.Fatalf("nodes did not connect, got %v", connected)
+		}
+	}
+	for id := range connected {
+		if err := srv.SendContext(ctx, qsy.NewPacket(qsy.CommandT, id, qsy.Green, 0, 1, false, false)); err != nil {
+			t.Fatalf("failed to send command: %s", err)
+		}
+	}
+	touched := map[uint16]bool{}
+	for len(touched) < 3 {
+		tc := <-l.touches
+		if tc.T != qsy.ToucheT || tc.Step != 1 || tc.Color != qsy.Green {
+			t.Fatalf("unexpected packet: %s", tc.Packet)
+		}
+		if tc.Observed < 50*time.Millisecond || tc.Reaction > tc.Observed {
+			t.Fatalf("unexpected touche timing: %+v", tc)
+		}
+		touched[tc.ID] = true
+	}
+	for _, info := range srv.Snapshot() {
+		for info.Latency.Samples == 0 {
+			time.Sleep(10 * time.Millisecond)
+			info, _ = srv.NodeInfo(info.ID)
+		}
+		// the clock of the node started before the connection
+		// and is reported in milliseconds
+		if info.ClockOffset < time.Hour-info.ClockOffsetError-time.Millisecond || info.ClockOffset > time.Hour+5*time.Second {
+			t.Fatalf("unexpected clock offset of node %v: %s", info.ID, info.ClockOffset)
+		}
+	}
+
+	// a short drop does not lose the node
+	f.Nodes()[0].Drop()
+	if id := <-l.reconnected; id != f.Nodes()[0].ID() {
+		t.Fatalf("expected node %v to reconnect but got %v", f.Nodes()[0].ID(), id)
+	}
+	if len(l.lost) != 0 {
+		t.Fatalf("expected no node to be lost but got %v", <-l.lost)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		port        = freePort(t)
+		l           = newListener()
+	)
+	defer cancel()
+	srv, err := qsy.NewServer(ctx, "lo", "127.0.0.1", l,
+		qsy.WithPort(port), qsy.WithAssignIDs(true))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	start := func(ip net.IP) *Fleet {
+		f, err := Start(ctx, Config{
+			Nodes:         1,
+			FirstID:       1,
+			IP:            ip,
+			Port:          port,
+			HelloAddr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+			HelloInterval: 50 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("failed to start fleet: %s", err)
+		}
+		return f
+	}
+	a := start(net.IP{127, 0, 3, 1})
+	defer a.Close()
+	if id := <-l.new; id != 1 {
+		t.Fatalf("expected new node 1 but got %v", id)
+	}
+	b := start(net.IP{127, 0, 4, 1})
+	defer b.Close()
+	cerr := <-l.conflicts
+	// multicast hellos are dialed on the port of the server
+	if cerr.ID != 1 || cerr.AssignedID != 2 || cerr.ConflictAddr != "127.0.4.1" {
+		t.Fatalf("unexpected conflict: %s", cerr)
+	}
+	if id := <-l.new; id != 2 {
+		t.Fatalf("expected new node 2 but got %v", id)
+	}
+	if id := b.Nodes()[0].ID(); id != 2 {
+		t.Fatalf("expected node to take id 2 but has %v", id)
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		port        = freePort(t)
+		l           = newListener()
+	)
+	defer cancel()
+	srv, err := qsy.NewServer(ctx, "lo", "127.0.0.1", l, qsy.WithPort(port))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	defer srv.Close()
+	// the node takes longer to react than the blink is off
+	f, err := Start(ctx, Config{
+		Nodes:         1,
+		FirstID:       1,
+		IP:            net.IP{127, 0, 6, 1},
+		Port:          port,
+		HelloAddr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		HelloInterval: 50 * time.Millisecond,
+		Reaction:      Fixed(300 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("failed to start fleet: %s", err)
+	}
+	defer f.Close()
+	if id := <-l.new; id != 1 {
+		t.Fatalf("expected new node 1 but got %v", id)
+	}
+
+	pkt := qsy.NewPacket(qsy.ToucheT, 1, qsy.Red, 0, 1, false, false)
+	pkt.Animation = qsy.Animation{Kind: qsy.Blink, Period: qsy.MinAnimationPeriod}
+	if err := srv.SendContext(ctx, pkt); err != nil {
+		t.Fatalf("failed to send step: %s", err)
+	}
+	select {
+	case tc := <-l.touches:
+		if tc.Step != 1 || tc.Observed < 300*time.Millisecond {
+			t.Fatalf("unexpected touche: %+v", tc)
+		}
+	case <-ctx.Done():
+		t.Fatalf("blinking node was not touched")
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		port        = freePort(t)
+	)
+	defer cancel()
+	f, err := Start(ctx, Config{
+		Nodes:         2,
+		FirstID:       1,
+		IP:            net.IP{127, 0, 5, 1},
+		Port:          port,
+		HelloAddr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		HelloInterval: 50 * time.Millisecond,
+		Reaction:      Fixed(10 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatalf("failed to start fleet: %s", err)
+	}
+	defer f.Close()
+	term := &terminal.T{
+		Options: []qsy.Option{qsy.WithInterface("lo"), qsy.WithLocalAddress("127.0.0.1"), qsy.WithPort(port)},
+	}
+	if err := term.Start(ctx); err != nil {
+		t.Fatalf("failed to start terminal: %s", err)
+	}
+	defer term.Server().Close()
+	for len(term.Server().Snapshot()) < 2 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("nodes did not connect")
+		}
+	}
+
+	routine, err := proto.Marshal(&executor.CustomExecutor{
+		Steps: []*executor.Step{
+			{
+				Expression: "1 & 2",
+				NodeConfigs: []*executor.NodeConfig{
+					{Id: 1, Color: executor.Color_GREEN},
+					{Id: 2, Color: executor.Color_BLUE},
+				},
+			},
+			{
+				Expression:  "2",
+				NodeConfigs: []*executor.NodeConfig{{Id: 2, Color: executor.Color_RED}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal routine: %s", err)
+	}
+	if err := term.Write(append([]byte{executor.CustomExecID}, routine...)); err != nil {
+		t.Fatalf("failed to start routine: %s", err)
+	}
+	for {
+		select {
+		case b := <-term.Notify():
+			e := executor.Event{}
+			if err := proto.Unmarshal(b, &e); err != nil {
+				t.Fatalf("failed to unmarshal event: %s", err)
+			}
+			switch e.GetType() {
+			case executor.Event_End:
+				return
+			case executor.Event_StepTimeout, executor.Event_RoutineTimeout, executor.Event_WrongNode:
+				t.Fatalf("unexpected event: %s", e.String())
+			}
+		case <-ctx.Done():
+			t.Fatalf("routine did not end")
+		}
+	}
+}
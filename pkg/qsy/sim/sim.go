@@ -0,0 +1,470 @@
+// Package sim provides simulated QSY nodes. Simulated nodes
+// speak the QSY protocol over real sockets so that a qsy.Server
+// and everything built on top of it can be exercised without
+// hardware, e.g. over loopback in CI.
+package sim
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"qsydev.com/term/pkg/qsy"
+)
+
+const (
+	// DefaultHelloAddr is the multicast address where real
+	// nodes announce themselves.
+	DefaultHelloAddr = "224.0.0.12:3000"
+	// DefaultHelloInterval is the default amount of time between
+	// hello packets while a node is waiting to be connected.
+	DefaultHelloInterval = 500 * time.Millisecond
+	// DefaultKeepAlive is the default amount of time between
+	// keep alive packets.
+	DefaultKeepAlive = time.Second
+)
+
+var (
+	// defaultIP is the address of the first node when none
+	// is provided. Every node of the fleet listens on its own
+	// address so that all of them can use the same port.
+	defaultIP = net.IP{127, 0, 0, 2}
+)
+
+// ReactionFunc returns the amount of time the node waits before
+// being touched after receiving the command pkt.
+type ReactionFunc func(pkt qsy.Packet) time.Duration
+
+// Fixed returns a ReactionFunc that always reacts after d.
+func Fixed(d time.Duration) ReactionFunc {
+	return func(qsy.Packet) time.Duration {
+		return d
+	}
+}
+
+// Random returns a ReactionFunc that reacts after a random
+// duration in the [min, max) range.
+func Random(min, max time.Duration) ReactionFunc {
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func(qsy.Packet) time.Duration {
+		if max <= min {
+			return min
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return min + time.Duration(rnd.Int63n(int64(max-min)))
+	}
+}
+
+// Scripted returns a ReactionFunc that reacts after each of the
+// given delays in order, starting over once all were used.
+func Scripted(delays ...time.Duration) ReactionFunc {
+	var (
+		mu sync.Mutex
+		i  int
+	)
+	return func(qsy.Packet) time.Duration {
+		if len(delays) == 0 {
+			return 0
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		d := delays[i%len(delays)]
+		i++
+		return d
+	}
+}
+
+// Config is the configuration used for starting a fleet of
+// simulated nodes. Zero values are replaced by defaults.
+type Config struct {
+	// Nodes is the amount of nodes in the fleet.
+	Nodes int
+	// FirstID is the ID of the first node, the rest of the
+	// nodes use consecutive IDs.
+	FirstID uint16
+	// IP is the address of the first node, the rest of the nodes
+	// use consecutive addresses. Defaults to 127.0.0.2.
+	IP net.IP
+	// Port is the port nodes listen on for the server.
+	// Defaults to qsy.QSYPort.
+	Port int
+	// HelloAddr is the address where hello packets are sent.
+	// Defaults to DefaultHelloAddr.
+	HelloAddr string
+	// HelloInterval is the time between hello packets.
+	HelloInterval time.Duration
+	// KeepAlive is the time between keep alive packets.
+	KeepAlive time.Duration
+	// Reaction decides when nodes are touched. Defaults to
+	// a random reaction between 100ms and 500ms.
+	Reaction ReactionFunc
+	// ClockOffset is added to the clock of the nodes, which
+	// starts when the fleet starts. The clock is reported when
+	// answering latency probes.
+	ClockOffset time.Duration
+	// Version is the latest protocol version spoken by the
+	// nodes. Defaults to qsy.LatestProtocol.
+	Version uint16
+	// Caps are the capabilities advertised by the nodes.
+	// Defaults to every capability the nodes have.
+	Caps qsy.Capability
+}
+
+// Fleet is a set of simulated nodes.
+type Fleet struct {
+	nodes  []*Node
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start starts the fleet of nodes specified in cfg. The fleet
+// runs until ctx is cancelled or Close is called.
+func Start(ctx context.Context, cfg Config) (*Fleet, error) {
+	if cfg.Nodes <= 0 {
+		return nil, errors.New("fleet needs at least one node")
+	}
+	if cfg.IP == nil {
+		cfg.IP = defaultIP
+	}
+	if cfg.Port == 0 {
+		cfg.Port = qsy.QSYPort
+	}
+	if cfg.HelloAddr == "" {
+		cfg.HelloAddr = DefaultHelloAddr
+	}
+	if cfg.HelloInterval == 0 {
+		cfg.HelloInterval = DefaultHelloInterval
+	}
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = DefaultKeepAlive
+	}
+	if cfg.Version == 0 {
+		cfg.Version = qsy.LatestProtocol
+	}
+	if cfg.Caps == 0 {
+		cfg.Caps = qsy.CapProbe | qsy.CapAssignID
+	}
+	if cfg.Reaction == nil {
+		cfg.Reaction = Random(100*time.Millisecond, 500*time.Millisecond)
+	}
+	haddr, err := net.ResolveUDPAddr("udp4", cfg.HelloAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid hello address")
+	}
+	ip := cfg.IP.To4()
+	if ip == nil {
+		return nil, errors.New("node address must be IPv4")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f := &Fleet{cancel: cancel}
+	for i := 0; i < cfg.Nodes; i++ {
+		n, err := newNode(cfg.FirstID+uint16(i), ip, haddr, cfg)
+		if err != nil {
+			cancel()
+			for _, n := range f.nodes {
+				n.close()
+			}
+			return nil, errors.Wrapf(err, "failed to start node %v", cfg.FirstID+uint16(i))
+		}
+		f.nodes = append(f.nodes, n)
+		ip = nextIP(ip)
+	}
+	for _, n := range f.nodes {
+		f.wg.Add(1)
+		go func(n *Node) {
+			defer f.wg.Done()
+			n.run(ctx)
+		}(n)
+	}
+	return f, nil
+}
+
+// Nodes returns the nodes of the fleet.
+func (f *Fleet) Nodes() []*Node {
+	return f.nodes
+}
+
+// Close stops every node of the fleet and waits for them
+// to exit.
+func (f *Fleet) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	return nil
+}
+
+// Node is a single simulated node.
+type Node struct {
+	ip        net.IP
+	port      int
+	helloAddr *net.UDPAddr
+	interval  time.Duration
+	keepAlive time.Duration
+	reaction  ReactionFunc
+	start     time.Time
+	version   uint16
+	caps      qsy.Capability
+
+	ln    *net.TCPListener
+	hello *net.UDPConn
+
+	mu     sync.Mutex
+	id     uint16
+	conn   net.Conn
+	codec  qsy.Codec
+	touche *time.Timer
+}
+
+func newNode(id uint16, ip net.IP, helloAddr *net.UDPAddr, cfg Config) (*Node, error) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip, Port: cfg.Port})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for the server")
+	}
+	hello, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+	if err != nil {
+		ln.Close()
+		return nil, errors.Wrap(err, "failed to open hello conn")
+	}
+	return &Node{
+		id:        id,
+		ip:        ip,
+		port:      cfg.Port,
+		helloAddr: helloAddr,
+		interval:  cfg.HelloInterval,
+		keepAlive: cfg.KeepAlive,
+		reaction:  cfg.Reaction,
+		start:     time.Now().Add(-cfg.ClockOffset),
+		version:   cfg.Version,
+		caps:      cfg.Caps,
+		ln:        ln,
+		hello:     hello,
+	}, nil
+}
+
+// ID returns the ID of the node. It changes if the server
+// assigns a new one.
+func (n *Node) ID() uint16 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.id
+}
+
+// Addr returns the address the node listens on.
+func (n *Node) Addr() string {
+	return net.JoinHostPort(n.ip.String(), strconv.Itoa(n.port))
+}
+
+// Connected returns true if the server is connected to
+// the node.
+func (n *Node) Connected() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.conn != nil
+}
+
+// Drop closes the current connection with the server. The
+// node goes back to announcing itself.
+func (n *Node) Drop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn != nil {
+		n.conn.Close()
+	}
+}
+
+// run announces the node until the server connects and serves
+// the connection, it starts over once the connection is lost.
+func (n *Node) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		n.close()
+	}()
+	for ctx.Err() == nil {
+		if err := n.sayHello(); err != nil {
+			log.Printf("node %v failed to send hello: %s", n.ID(), err)
+		}
+		if err := n.ln.SetDeadline(time.Now().Add(n.interval)); err != nil {
+			return
+		}
+		conn, err := n.ln.AcceptTCP()
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+		n.serve(conn)
+	}
+}
+
+func (n *Node) sayHello() error {
+	b, err := qsy.NewHelloPacket(n.ID(), n.version, n.caps).Encode()
+	if err != nil {
+		return err
+	}
+	_, err = n.hello.WriteTo(b, n.helloAddr)
+	return err
+}
+
+// serve sends keep alives and answers commands until the
+// connection is lost. Touche packets sent by the server, such
+// as the steps of terminal.T, are taken as commands. Animation
+// frames are ignored.
+func (n *Node) serve(conn *net.TCPConn) {
+	rd := bufio.NewReader(conn)
+	codec, err := n.negotiate(rd)
+	if err != nil {
+		log.Printf("node %v failed to negotiate protocol: %s", n.ID(), err)
+		conn.Close()
+		return
+	}
+	n.mu.Lock()
+	n.conn = conn
+	n.codec = codec
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go n.keepAlives(done)
+	for {
+		b, err := codec.ReadFrame(rd, nil)
+		if errors.Cause(err) == qsy.ErrBadSignature {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		pkt := qsy.Packet{}
+		if err := codec.Decode(b, &pkt); err != nil {
+			continue
+		}
+		switch {
+		case pkt.T == qsy.CommandT && pkt.Config&qsy.AssignIDConfig != 0:
+			// the node takes the new ID and says hello again
+			n.mu.Lock()
+			n.id = pkt.Step
+			n.mu.Unlock()
+			conn.Close()
+		case pkt.T == qsy.CommandT && pkt.Config&qsy.FrameConfig != 0:
+			// frames of emulated animations only change the
+			// light, the node keeps waiting to be touched
+		case pkt.T == qsy.CommandT || pkt.T == qsy.ToucheT:
+			n.command(pkt)
+		case pkt.T == qsy.KeepAliveT && pkt.Config&qsy.ProbeConfig != 0:
+			n.answer(pkt)
+		}
+	}
+	close(done)
+
+	n.mu.Lock()
+	if n.touche != nil {
+		n.touche.Stop()
+		n.touche = nil
+	}
+	n.conn.Close()
+	n.conn = nil
+	n.mu.Unlock()
+}
+
+// negotiate returns the codec of the protocol version chosen
+// by the server. Nodes that speak qsy.ProtocolV1 don't get
+// told, newer nodes wait for the version in a hello.
+func (n *Node) negotiate(r *bufio.Reader) (qsy.Codec, error) {
+	v1 := qsy.V1Codec{}
+	if n.version < qsy.ProtocolV2 {
+		return v1, nil
+	}
+	b, err := v1.ReadFrame(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	pkt := qsy.Packet{}
+	if err := v1.Decode(b, &pkt); err != nil {
+		return nil, err
+	}
+	if pkt.T != qsy.HelloT || pkt.Config&qsy.VersionConfig == 0 || pkt.Step > n.version {
+		return nil, errors.Errorf("unexpected handshake: %s", pkt)
+	}
+	return qsy.LookupCodec(pkt.Step)
+}
+
+// command turns the node on or off. A node that is on gets
+// touched after the reaction delay.
+func (n *Node) command(pkt qsy.Packet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.touche != nil {
+		n.touche.Stop()
+		n.touche = nil
+	}
+	if pkt.Color == qsy.NoColor {
+		return
+	}
+	d := n.reaction(pkt)
+	id := n.id
+	n.touche = time.AfterFunc(d, func() {
+		n.send(qsy.NewPacket(qsy.ToucheT, id, pkt.Color, uint32(d/time.Millisecond), pkt.Step, false, false))
+	})
+}
+
+// answer answers a latency probe with the node clock.
+func (n *Node) answer(probe qsy.Packet) {
+	clock := uint32(time.Since(n.start) / time.Millisecond)
+	p := qsy.NewPacket(qsy.KeepAliveT, n.ID(), qsy.NoColor, clock, probe.Step, false, false)
+	p.Config |= qsy.ProbeConfig
+	n.send(p)
+}
+
+func (n *Node) keepAlives(done <-chan struct{}) {
+	t := time.NewTicker(n.keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n.send(qsy.NewPacket(qsy.KeepAliveT, n.ID(), qsy.NoColor, 0, 0, false, false))
+		case <-done:
+			return
+		}
+	}
+}
+
+func (n *Node) send(pkt qsy.Packet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return
+	}
+	b, err := n.codec.Encode(pkt)
+	if err != nil {
+		return
+	}
+	if _, err := n.conn.Write(b); err != nil {
+		log.Printf("node %v failed to write: %s", n.id, err)
+	}
+}
+
+func (n *Node) close() {
+	n.ln.Close()
+	n.hello.Close()
+	n.Drop()
+}
+
+// nextIP returns the address following ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,105 @@
+package sim
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"qsydev.com/term/pkg/qsy"
+)
+
+func TestFleet(t *testing.T) {
+	t.Parallel()
+
+	hello, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("failed to listen for hellos: %s", err)
+	}
+	defer hello.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := Start(ctx, Config{
+		Nodes:         2,
+		FirstID:       18,
+		IP:            net.IP{127, 0, 1, 2},
+		HelloAddr:     hello.LocalAddr().String(),
+		HelloInterval: 20 * time.Millisecond,
+		KeepAlive:     20 * time.Millisecond,
+		Reaction:      Fixed(30 * time.Millisecond),
+		Version:       qsy.ProtocolV1,
+	})
+	if err != nil {
+		t.Fatalf("failed to start fleet: %s", err)
+	}
+	defer f.Close()
+
+	b := make([]byte, qsy.PacketSize)
+	_, src, err := hello.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("failed to read hello: %s", err)
+	}
+	pkt := qsy.Packet{}
+	if err := qsy.Decode(b, &pkt); err != nil {
+		t.Fatalf("failed to decode hello: %s", err)
+	}
+	if pkt.T != qsy.HelloT || (pkt.ID != 18 && pkt.ID != 19) {
+		t.Fatalf("expected hello from node 18 or 19 but got %s", pkt)
+	}
+	if pkt.Step != qsy.ProtocolV1 || !qsy.Capability(pkt.Delay).Has(qsy.CapProbe) {
+		t.Fatalf("unexpected version %v and capabilities %s", pkt.Step, qsy.Capability(pkt.Delay))
+	}
+	host, _, _ := net.SplitHostPort(src.String())
+	conn, err := net.Dial("tcp4", net.JoinHostPort(host, strconv.Itoa(qsy.QSYPort)))
+	if err != nil {
+		t.Fatalf("failed to dial node: %s", err)
+	}
+	defer conn.Close()
+
+	cmd, _ := qsy.NewPacket(qsy.CommandT, pkt.ID, qsy.Red, 0, 3, false, false).Encode()
+	if _, err := conn.Write(cmd); err != nil {
+		t.Fatalf("failed to write command: %s", err)
+	}
+	keepAlive := false
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			t.Fatalf("failed to read from node: %s", err)
+		}
+		p := qsy.Packet{}
+		if err := qsy.Decode(b, &p); err != nil {
+			t.Fatalf("failed to decode packet: %s", err)
+		}
+		if p.T == qsy.KeepAliveT {
+			keepAlive = true
+			continue
+		}
+		if p.T != qsy.ToucheT || p.ID != pkt.ID || p.Step != 3 || p.Color != qsy.Red || p.Delay != 30 {
+			t.Fatalf("unexpected touche: %s - step %v - delay %v", p, p.Step, p.Delay)
+		}
+		break
+	}
+	if !keepAlive {
+		t.Fatalf("expected keep alive before touche")
+	}
+}
+
+func TestScripted(t *testing.T) {
+	t.Parallel()
+
+	r := Scripted(time.Millisecond, 2*time.Millisecond)
+	for _, d := range []time.Duration{time.Millisecond, 2 * time.Millisecond, time.Millisecond} {
+		if got := r(qsy.Packet{}); got != d {
+			t.Fatalf("expected %s but got %s", d, got)
+		}
+	}
+}
+
+func TestNextIP(t *testing.T) {
+	t.Parallel()
+
+	if ip := nextIP(net.IP{127, 0, 0, 255}); !ip.Equal(net.IP{127, 0, 1, 0}) {
+		t.Fatalf("expected 127.0.1.0 but got %s", ip)
+	}
+}
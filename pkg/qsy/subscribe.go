@@ -0,0 +1,310 @@
+package qsy
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultEventBuffer is the default size of the channel of a
+// subscriber.
+const DefaultEventBuffer = 64
+
+// EventType is the type of an Event.
+type EventType uint8
+
+// Types of the events.
+const (
+	TouchEvent EventType = iota
+	KeepAliveEvent
+	NodeUpEvent
+	NodeDownEvent
+	ErrorEvent
+	// pairedEvent is only delivered to the Listener.
+	pairedEvent
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TouchEvent:
+		return "Touch"
+	case KeepAliveEvent:
+		return "KeepAlive"
+	case NodeUpEvent:
+		return "NodeUp"
+	case NodeDownEvent:
+		return "NodeDown"
+	case ErrorEvent:
+		return "Error"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event is something that happened to a node. It is one of
+// Touch, KeepAlive, NodeUp, NodeDown or Error.
+type Event interface {
+	// NodeID returns the ID of the node of the event.
+	NodeID() uint16
+	// Type returns the type of the event.
+	Type() EventType
+}
+
+// Touch is a touche read from a node. ID is the node the packet
+// was read from. Timing is only set for touches of steps the
+// server commanded. Packets of any other type but keep alive
+// are sent as an Error wrapping ErrUnknownType.
+type Touch struct {
+	ID     uint16
+	Packet Packet
+	Timing *Touche
+	// Time is when the packet was read.
+	Time time.Time
+}
+
+// NodeID returns the ID of the node that sent the packet.
+func (e Touch) NodeID() uint16 { return e.ID }
+
+// Type returns TouchEvent.
+func (Touch) Type() EventType { return TouchEvent }
+
+// KeepAlive is a keep alive read from a node.
+type KeepAlive struct {
+	ID uint16
+	// Time is when the keep alive was read.
+	Time time.Time
+}
+
+// NodeID returns the ID of the node.
+func (e KeepAlive) NodeID() uint16 { return e.ID }
+
+// Type returns KeepAliveEvent.
+func (KeepAlive) Type() EventType { return KeepAliveEvent }
+
+// NodeUp is a node that connected. Reconnect is true if the
+// node came back within its reconnect grace window.
+type NodeUp struct {
+	ID        uint16
+	Reconnect bool
+}
+
+// NodeID returns the ID of the node.
+func (e NodeUp) NodeID() uint16 { return e.ID }
+
+// Type returns NodeUpEvent.
+func (NodeUp) Type() EventType { return NodeUpEvent }
+
+// NodeDown is a node that was lost, its ID is free from then
+// on.
+type NodeDown struct {
+	ID uint16
+}
+
+// NodeID returns the ID of the node.
+func (e NodeDown) NodeID() uint16 { return e.ID }
+
+// Type returns NodeDownEvent.
+func (NodeDown) Type() EventType { return NodeDownEvent }
+
+// Error is an error of a node. Err is either a decode error of
+// a packet read from the node or a *ConflictError.
+type Error struct {
+	ID  uint16
+	Err error
+}
+
+// NodeID returns the ID of the node.
+func (e Error) NodeID() uint16 { return e.ID }
+
+// Type returns ErrorEvent.
+func (Error) Type() EventType { return ErrorEvent }
+
+// paired is a node that was added to the allow-list.
+type paired struct {
+	PairedNode
+}
+
+func (e paired) NodeID() uint16 { return e.ID }
+
+func (paired) Type() EventType { return pairedEvent }
+
+// Backpressure decides what happens to the events of a
+// subscriber that is not keeping up.
+type Backpressure uint8
+
+const (
+	// Block waits for the subscriber to receive the event,
+	// holding back every other subscriber and the Listener.
+	Block Backpressure = iota
+	// DropOldestEvent drops the oldest event in the channel to
+	// make room for the new one.
+	DropOldestEvent
+)
+
+// Filter selects the events of a subscriber.
+type Filter struct {
+	// Nodes are the IDs of the nodes whose events are wanted,
+	// empty means every node.
+	Nodes []uint16
+	// Types are the types of the events wanted, empty means
+	// every type.
+	Types []EventType
+	// Buffer is the size of the channel, zero uses
+	// DefaultEventBuffer.
+	Buffer int
+	// Backpressure is what happens when the channel is full.
+	Backpressure Backpressure
+}
+
+func (f Filter) match(e Event) bool {
+	return matchAny(f.Nodes, e.NodeID()) && matchType(f.Types, e.Type())
+}
+
+func matchAny(ids []uint16, id uint16) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return len(ids) == 0
+}
+
+func matchType(types []EventType, t EventType) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return len(types) == 0
+}
+
+// subscriber is a channel of events. mu is held while sending so
+// that the channel is not closed under a send.
+type subscriber struct {
+	mu     sync.Mutex
+	c      chan Event
+	filter Filter
+	done   chan struct{}
+	closed bool
+}
+
+// send sends the event with the backpressure of the subscriber.
+func (s *subscriber) send(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.filter.Backpressure == Block {
+		select {
+		case s.c <- e:
+		case <-s.done:
+		}
+		return
+	}
+	for {
+		select {
+		case s.c <- e:
+			return
+		default:
+		}
+		select {
+		case <-s.c:
+		default:
+		}
+	}
+}
+
+// close closes the channel, a blocked send gives up first.
+func (s *subscriber) close() {
+	close(s.done)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.c)
+}
+
+// hub delivers the events to the subscribers.
+type hub struct {
+	mu     sync.Mutex
+	subs   map[<-chan Event]*subscriber
+	closed bool
+}
+
+func newHub() *hub {
+	return &hub{subs: map[<-chan Event]*subscriber{}}
+}
+
+func (h *hub) subscribe(f Filter) <-chan Event {
+	if f.Buffer <= 0 {
+		f.Buffer = DefaultEventBuffer
+	}
+	s := &subscriber{c: make(chan Event, f.Buffer), filter: f, done: make(chan struct{})}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(s.c)
+		return s.c
+	}
+	h.subs[s.c] = s
+	return s.c
+}
+
+func (h *hub) unsubscribe(c <-chan Event) {
+	h.mu.Lock()
+	s, ok := h.subs[c]
+	delete(h.subs, c)
+	h.mu.Unlock()
+	if ok {
+		s.close()
+	}
+}
+
+// publish sends the event to every subscriber it matches. It
+// must only be called from one goroutine so that every
+// subscriber sees the events in the same order.
+func (h *hub) publish(e Event) {
+	if e.Type() == pairedEvent {
+		return
+	}
+	h.mu.Lock()
+	subs := make([]*subscriber, 0, len(h.subs))
+	for _, s := range h.subs {
+		if s.filter.match(e) {
+			subs = append(subs, s)
+		}
+	}
+	h.mu.Unlock()
+	for _, s := range subs {
+		s.send(e)
+	}
+}
+
+// close closes the channel of every subscriber, later
+// subscribers get a closed channel.
+func (h *hub) close() {
+	h.mu.Lock()
+	subs := h.subs
+	h.subs = map[<-chan Event]*subscriber{}
+	h.closed = true
+	h.mu.Unlock()
+	for _, s := range subs {
+		s.close()
+	}
+}
+
+// Subscribe returns a channel with the events that match the
+// filter. The events of a node are delivered in the order they
+// happened: NodeUp, then its touches, keep alives and errors,
+// and NodeDown last. The channel is closed after the server
+// stops, once the final NodeDown events were delivered, or on
+// Unsubscribe. Subscribers with Block backpressure must keep
+// receiving until then or the server stalls.
+func (srv *Server) Subscribe(f Filter) <-chan Event {
+	return srv.hub.subscribe(f)
+}
+
+// Unsubscribe stops the delivery of events to the channel
+// returned by Subscribe and closes it.
+func (srv *Server) Unsubscribe(c <-chan Event) {
+	srv.hub.unsubscribe(c)
+}
@@ -0,0 +1,114 @@
+package qsy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	var (
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		conns       = make(chan net.Conn, 1)
+	)
+	defer cancel()
+	srv, err := NewServer(ctx, "", "", nil,
+		WithDiscoverer(NewStaticDiscoverer(Hello{ID: 18, Addr: "pipe"})),
+		WithDialer(pipeDialer(conns)))
+	if err != nil {
+		t.Fatalf("failed to create server: %s", err)
+	}
+	all := srv.Subscribe(Filter{})
+	touches := srv.Subscribe(Filter{Nodes: []uint16{18}, Types: []EventType{TouchEvent}})
+	other := srv.Subscribe(Filter{Nodes: []uint16{7}})
+	gone := srv.Subscribe(Filter{})
+	srv.Unsubscribe(gone)
+	if _, ok := <-gone; ok {
+		t.Fatalf("expected the channel to be closed after unsubscribing")
+	}
+	if err := srv.ListenAndAccept(); err != nil {
+		t.Fatalf("failed to start server: %s", err)
+	}
+	conn := <-conns
+	unknown := touchePacket()
+	unknown[TypeHeader] = 9
+	go func() {
+		for _, b := range [][]byte{keepAlivePacket(), touchePacket(), unknown, touchePacket()} {
+			conn.Write(b)
+		}
+		io.Copy(io.Discard, conn)
+	}()
+
+	want := []EventType{NodeUpEvent, KeepAliveEvent, TouchEvent, ErrorEvent, TouchEvent}
+	for i, w := range want {
+		if e := <-all; e.Type() != w || e.NodeID() != 18 {
+			t.Fatalf("expected event %v to be %s of node 18 but got %#v", i, w, e)
+		}
+	}
+	srv.Close()
+	conn.Close()
+	if e := <-all; e.Type() != NodeDownEvent || e.NodeID() != 18 {
+		t.Fatalf("expected node 18 to be down but got %#v", e)
+	}
+	if e, ok := <-all; ok {
+		t.Fatalf("expected the channel to be closed but got %#v", e)
+	}
+	for i := 0; i < 2; i++ {
+		if e := <-touches; e == nil || e.Type() != TouchEvent {
+			t.Fatalf("expected touch %v but got %#v", i, e)
+		}
+	}
+	if e, ok := <-touches; ok {
+		t.Fatalf("expected the channel to be closed but got %#v", e)
+	}
+	if e, ok := <-other; ok {
+		t.Fatalf("expected no events for node 7 but got %#v", e)
+	}
+	if _, ok := <-srv.Subscribe(Filter{}); ok {
+		t.Fatalf("expected a closed channel once the server is closed")
+	}
+}
+
+func TestSubscribeBackpressure(t *testing.T) {
+	t.Parallel()
+
+	h := newHub()
+	drop := h.subscribe(Filter{Types: []EventType{NodeUpEvent}, Buffer: 2, Backpressure: DropOldestEvent})
+	for id := uint16(1); id <= 5; id++ {
+		h.publish(NodeUp{ID: id})
+	}
+	for _, id := range []uint16{4, 5} {
+		if e := <-drop; e.NodeID() != id {
+			t.Fatalf("expected event of node %v but got %#v", id, e)
+		}
+	}
+
+	block := h.subscribe(Filter{Buffer: 1})
+	h.publish(NodeDown{ID: 1})
+	published := make(chan struct{})
+	go func() {
+		h.publish(NodeDown{ID: 2})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatalf("expected publish to block on a full subscriber")
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.unsubscribe(block)
+	<-published
+	if e := <-block; e.NodeID() != 1 {
+		t.Fatalf("expected the buffered event of node 1 but got %#v", e)
+	}
+	if _, ok := <-block; ok {
+		t.Fatalf("expected the channel to be closed")
+	}
+	h.close()
+	if _, ok := <-drop; ok {
+		t.Fatalf("expected the channel to be closed")
+	}
+}